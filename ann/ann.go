@@ -0,0 +1,149 @@
+// Package ann has in-process vector indexes that find the stored vectors closest to a query by cosine similarity.
+// Flat compares the query with every vector and is exact. HNSW walks a proximity graph and is approximate but much faster on big sets.
+// The scores are the cosine similarity of the vectors, the same as the search_score of the vector search in store,
+// so the same score thresholds apply.
+// The indexes are not safe for concurrent writes. Searches can run concurrently with each other
+package ann
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+const (
+	_FLAT = "flat"
+	_HNSW = "hnsw"
+)
+
+type Index interface {
+	// adds the vector or replaces the vector of an existing id
+	Add(id string, vec []float32) error
+	Remove(id string)
+	Contains(id string) bool
+	// the top_n vectors closest to the query, best first. accept filters the ids and can be nil
+	Search(query []float32, top_n int, accept func(id string) bool) []Result
+	Len() int
+	Dimensions() int
+	Save(w io.Writer) error
+}
+
+type Result struct {
+	ID    string
+	Score float64
+}
+
+type IndexError string
+
+func (err IndexError) Error() string {
+	return string(err)
+}
+
+// what gets saved. The vectors are saved normalized
+type indexFile struct {
+	Kind       string
+	Dimensions int
+	IDs        []string
+	Vectors    [][]float32
+	Graph      *hnswGraph // HNSW only
+}
+
+// reads an index that Save wrote
+func Load(r io.Reader) (Index, error) {
+	var file indexFile
+	if err := gob.NewDecoder(r).Decode(&file); err != nil {
+		return nil, err
+	}
+	if len(file.IDs) != len(file.Vectors) {
+		return nil, IndexError("corrupted index")
+	}
+	switch file.Kind {
+	case _FLAT:
+		return loadFlat(file), nil
+	case _HNSW:
+		return loadHNSW(file)
+	default:
+		return nil, IndexError(fmt.Sprintf("unknown index kind %s", file.Kind))
+	}
+}
+
+func LoadFile(file_path string) (Index, error) {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Load(bufio.NewReader(file))
+}
+
+// writes to a temporary file first and then renames it so that a crash in the middle doesn't leave a half written file
+func SaveFile(index Index, file_path string) error {
+	temp_path := file_path + ".tmp"
+	file, err := os.Create(temp_path)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	err = index.Save(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		os.Remove(temp_path)
+		return err
+	}
+	return os.Rename(temp_path, file_path)
+}
+
+func checkDimensions(vec []float32, dimensions int) error {
+	if len(vec) != dimensions {
+		return IndexError(fmt.Sprintf("vector has %d dimensions instead of %d", len(vec), dimensions))
+	}
+	return nil
+}
+
+// unit vector in the same direction. The zero vector stays as is and scores 0 against everything
+func normalize(vec []float32) []float32 {
+	var norm float64
+	for _, val := range vec {
+		norm += float64(val) * float64(val)
+	}
+	res := make([]float32, len(vec))
+	if norm == 0 {
+		return res
+	}
+	norm = math.Sqrt(norm)
+	for i, val := range vec {
+		res[i] = float32(float64(val) / norm)
+	}
+	return res
+}
+
+// cosine similarity of normalized vectors
+func dot(a, b []float32) float64 {
+	var res float64
+	for i := range a {
+		res += float64(a[i]) * float64(b[i])
+	}
+	return res
+}
+
+func sortResults(results []Result) []Result {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	return results
+}
@@ -0,0 +1,109 @@
+package ann
+
+import (
+	"container/heap"
+	"encoding/gob"
+	"io"
+)
+
+// Flat is the exact index. A search scores every vector
+type Flat struct {
+	dimensions int
+	ids        []string
+	vectors    [][]float32
+	positions  map[string]int
+}
+
+func NewFlat(dimensions int) *Flat {
+	return &Flat{dimensions: dimensions, positions: make(map[string]int)}
+}
+
+func loadFlat(file indexFile) *Flat {
+	index := NewFlat(file.Dimensions)
+	index.ids, index.vectors = file.IDs, file.Vectors
+	for i, id := range file.IDs {
+		index.positions[id] = i
+	}
+	return index
+}
+
+func (index *Flat) Add(id string, vec []float32) error {
+	if err := checkDimensions(vec, index.dimensions); err != nil {
+		return err
+	}
+	if pos, ok := index.positions[id]; ok {
+		index.vectors[pos] = normalize(vec)
+		return nil
+	}
+	index.positions[id] = len(index.ids)
+	index.ids = append(index.ids, id)
+	index.vectors = append(index.vectors, normalize(vec))
+	return nil
+}
+
+// the last vector takes the place of the removed one
+func (index *Flat) Remove(id string) {
+	pos, ok := index.positions[id]
+	if !ok {
+		return
+	}
+	last := len(index.ids) - 1
+	index.ids[pos], index.vectors[pos] = index.ids[last], index.vectors[last]
+	index.positions[index.ids[pos]] = pos
+	index.ids, index.vectors = index.ids[:last], index.vectors[:last]
+	delete(index.positions, id)
+}
+
+func (index *Flat) Search(query []float32, top_n int, accept func(id string) bool) []Result {
+	if len(query) != index.dimensions || top_n <= 0 {
+		return nil
+	}
+	query = normalize(query)
+	// the worst of the best top_n is on top
+	best := make(resultHeap, 0, top_n)
+	for i, vec := range index.vectors {
+		score := dot(query, vec)
+		if len(best) == top_n && score <= best[0].Score {
+			continue
+		}
+		if accept != nil && !accept(index.ids[i]) {
+			continue
+		}
+		if len(best) == top_n {
+			heap.Pop(&best)
+		}
+		heap.Push(&best, Result{ID: index.ids[i], Score: score})
+	}
+	return sortResults(best)
+}
+
+func (index *Flat) Contains(id string) bool {
+	_, ok := index.positions[id]
+	return ok
+}
+
+func (index *Flat) Len() int {
+	return len(index.ids)
+}
+
+func (index *Flat) Dimensions() int {
+	return index.dimensions
+}
+
+func (index *Flat) Save(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(indexFile{Kind: _FLAT, Dimensions: index.dimensions, IDs: index.ids, Vectors: index.vectors})
+}
+
+// min heap by score
+type resultHeap []Result
+
+func (h resultHeap) Len() int           { return len(h) }
+func (h resultHeap) Less(i, j int) bool { return h[i].Score < h[j].Score }
+func (h resultHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *resultHeap) Push(x any)        { *h = append(*h, x.(Result)) }
+func (h *resultHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,304 @@
+package ann
+
+import (
+	"container/heap"
+	"encoding/gob"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+const (
+	_DEFAULT_M               = 16
+	_DEFAULT_EF_CONSTRUCTION = 200
+	_DEFAULT_EF_SEARCH       = 64
+	_MIN_REBUILD_DELETES     = 64 // removed nodes stay in the graph until there are more of them than live ones and at least this many
+)
+
+// https://arxiv.org/abs/1603.09320
+type HNSWConfig struct {
+	M              int   // neighbors per node on the upper layers. Layer 0 has 2 x M. Default 16
+	EfConstruction int   // candidates considered for the neighbors of a new node. Default 200
+	EfSearch       int   // candidates considered by a search. It is at least top_n. Default 64
+	Seed           int64 // of the random node levels
+}
+
+// the graph as it gets saved
+type hnswGraph struct {
+	M              int
+	EfConstruction int
+	EfSearch       int
+	Levels         []int
+	Neighbors      [][][]int32 // node -> layer -> neighbor nodes
+	Deleted        []bool      // removed nodes still connect the graph but don't show up in the results
+	Entry          int         // -1 for an empty graph
+	MaxLevel       int
+}
+
+// HNSW is the approximate index. Removing a vector leaves its node in the graph for the searches to pass through.
+// The graph gets rebuilt once the removed nodes outnumber the live ones
+type HNSW struct {
+	dimensions int
+	ids        []string
+	vectors    [][]float32
+	graph      hnswGraph
+	positions  map[string]int // live node of each id
+	deleted    int
+	rng        *rand.Rand
+}
+
+func NewHNSW(dimensions int, config HNSWConfig) *HNSW {
+	if config.M <= 1 {
+		config.M = _DEFAULT_M
+	}
+	if config.EfConstruction <= 0 {
+		config.EfConstruction = _DEFAULT_EF_CONSTRUCTION
+	}
+	if config.EfSearch <= 0 {
+		config.EfSearch = _DEFAULT_EF_SEARCH
+	}
+	return &HNSW{
+		dimensions: dimensions,
+		graph:      hnswGraph{M: config.M, EfConstruction: config.EfConstruction, EfSearch: config.EfSearch, Entry: -1},
+		positions:  make(map[string]int),
+		rng:        rand.New(rand.NewSource(config.Seed)),
+	}
+}
+
+func loadHNSW(file indexFile) (*HNSW, error) {
+	graph := file.Graph
+	if graph == nil || len(graph.Levels) != len(file.IDs) || len(graph.Neighbors) != len(file.IDs) || len(graph.Deleted) != len(file.IDs) || graph.Entry >= len(file.IDs) {
+		return nil, IndexError("corrupted index")
+	}
+	index := NewHNSW(file.Dimensions, HNSWConfig{M: graph.M, EfConstruction: graph.EfConstruction, EfSearch: graph.EfSearch})
+	index.ids, index.vectors, index.graph = file.IDs, file.Vectors, *graph
+	for node, id := range file.IDs {
+		if graph.Deleted[node] {
+			index.deleted++
+		} else {
+			index.positions[id] = node
+		}
+	}
+	return index, nil
+}
+
+func (index *HNSW) Add(id string, vec []float32) error {
+	if err := checkDimensions(vec, index.dimensions); err != nil {
+		return err
+	}
+	if _, ok := index.positions[id]; ok {
+		index.Remove(id)
+	}
+	index.insert(id, normalize(vec))
+	return nil
+}
+
+func (index *HNSW) insert(id string, vec []float32) {
+	graph := &index.graph
+	node := len(index.ids)
+	level := int(math.Floor(-math.Log(1-index.rng.Float64()) / math.Log(float64(graph.M))))
+	index.ids = append(index.ids, id)
+	index.vectors = append(index.vectors, vec)
+	graph.Levels = append(graph.Levels, level)
+	graph.Neighbors = append(graph.Neighbors, make([][]int32, level+1))
+	graph.Deleted = append(graph.Deleted, false)
+	index.positions[id] = node
+	if graph.Entry < 0 {
+		graph.Entry, graph.MaxLevel = node, level
+		return
+	}
+
+	current := graph.Entry
+	for layer := graph.MaxLevel; layer > level; layer-- {
+		current = index.closestNeighbor(vec, current, layer)
+	}
+	entries := []int{current}
+	for layer := min(level, graph.MaxLevel); layer >= 0; layer-- {
+		candidates := index.searchLayer(vec, entries, graph.EfConstruction, layer, func(n int) bool { return !graph.Deleted[n] })
+		neighbors := make([]int32, 0, graph.M)
+		for _, candidate := range candidates {
+			if len(neighbors) == graph.M {
+				break
+			}
+			neighbors = append(neighbors, int32(candidate.node))
+		}
+		graph.Neighbors[node][layer] = neighbors
+		for _, neighbor := range neighbors {
+			index.connect(int(neighbor), node, layer)
+		}
+		if len(candidates) > 0 {
+			entries = entries[:0]
+			for _, candidate := range candidates {
+				entries = append(entries, candidate.node)
+			}
+		}
+	}
+	if level > graph.MaxLevel {
+		graph.Entry, graph.MaxLevel = node, level
+	}
+}
+
+// adds node to the neighbors of from and drops the farthest one if from has too many
+func (index *HNSW) connect(from, node, layer int) {
+	graph := &index.graph
+	max_neighbors := graph.M
+	if layer == 0 {
+		max_neighbors = 2 * graph.M
+	}
+	neighbors := append(graph.Neighbors[from][layer], int32(node))
+	if len(neighbors) > max_neighbors {
+		vec := index.vectors[from]
+		sort.Slice(neighbors, func(i, j int) bool {
+			return dot(vec, index.vectors[neighbors[i]]) > dot(vec, index.vectors[neighbors[j]])
+		})
+		neighbors = neighbors[:max_neighbors]
+	}
+	graph.Neighbors[from][layer] = neighbors
+}
+
+func (index *HNSW) Remove(id string) {
+	node, ok := index.positions[id]
+	if !ok {
+		return
+	}
+	index.graph.Deleted[node] = true
+	delete(index.positions, id)
+	index.deleted++
+	if index.deleted >= _MIN_REBUILD_DELETES && index.deleted > len(index.positions) {
+		index.rebuild()
+	}
+}
+
+// a new graph of the live nodes
+func (index *HNSW) rebuild() {
+	rebuilt := NewHNSW(index.dimensions, HNSWConfig{M: index.graph.M, EfConstruction: index.graph.EfConstruction, EfSearch: index.graph.EfSearch, Seed: index.rng.Int63()})
+	for node, id := range index.ids {
+		if !index.graph.Deleted[node] {
+			rebuilt.insert(id, index.vectors[node])
+		}
+	}
+	*index = *rebuilt
+}
+
+func (index *HNSW) Search(query []float32, top_n int, accept func(id string) bool) []Result {
+	graph := &index.graph
+	if len(query) != index.dimensions || top_n <= 0 || graph.Entry < 0 {
+		return nil
+	}
+	query = normalize(query)
+	current := graph.Entry
+	for layer := graph.MaxLevel; layer > 0; layer-- {
+		current = index.closestNeighbor(query, current, layer)
+	}
+	candidates := index.searchLayer(query, []int{current}, max(graph.EfSearch, top_n), 0, func(n int) bool {
+		return !graph.Deleted[n] && (accept == nil || accept(index.ids[n]))
+	})
+	results := make([]Result, 0, min(top_n, len(candidates)))
+	for _, candidate := range candidates[:min(top_n, len(candidates))] {
+		results = append(results, Result{ID: index.ids[candidate.node], Score: candidate.score})
+	}
+	return sortResults(results)
+}
+
+// greedy walk on the layer towards the query
+func (index *HNSW) closestNeighbor(query []float32, current, layer int) int {
+	best := dot(query, index.vectors[current])
+	for changed := true; changed; {
+		changed = false
+		for _, neighbor := range index.graph.Neighbors[current][layer] {
+			if score := dot(query, index.vectors[neighbor]); score > best {
+				best, current, changed = score, int(neighbor), true
+			}
+		}
+	}
+	return current
+}
+
+type scoredNode struct {
+	node  int
+	score float64
+}
+
+// best first search on the layer. Returns up to ef accepted nodes, best first.
+// Nodes that are not accepted are still walked through so that a filter doesn't cut the graph
+func (index *HNSW) searchLayer(query []float32, entries []int, ef, layer int, accept func(n int) bool) []scoredNode {
+	visited := make(map[int]bool, ef*2)
+	candidates := &nodeHeap{best_first: true}
+	results := &nodeHeap{}
+	for _, entry := range entries {
+		if visited[entry] {
+			continue
+		}
+		visited[entry] = true
+		scored := scoredNode{node: entry, score: dot(query, index.vectors[entry])}
+		heap.Push(candidates, scored)
+		if accept(entry) {
+			heap.Push(results, scored)
+		}
+	}
+	for candidates.Len() > 0 {
+		closest := heap.Pop(candidates).(scoredNode)
+		if results.Len() >= ef && closest.score < results.nodes[0].score {
+			break
+		}
+		for _, neighbor := range index.graph.Neighbors[closest.node][layer] {
+			n := int(neighbor)
+			if visited[n] {
+				continue
+			}
+			visited[n] = true
+			scored := scoredNode{node: n, score: dot(query, index.vectors[n])}
+			if results.Len() < ef || scored.score > results.nodes[0].score {
+				heap.Push(candidates, scored)
+				if accept(n) {
+					heap.Push(results, scored)
+					if results.Len() > ef {
+						heap.Pop(results)
+					}
+				}
+			}
+		}
+	}
+	sorted := results.nodes
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].score > sorted[j].score })
+	return sorted
+}
+
+func (index *HNSW) Contains(id string) bool {
+	_, ok := index.positions[id]
+	return ok
+}
+
+func (index *HNSW) Len() int {
+	return len(index.positions)
+}
+
+func (index *HNSW) Dimensions() int {
+	return index.dimensions
+}
+
+func (index *HNSW) Save(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(indexFile{Kind: _HNSW, Dimensions: index.dimensions, IDs: index.ids, Vectors: index.vectors, Graph: &index.graph})
+}
+
+// worst first unless best_first
+type nodeHeap struct {
+	nodes      []scoredNode
+	best_first bool
+}
+
+func (h *nodeHeap) Len() int { return len(h.nodes) }
+func (h *nodeHeap) Less(i, j int) bool {
+	if h.best_first {
+		return h.nodes[i].score > h.nodes[j].score
+	}
+	return h.nodes[i].score < h.nodes[j].score
+}
+func (h *nodeHeap) Swap(i, j int) { h.nodes[i], h.nodes[j] = h.nodes[j], h.nodes[i] }
+func (h *nodeHeap) Push(x any)    { h.nodes = append(h.nodes, x.(scoredNode)) }
+func (h *nodeHeap) Pop() any {
+	item := h.nodes[len(h.nodes)-1]
+	h.nodes = h.nodes[:len(h.nodes)-1]
+	return item
+}
@@ -0,0 +1,174 @@
+package ann
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func randomVectors(n, dimensions int, seed int64) [][]float32 {
+	rng := rand.New(rand.NewSource(seed))
+	vectors := make([][]float32, n)
+	for i := range vectors {
+		vectors[i] = make([]float32, dimensions)
+		for j := range vectors[i] {
+			vectors[i][j] = rng.Float32()*2 - 1
+		}
+	}
+	return vectors
+}
+
+func TestHNSWFindsTheSameVector(t *testing.T) {
+	index := NewHNSW(8, HNSWConfig{Seed: 1})
+	vectors := randomVectors(200, 8, 1)
+	for i, vec := range vectors {
+		if err := index.Add(fmt.Sprint(i), vec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if index.Len() != len(vectors) {
+		t.Fatalf("expected %d vectors, got %d", len(vectors), index.Len())
+	}
+	for i, vec := range vectors {
+		results := index.Search(vec, 1, nil)
+		if len(results) != 1 || results[0].ID != fmt.Sprint(i) {
+			t.Fatalf("vector %d: expected itself as the closest, got %v", i, results)
+		}
+		if results[0].Score < 0.999 {
+			t.Fatalf("vector %d: expected a score of 1, got %f", i, results[0].Score)
+		}
+	}
+}
+
+func TestHNSWMatchesFlat(t *testing.T) {
+	hnsw, flat := NewHNSW(16, HNSWConfig{Seed: 2}), NewFlat(16)
+	for i, vec := range randomVectors(500, 16, 2) {
+		hnsw.Add(fmt.Sprint(i), vec)
+		flat.Add(fmt.Sprint(i), vec)
+	}
+	// the graph is approximate so it only has to find most of the exact top 10
+	found, total := 0, 0
+	for _, query := range randomVectors(20, 16, 3) {
+		exact := make(map[string]bool)
+		for _, res := range flat.Search(query, 10, nil) {
+			exact[res.ID] = true
+		}
+		for _, res := range hnsw.Search(query, 10, nil) {
+			if exact[res.ID] {
+				found++
+			}
+		}
+		total += len(exact)
+	}
+	if recall := float64(found) / float64(total); recall < 0.9 {
+		t.Fatalf("expected a recall of at least 0.9, got %f", recall)
+	}
+}
+
+func TestHNSWRemove(t *testing.T) {
+	index := NewHNSW(4, HNSWConfig{Seed: 3})
+	vectors := randomVectors(20, 4, 4)
+	for i, vec := range vectors {
+		index.Add(fmt.Sprint(i), vec)
+	}
+	index.Remove("5")
+	index.Remove("unknown")
+	if index.Contains("5") || index.Len() != 19 {
+		t.Fatalf("expected 5 to be gone and 19 vectors, got %v and %d", index.Contains("5"), index.Len())
+	}
+	for _, res := range index.Search(vectors[5], 20, nil) {
+		if res.ID == "5" {
+			t.Fatal("removed vector showed up in the results")
+		}
+	}
+
+	// adding an existing id replaces its vector
+	index.Add("6", vectors[5])
+	if results := index.Search(vectors[5], 1, nil); len(results) != 1 || results[0].ID != "6" {
+		t.Fatalf("expected the new vector of 6, got %v", results)
+	}
+	if index.Len() != 19 {
+		t.Fatalf("expected 19 vectors after the replace, got %d", index.Len())
+	}
+}
+
+func TestHNSWRebuild(t *testing.T) {
+	index := NewHNSW(8, HNSWConfig{Seed: 4})
+	vectors := randomVectors(3*_MIN_REBUILD_DELETES, 8, 5)
+	for i, vec := range vectors {
+		index.Add(fmt.Sprint(i), vec)
+	}
+	// removing more than half of them rebuilds the graph with the live ones only
+	removed := 2 * _MIN_REBUILD_DELETES
+	for i := 0; i < removed; i++ {
+		index.Remove(fmt.Sprint(i))
+	}
+	if len(index.ids) >= len(vectors) || len(index.ids) != index.Len()+index.deleted || index.Len() != len(vectors)-removed {
+		t.Fatalf("expected a rebuilt graph, got %d nodes with %d deleted", len(index.ids), index.deleted)
+	}
+	for i := removed; i < len(vectors); i++ {
+		results := index.Search(vectors[i], 1, nil)
+		if len(results) != 1 || results[0].ID != fmt.Sprint(i) {
+			t.Fatalf("vector %d: expected itself after the rebuild, got %v", i, results)
+		}
+	}
+}
+
+func TestHNSWSearchFilter(t *testing.T) {
+	index := NewHNSW(4, HNSWConfig{Seed: 5})
+	vectors := randomVectors(50, 4, 6)
+	for i, vec := range vectors {
+		index.Add(fmt.Sprint(i), vec)
+	}
+	results := index.Search(vectors[0], 5, func(id string) bool { return id != "0" })
+	if len(results) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(results))
+	}
+	for i, res := range results {
+		if res.ID == "0" {
+			t.Fatal("filtered out id showed up in the results")
+		}
+		if i > 0 && res.Score > results[i-1].Score {
+			t.Fatalf("results are not sorted by score: %v", results)
+		}
+	}
+}
+
+func TestHNSWSaveAndLoad(t *testing.T) {
+	index := NewHNSW(4, HNSWConfig{Seed: 6})
+	vectors := randomVectors(30, 4, 7)
+	for i, vec := range vectors {
+		index.Add(fmt.Sprint(i), vec)
+	}
+	index.Remove("3")
+
+	var buf bytes.Buffer
+	if err := index.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len() != index.Len() || loaded.Dimensions() != 4 || loaded.Contains("3") {
+		t.Fatalf("loaded index differs: %d vectors, %d dimensions, contains 3: %v", loaded.Len(), loaded.Dimensions(), loaded.Contains("3"))
+	}
+	for _, query := range randomVectors(5, 4, 8) {
+		expected, actual := index.Search(query, 5, nil), loaded.Search(query, 5, nil)
+		if fmt.Sprint(expected) != fmt.Sprint(actual) {
+			t.Fatalf("expected %v, got %v", expected, actual)
+		}
+	}
+}
+
+func TestCheckDimensions(t *testing.T) {
+	for _, index := range []Index{NewHNSW(3, HNSWConfig{}), NewFlat(3)} {
+		if err := index.Add("a", []float32{1, 2}); err == nil {
+			t.Fatalf("%T: expected an error for the wrong number of dimensions", index)
+		}
+		if results := index.Search([]float32{1, 2}, 1, nil); len(results) != 0 {
+			t.Fatalf("%T: expected no results for the wrong number of dimensions, got %v", index, results)
+		}
+	}
+}
@@ -10,7 +10,9 @@ require (
 	github.com/pkoukk/tiktoken-go v0.1.6
 	github.com/soumitsalman/data-utils v0.0.0-20240411181743-1067a6fce2ca
 	github.com/tmc/langchaingo v0.1.10
+	go.etcd.io/bbolt v1.3.10
 	go.mongodb.org/mongo-driver v1.15.0
+	golang.org/x/sync v0.7.0
 )
 
 require github.com/imdario/mergo v0.3.13 // indirect
@@ -84,6 +86,5 @@ require (
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20240424034433-3c2c7870ae76 // indirect
 	golang.org/x/crypto v0.23.0 // indirect
-	golang.org/x/sync v0.7.0 // indirect
 	golang.org/x/text v0.15.0 // indirect
 )
@@ -0,0 +1,69 @@
+package nlp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const (
+	EMBEDDINGS_SERVICE = "embeddings-service"
+	HUGGINGFACE        = "huggingface"
+)
+
+const (
+	_DEFAULT_EMBEDDINGS_MODEL      = "nomic-ai/nomic-embed-text-v1"
+	_DEFAULT_EMBEDDINGS_DIMENSIONS = 768
+)
+
+// Creates text embeddings with one model
+type Embedder interface {
+	// returns one embedding per text in the same order. task_type is one of SEARCH_QUERY, SEARCH_DOCUMENT, CLASSIFICATION or SIMILARITY.
+	// Texts that fail get nil duds and the error is returned along with the rest
+	CreateBatchTextEmbeddings(ctx context.Context, texts []string, task_type string) ([][]float32, error)
+	// size of the embeddings
+	Dimensions() int
+	// name of the model. Embeddings of different models can't be compared
+	ModelID() string
+}
+
+// what NewEmbedder passes to the driver. Empty fields get the defaults of the driver
+type EmbedderConfig struct {
+	// name of a registered driver. Default is EMBEDDINGS_SERVICE
+	Driver  string
+	BaseURL string
+	Model   string
+	APIKey  string
+	// size of the embeddings of Model. The drivers only know it for their default model
+	Dimensions int
+}
+
+type EmbedderFactory func(config EmbedderConfig) (Embedder, error)
+
+// embedders are picked based on the Driver of the config
+var embedder_factories = map[string]EmbedderFactory{}
+
+// Registers an embedder factory for a driver name such as "huggingface".
+// Registering the same name again replaces the existing factory
+func RegisterEmbedder(driver string, factory EmbedderFactory) {
+	embedder_factories[strings.ToLower(driver)] = factory
+}
+
+func NewEmbedder(config EmbedderConfig) (Embedder, error) {
+	if config.Driver == "" {
+		config.Driver = EMBEDDINGS_SERVICE
+	}
+	factory, ok := embedder_factories[strings.ToLower(config.Driver)]
+	if !ok {
+		return nil, EmbeddingServerError(fmt.Sprintf("no embedder registered for driver %s", config.Driver))
+	}
+	return factory(config)
+}
+
+// nomic models take the task type as a prefix of the text
+func withTaskType(text, task_type string) string {
+	if len(task_type) > 0 {
+		text = fmt.Sprintf("%s: %s", task_type, text)
+	}
+	return text
+}
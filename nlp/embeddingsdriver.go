@@ -1,6 +1,8 @@
 package nlp
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 
@@ -32,14 +34,32 @@ func (err EmbeddingServerError) Error() string {
 	return string(err)
 }
 
+func init() {
+	RegisterEmbedder(EMBEDDINGS_SERVICE, func(config EmbedderConfig) (Embedder, error) {
+		driver := NewEmbeddingsDriver(config.BaseURL)
+		if len(config.Model) > 0 {
+			driver.model = config.Model
+		}
+		if config.Dimensions > 0 {
+			driver.dimensions = config.Dimensions
+		}
+		return driver, nil
+	})
+}
+
+// client of the embeddings service. It serves nomic-embed-text-v1 by default
 type EmbeddingsDriver struct {
-	embed_url string
+	embed_url  string
+	model      string
+	dimensions int
 	// splitter  textsplitter.TokenSplitter
 }
 
 func NewEmbeddingsDriver(base_url string) *EmbeddingsDriver {
 	driver := &EmbeddingsDriver{
-		embed_url: _EMBEDDER_BASE_URL,
+		embed_url:  _EMBEDDER_BASE_URL,
+		model:      _DEFAULT_EMBEDDINGS_MODEL,
+		dimensions: _DEFAULT_EMBEDDINGS_DIMENSIONS,
 	}
 	if len(base_url) > 0 {
 		driver.embed_url = base_url
@@ -47,41 +67,45 @@ func NewEmbeddingsDriver(base_url string) *EmbeddingsDriver {
 	return driver
 }
 
-func (driver *EmbeddingsDriver) CreateBatchTextEmbeddings(texts []string, task_type string) [][]float32 {
+func (driver *EmbeddingsDriver) Dimensions() int {
+	return driver.dimensions
+}
+
+func (driver *EmbeddingsDriver) ModelID() string {
+	return driver.model
+}
+
+// returns one embedding per text in the same order. If the embeddings generation fails for a batch,
+// nil duds are inserted for that batch so that the sequence is maintained and the error is returned along with the rest
+func (driver *EmbeddingsDriver) CreateBatchTextEmbeddings(ctx context.Context, texts []string, task_type string) ([][]float32, error) {
 	// if the count is over the window size split in half and try
 	if CountTokens(texts) > _EMBEDDER_WINDOW {
-		return append(
-			driver.CreateBatchTextEmbeddings(texts[:len(texts)/2], task_type),
-			driver.CreateBatchTextEmbeddings(texts[len(texts)/2:], task_type)...)
+		first, first_err := driver.CreateBatchTextEmbeddings(ctx, texts[:len(texts)/2], task_type)
+		second, second_err := driver.CreateBatchTextEmbeddings(ctx, texts[len(texts)/2:], task_type)
+		return append(first, second...), errors.Join(first_err, second_err)
 	}
-	input_texts := datautils.Transform(texts, func(item *string) string { return driver.toEmbeddingInput(*item, task_type) })
-	embs := driver.createEmbeddings(&inferenceInput{input_texts})
+	input_texts := datautils.Transform(texts, func(item *string) string { return withTaskType(*item, task_type) })
+	embs, err := driver.createEmbeddings(ctx, &inferenceInput{input_texts})
 	// if the embeddings generation is failing insert duds
-	if embs == nil {
-		return make([][]float32, len(texts))
-	}
-	return embs
-}
-
-func (driver *EmbeddingsDriver) CreateTextEmbeddings(text string, task_type string) []float32 {
-	output := driver.createEmbeddings(&inferenceInput{[]string{driver.toEmbeddingInput(text, task_type)}})
-	if len(output) >= 1 {
-		return output[0]
+	if err != nil {
+		return make([][]float32, len(texts)), err
 	}
-	return nil
+	return embs, nil
 }
 
-func (driver *EmbeddingsDriver) toEmbeddingInput(text, task_type string) string {
-	if len(task_type) > 0 {
-		text = fmt.Sprintf("%s: %s", task_type, text)
+func (driver *EmbeddingsDriver) CreateTextEmbeddings(ctx context.Context, text string, task_type string) ([]float32, error) {
+	output, err := driver.createEmbeddings(ctx, &inferenceInput{[]string{withTaskType(text, task_type)}})
+	if err != nil {
+		return nil, err
 	}
-	return text
+	return output[0], nil
 }
 
-func (driver *EmbeddingsDriver) createEmbeddings(input *inferenceInput) [][]float32 {
+func (driver *EmbeddingsDriver) createEmbeddings(ctx context.Context, input *inferenceInput) ([][]float32, error) {
 	return retryT(
+		ctx,
 		func() ([][]float32, error) {
-			if embs, err := postHTTPRequest[[][]float32](driver.embed_url, "", input); err != nil {
+			if embs, err := postHTTPRequest[[][]float32](ctx, driver.embed_url, "", input); err != nil {
 				log.Printf("[EmbeddingsDriver] Embedding generation failed. %v\n", err)
 				return nil, err
 			} else if len(embs) != len(input.Inputs) {
@@ -6,12 +6,15 @@ import (
 	// "github.com/tmc/langchaingo/vectorstores"
 
 	// llms "github.com/tmc/langchaingo/llms"
-	ctx "context"
+	"context"
+	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/avast/retry-go"
+	datautils "github.com/soumitsalman/data-utils"
 	hfemb "github.com/tmc/langchaingo/embeddings/huggingface"
 	hfllm "github.com/tmc/langchaingo/llms/huggingface"
 	"github.com/tmc/langchaingo/textsplitter"
@@ -22,25 +25,50 @@ const (
 )
 
 const (
-	_EMBEDDINGS_MODEL = "nomic-ai/nomic-embed-text-v1"
 	// _KEYWORDS_MODEL   = "ilsilfverskiold/tech-keywords-extractor"
 	_SUMMARY_MODEL   = "google/flan-t5-base"
 	_TEXT_CHUNK_SIZE = 8192
 )
 
+func init() {
+	RegisterEmbedder(HUGGINGFACE, func(config EmbedderConfig) (Embedder, error) {
+		driver := NewHuggingfaceDriver(config.APIKey, config.Model)
+		if driver == nil {
+			return nil, EmbeddingServerError("couldn't set up the huggingface embedder")
+		}
+		if config.Dimensions > 0 {
+			driver.dimensions = config.Dimensions
+		}
+		return driver, nil
+	})
+}
+
 type HuggingfaceDriver struct {
 	// small_embedder *hfemb.Huggingface
 	embedder       *hfemb.Huggingface
+	model          string
+	dimensions     int
 	text_splitter  textsplitter.TokenSplitter
 	keywords_model *hfllm.LLM
 	summary_moodel *hfllm.LLM
 }
 
-func NewHuggingfaceDriver() *HuggingfaceDriver {
-	emb_llm, _ := hfllm.New(hfllm.WithToken(getHuggingfaceToken()))
-	embedder, err := hfemb.NewHuggingface(hfemb.WithClient(*emb_llm), hfemb.WithModel(_EMBEDDINGS_MODEL))
+// api_key defaults to HUGGINGFACE_API_TOKEN and model to nomic-ai/nomic-embed-text-v1
+func NewHuggingfaceDriver(api_key, model string) *HuggingfaceDriver {
+	if len(api_key) == 0 {
+		api_key = getHuggingfaceToken()
+	}
+	if len(model) == 0 {
+		model = _DEFAULT_EMBEDDINGS_MODEL
+	}
+	emb_llm, err := hfllm.New(hfllm.WithToken(api_key))
 	if err != nil {
-		log.Printf("[NewHuggingfaceDriver] Failed Loading %s. %v\n", _EMBEDDINGS_MODEL, err)
+		log.Printf("[NewHuggingfaceDriver] Failed Loading %s. %v\n", model, err)
+		return nil
+	}
+	embedder, err := hfemb.NewHuggingface(hfemb.WithClient(*emb_llm), hfemb.WithModel(model))
+	if err != nil {
+		log.Printf("[NewHuggingfaceDriver] Failed Loading %s. %v\n", model, err)
 		return nil
 	}
 	// keywords_model, err := hfllm.New(hfllm.WithToken(getHuggingfaceToken()), hfllm.WithModel(_KEYWORDS_MODEL))
@@ -48,7 +76,7 @@ func NewHuggingfaceDriver() *HuggingfaceDriver {
 	// 	log.Printf("[NewHuggingfaceDriver] Failed Loading %s. %v\n", _KEYWORDS_MODEL, err)
 	// 	return nil
 	// }
-	summary_model, err := hfllm.New(hfllm.WithToken(getHuggingfaceToken()), hfllm.WithModel(_SUMMARY_MODEL))
+	summary_model, err := hfllm.New(hfllm.WithToken(api_key), hfllm.WithModel(_SUMMARY_MODEL))
 	if err != nil {
 		log.Printf("[NewHuggingfaceDriver] Failed Loading %s. %v\n", _SUMMARY_MODEL, err)
 		return nil
@@ -56,36 +84,48 @@ func NewHuggingfaceDriver() *HuggingfaceDriver {
 	return &HuggingfaceDriver{
 		text_splitter: textsplitter.NewTokenSplitter(textsplitter.WithChunkSize(_TEXT_CHUNK_SIZE)),
 		embedder:      embedder,
+		model:         model,
+		dimensions:    _DEFAULT_EMBEDDINGS_DIMENSIONS,
 		// keywords_model: keywords_model,
 		summary_moodel: summary_model,
 	}
 }
 
-func (driver *HuggingfaceDriver) CreateTextEmbeddings(text string) ([]float32, error) {
-	var res []float32
-	retry.Do(func() error {
-		vecs, err := driver.embedder.EmbedDocuments(ctx.Background(), []string{text})
-		if err != nil {
-			log.Printf("[Huggingface Driver | %s]: error generating embeddings.%v\n", _EMBEDDINGS_MODEL, err)
-			return err
-		}
-		res = vecs[0]
-		return nil
-	}, retry.Delay(_RETRY_DELAY))
-	return res, nil
+func (driver *HuggingfaceDriver) Dimensions() int {
+	return driver.dimensions
 }
 
-func (driver *HuggingfaceDriver) CreateBatchTextEmbeddings(texts []string) ([][]float32, error) {
+func (driver *HuggingfaceDriver) ModelID() string {
+	return driver.model
+}
+
+func (driver *HuggingfaceDriver) CreateTextEmbeddings(ctx context.Context, text string, task_type string) ([]float32, error) {
+	vecs, err := driver.CreateBatchTextEmbeddings(ctx, []string{text}, task_type)
+	return vecs[0], err
+}
+
+// returns one embedding per text in the same order. If the model is still failing after the retries
+// nil duds are returned for all the texts along with the error
+func (driver *HuggingfaceDriver) CreateBatchTextEmbeddings(ctx context.Context, texts []string, task_type string) ([][]float32, error) {
+	if strings.Contains(driver.model, "nomic") {
+		texts = datautils.Transform(texts, func(item *string) string { return withTaskType(*item, task_type) })
+	}
 	var res [][]float32
-	retry.Do(func() error {
-		vecs, err := driver.embedder.EmbedDocuments(ctx.Background(), texts)
+	err := retry.Do(func() error {
+		vecs, err := driver.embedder.EmbedDocuments(ctx, texts)
 		if err != nil {
-			log.Printf("[Huggingface Driver | %s]: error generating embeddings.%v\n", _EMBEDDINGS_MODEL, err)
+			log.Printf("[Huggingface Driver | %s]: error generating embeddings.%v\n", driver.model, err)
 			return err
 		}
+		if len(vecs) != len(texts) {
+			return EmbeddingServerError(fmt.Sprintf("[Huggingface Driver | %s]: expected %d embeddings. Generated %d", driver.model, len(texts), len(vecs)))
+		}
 		res = vecs
 		return nil
-	}, retry.Delay(_RETRY_DELAY))
+	}, retry.Context(ctx), retry.Delay(_RETRY_DELAY), retry.Attempts(RETRY_ATTEMPTS), retry.LastErrorOnly(true))
+	if err != nil {
+		return make([][]float32, len(texts)), err
+	}
 	return res, nil
 }
 
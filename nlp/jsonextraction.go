@@ -32,9 +32,12 @@ const (
 
 type JsonValueExtraction struct {
 	llm_chain *chains.LLMChain
+	// LLMChain only keeps the callback handler of its options so the rest go with each call
+	options []chains.ChainCallOption
 }
 
-func NewJsonValueExtraction[T any](llm llms.Model, sample_input string, sample_output *T) *JsonValueExtraction {
+// options are the default call options of the chain such as temperature and seed. Default is temperature 0.1 and seed 1000
+func NewJsonValueExtraction[T any](llm llms.Model, sample_input string, sample_output *T, options ...chains.ChainCallOption) *JsonValueExtraction {
 	parser := NewJsonOutputParser[T](*sample_output)
 
 	prompt := prompts.NewChatPromptTemplate([]prompts.MessageFormatter{
@@ -58,15 +61,19 @@ func NewJsonValueExtraction[T any](llm llms.Model, sample_input string, sample_o
 	// )
 	// internal_chain := chains.NewLLMChain(llm, keyconcept_prompt, chains.WithTemperature(0))
 
-	internal_chain := chains.NewLLMChain(llm, prompt, chains.WithTemperature(0.1), chains.WithSeed(1000))
+	if len(options) == 0 {
+		options = []chains.ChainCallOption{chains.WithTemperature(_DEFAULT_TEMPERATURE), chains.WithSeed(_DEFAULT_SEED)}
+	}
+	internal_chain := chains.NewLLMChain(llm, prompt)
 	internal_chain.OutputParser = parser
 	internal_chain.OutputKey = _DEFAULT_OUTPUT_KEY
 
-	return &JsonValueExtraction{internal_chain}
+	return &JsonValueExtraction{llm_chain: internal_chain, options: options}
 }
 
 func (c JsonValueExtraction) Call(ctx context.Context, values map[string]any, options ...chains.ChainCallOption) (map[string]any, error) {
-	return c.llm_chain.Call(ctx, values, options...)
+	// the options of the call override the defaults
+	return c.llm_chain.Call(ctx, values, append(append([]chains.ChainCallOption{}, c.options...), options...)...)
 }
 
 // GetMemory returns the memory.
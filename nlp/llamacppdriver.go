@@ -0,0 +1,89 @@
+//go:build llamacpp
+
+package nlp
+
+// go-llama.cpp links against llama.cpp through cgo so it is left out of the default build.
+// Build its bindings, point go.mod at the checkout with a replace directive and build with -tags llamacpp
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"sync"
+
+	llama "github.com/go-skynet/go-llama.cpp"
+	"github.com/tmc/langchaingo/llms"
+)
+
+const (
+	// upper bound of the output when the caller doesn't set one
+	_LLAMA_MAX_TOKENS = 2048
+)
+
+// the model is loaded once and serves one prediction at a time
+type llamaModel struct {
+	lock  sync.Mutex
+	model *llama.LLama
+}
+
+func newLlamaModel(model_path string, context_window int) (llms.Model, error) {
+	model, err := llama.New(model_path, llama.SetContext(context_window))
+	if err != nil {
+		return nil, err
+	}
+	return &llamaModel{model: model}, nil
+}
+
+func (llm *llamaModel) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	opts := llms.CallOptions{Temperature: _DEFAULT_TEMPERATURE, Seed: _DEFAULT_SEED, MaxTokens: _LLAMA_MAX_TOKENS}
+	for _, opt := range options {
+		opt(&opts)
+	}
+	predict_opts := []llama.PredictOption{
+		llama.SetTemperature(float32(opts.Temperature)),
+		llama.SetSeed(opts.Seed),
+		llama.SetTokens(opts.MaxTokens),
+		llama.SetThreads(runtime.NumCPU()),
+	}
+	if len(opts.StopWords) > 0 {
+		predict_opts = append(predict_opts, llama.SetStopWords(opts.StopWords...))
+	}
+
+	llm.lock.Lock()
+	defer llm.lock.Unlock()
+	text, err := llm.model.Predict(chatPrompt(messages), predict_opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{{Content: strings.TrimSpace(text)}}}, nil
+}
+
+func (llm *llamaModel) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, llm, prompt, options...)
+}
+
+// a plain role tagged transcript that instruction tuned models follow well enough without their own chat template
+func chatPrompt(messages []llms.MessageContent) string {
+	var prompt strings.Builder
+	for _, msg := range messages {
+		switch msg.Role {
+		case llms.ChatMessageTypeSystem:
+			prompt.WriteString("### System:\n")
+		case llms.ChatMessageTypeAI:
+			prompt.WriteString("### Assistant:\n")
+		default:
+			prompt.WriteString("### User:\n")
+		}
+		for _, part := range msg.Parts {
+			if text, ok := part.(llms.TextContent); ok {
+				prompt.WriteString(text.Text)
+			}
+		}
+		prompt.WriteString("\n\n")
+	}
+	prompt.WriteString("### Assistant:\n")
+	return prompt.String()
+}
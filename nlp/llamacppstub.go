@@ -0,0 +1,9 @@
+//go:build !llamacpp
+
+package nlp
+
+import "github.com/tmc/langchaingo/llms"
+
+func newLlamaModel(model_path string, context_window int) (llms.Model, error) {
+	return nil, LLMProviderError("llamacpp support isn't built in. Build with -tags llamacpp")
+}
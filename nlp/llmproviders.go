@@ -0,0 +1,197 @@
+package nlp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+// where the parrotbox models run. All but LLAMACPP are OpenAI compatible chat completion endpoints
+type LLMProvider string
+
+const (
+	GROQ   LLMProvider = "groq"
+	OPENAI LLMProvider = "openai"
+	// ollama serve. The model has to be pulled first
+	OLLAMA LLMProvider = "ollama"
+	// llama.cpp's llama-server. It serves whichever model it was started with
+	LLAMACPP_SERVER LLMProvider = "llamacpp-server"
+	// runs a gguf model in process through go-llama.cpp. Needs the llamacpp build tag
+	LLAMACPP LLMProvider = "llamacpp"
+)
+
+const (
+	_DEFAULT_MODEL          = "llama3-8b-8192"
+	_DEFAULT_CONTEXT_WINDOW = 8192
+	// room for the instructions, the samples and the output. What is left of the context window goes to the input texts
+	_PROMPT_RESERVE      = 2048
+	_DEFAULT_TEMPERATURE = 0.1
+	_DEFAULT_SEED        = 1000
+	// local servers don't check the key but the openai client doesn't start without one
+	_NO_API_KEY = "none"
+)
+
+var default_base_urls = map[LLMProvider]string{
+	GROQ:            "https://api.groq.com/openai/v1",
+	OPENAI:          "https://api.openai.com/v1",
+	OLLAMA:          "http://localhost:11434/v1",
+	LLAMACPP_SERVER: "http://localhost:8080/v1",
+}
+
+var default_models = map[LLMProvider]string{
+	GROQ:   _DEFAULT_MODEL,
+	OPENAI: "gpt-4o-mini",
+	OLLAMA: "llama3",
+	// llama-server ignores the model name
+	LLAMACPP_SERVER: "default",
+}
+
+type LLMProviderError string
+
+func (err LLMProviderError) Error() string {
+	return string(err)
+}
+
+// one model behind one endpoint
+type LLMEndpoint struct {
+	Provider LLMProvider
+	// empty for the default of the provider
+	BaseURL string
+	// empty for the default of the provider. For LLAMACPP this is the path of the gguf file
+	Model string
+	// empty for the api_key of NewParrotboxClient
+	APIKey string
+}
+
+func (endpoint LLMEndpoint) String() string {
+	return fmt.Sprintf("%s(%s)", endpoint.Provider, endpoint.Model)
+}
+
+type parrotboxConfig struct {
+	endpoints      []LLMEndpoint
+	llm            llms.Model
+	context_window int
+	temperature    float64
+	seed           int
+}
+
+type ParrotboxOption func(config *parrotboxConfig)
+
+// adds an endpoint to the client. Each call goes to the first endpoint and moves on to the next one if it fails.
+// Without this the client uses llama3-8b-8192 on Groq
+func WithLLMEndpoint(endpoint LLMEndpoint) ParrotboxOption {
+	return func(config *parrotboxConfig) {
+		config.endpoints = append(config.endpoints, endpoint)
+	}
+}
+
+// uses the model as it is such as a langchaingo model that isn't openai compatible or a fake one in tests. The endpoints are ignored when it is set
+func WithLLM(llm llms.Model) ParrotboxOption {
+	return func(config *parrotboxConfig) {
+		config.llm = llm
+	}
+}
+
+// context window of the smallest model of the endpoints in tokens. The texts are batched to fit in it. Default is 8192
+func WithContextWindow(tokens int) ParrotboxOption {
+	return func(config *parrotboxConfig) {
+		if tokens > 0 {
+			config.context_window = tokens
+		}
+	}
+}
+
+// Default is 0.1
+func WithTemperature(temperature float64) ParrotboxOption {
+	return func(config *parrotboxConfig) {
+		config.temperature = temperature
+	}
+}
+
+// Default is 1000
+func WithSeed(seed int) ParrotboxOption {
+	return func(config *parrotboxConfig) {
+		config.seed = seed
+	}
+}
+
+// the input texts of a call get up to this many tokens
+func (config *parrotboxConfig) inputWindow() int {
+	// small local models still get half of their window for the input
+	return max(config.context_window-_PROMPT_RESERVE, config.context_window/2)
+}
+
+// fills in the defaults of the provider
+func (endpoint LLMEndpoint) withDefaults(api_key string) LLMEndpoint {
+	if endpoint.Provider == "" {
+		endpoint.Provider = GROQ
+	}
+	if endpoint.BaseURL == "" {
+		endpoint.BaseURL = default_base_urls[endpoint.Provider]
+	}
+	if endpoint.Model == "" {
+		endpoint.Model = default_models[endpoint.Provider]
+	}
+	if endpoint.APIKey == "" {
+		endpoint.APIKey = api_key
+	}
+	return endpoint
+}
+
+func newLLM(endpoint LLMEndpoint, context_window int) (llms.Model, error) {
+	switch {
+	case endpoint.Provider == LLAMACPP && endpoint.Model == "":
+		return nil, LLMProviderError("llamacpp needs the path of the model file")
+	case endpoint.Provider == LLAMACPP:
+		return newLlamaModel(endpoint.Model, context_window)
+	case endpoint.BaseURL == "":
+		return nil, LLMProviderError(fmt.Sprintf("%s needs a base url", endpoint.Provider))
+	case endpoint.Model == "":
+		return nil, LLMProviderError(fmt.Sprintf("%s needs a model name", endpoint.Provider))
+	}
+	api_key := endpoint.APIKey
+	if api_key == "" {
+		if endpoint.Provider == GROQ || endpoint.Provider == OPENAI {
+			return nil, LLMProviderError(fmt.Sprintf("%s needs an api key", endpoint.Provider))
+		}
+		api_key = _NO_API_KEY
+	}
+	return openai.New(
+		openai.WithBaseURL(strings.TrimSuffix(endpoint.BaseURL, "/")),
+		openai.WithModel(endpoint.Model),
+		openai.WithToken(api_key),
+		openai.WithResponseFormat(openai.ResponseFormatJSON))
+}
+
+// tries the models in order until one of them works
+type failoverLLM struct {
+	models []llms.Model
+	names  []string
+}
+
+func (llm *failoverLLM) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	var errs []error
+	for i, model := range llm.models {
+		res, err := model.GenerateContent(ctx, messages, options...)
+		if err == nil {
+			return res, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+		if i < len(llm.models)-1 {
+			log.Printf("[parrotboxdriver] %s failed. Trying %s. %v\n", llm.names[i], llm.names[i+1], err)
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (llm *failoverLLM) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, llm, prompt, options...)
+}
@@ -1,18 +1,13 @@
 package nlp
 
 import (
-	ctx "context"
+	"context"
+	"errors"
 	"log"
 	"strings"
 
-	datautils "github.com/soumitsalman/data-utils"
-	"github.com/tmc/langchaingo/llms/openai"
-)
-
-const (
-	_MODEL        = "llama3-8b-8192"
-	_BASE_URL     = "https://api.groq.com/openai/v1"
-	_MODEL_WINDOW = 6144 // reducing the size to account for instructions and samples
+	"github.com/tmc/langchaingo/chains"
+	"github.com/tmc/langchaingo/llms"
 )
 
 const (
@@ -22,39 +17,75 @@ const (
 type ParrotboxClient struct {
 	concepts_chain *JsonValueExtraction
 	digest_chain   *JsonValueExtraction
+	// tokens of input text per call
+	input_window int
 }
 
-func NewParrotboxClient(api_key string) *ParrotboxClient {
-	client, err := openai.New(
-		openai.WithBaseURL(_BASE_URL),
-		openai.WithModel(_MODEL),
-		openai.WithToken(api_key),
-		openai.WithResponseFormat(openai.ResponseFormatJSON))
+// api_key goes to the endpoints that don't have their own. Without any WithLLMEndpoint the client uses llama3-8b-8192 on Groq.
+// Returns nil if an endpoint can't be set up
+func NewParrotboxClient(api_key string, opts ...ParrotboxOption) *ParrotboxClient {
+	config := &parrotboxConfig{
+		context_window: _DEFAULT_CONTEXT_WINDOW,
+		temperature:    _DEFAULT_TEMPERATURE,
+		seed:           _DEFAULT_SEED,
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+	if config.llm != nil {
+		config.endpoints = nil
+	} else if len(config.endpoints) == 0 {
+		config.endpoints = []LLMEndpoint{{Provider: GROQ}}
+	}
 
-	if err != nil {
-		log.Println(err)
-		return nil
+	failover := &failoverLLM{}
+	for _, endpoint := range config.endpoints {
+		endpoint = endpoint.withDefaults(api_key)
+		model, err := newLLM(endpoint, config.context_window)
+		if err != nil {
+			log.Printf("[parrotboxdriver] Couldn't set up %s. %v\n", endpoint, err)
+			return nil
+		}
+		failover.models = append(failover.models, model)
+		failover.names = append(failover.names, endpoint.String())
+	}
+	var llm llms.Model = failover
+	if config.llm != nil {
+		llm = config.llm
+	} else if len(failover.models) == 1 {
+		llm = failover.models[0]
 	}
+
+	chain_opts := []chains.ChainCallOption{chains.WithTemperature(config.temperature), chains.WithSeed(config.seed)}
 	return &ParrotboxClient{
-		concepts_chain: NewJsonValueExtraction(client, _CONCEPTS_SAMPLE_INPUT, &_CONCEPTS_SAMPLE_OUTPUT),
-		digest_chain:   NewJsonValueExtraction(client, _DIGEST_SAMPLE_INPUT, &_DIGEST_SAMPLE_OUTPUT),
+		concepts_chain: NewJsonValueExtraction(llm, _CONCEPTS_SAMPLE_INPUT, &_CONCEPTS_SAMPLE_OUTPUT, chain_opts...),
+		digest_chain:   NewJsonValueExtraction(llm, _DIGEST_SAMPLE_INPUT, &_DIGEST_SAMPLE_OUTPUT, chain_opts...),
+		input_window:   config.inputWindow(),
 	}
 }
 
-func (client *ParrotboxClient) ExtractDigests(texts []string) []Digest {
+// returns one digest per text in the same order. Texts that fail get an empty digest as a dud
+// and the errors are returned along with the digests
+func (client *ParrotboxClient) ExtractDigests(ctx context.Context, texts []string) ([]Digest, error) {
 	output := make([]Digest, 0, len(texts))
-	datautils.ForEach(texts, func(text *string) {
-		res := serverErrorRetry(
+	var errs []error
+	for _, text := range texts {
+		// no point in going through the rest if the caller is gone
+		if err := ctx.Err(); err != nil {
+			return output, errors.Join(append(errs, err)...)
+		}
+		res, err := serverErrorRetry(
+			ctx,
 			func() (Digest, error) {
 				result, err := client.digest_chain.Call(
-					ctx.Background(),
+					ctx,
 					map[string]any{
 						"context":    _DIGEST_INSTRUCTION,
 						"input_text": text,
 					},
 				)
 				if err != nil {
-					result, err = retryIfParseError(client.digest_chain, err)
+					result, err = retryIfParseError(ctx, client.digest_chain, err)
 				}
 				// now check if there is an error. If there is server error the serverErrorRetry will try again
 				if err != nil {
@@ -64,27 +95,36 @@ func (client *ParrotboxClient) ExtractDigests(texts []string) []Digest {
 				}
 				return result["value"].(Digest), nil
 			})
+		if err != nil {
+			errs = append(errs, err)
+		}
 		output = append(output, res)
-	})
-	return output
+	}
+	return output, errors.Join(errs...)
 }
 
-func (client *ParrotboxClient) ExtractKeyConcepts(texts []string) []KeyConcept {
+// returns the concepts from the batches that worked along with the errors from the batches that didn't
+func (client *ParrotboxClient) ExtractKeyConcepts(ctx context.Context, texts []string) ([]KeyConcept, error) {
 	output := make([]KeyConcept, 0, len(texts))
-	datautils.ForEach(stuffAndBatchInput(texts), func(batch *string) {
+	var errs []error
+	for _, batch := range stuffAndBatchInput(texts, client.input_window) {
+		if err := ctx.Err(); err != nil {
+			return output, errors.Join(append(errs, err)...)
+		}
 		// retry for each batch
 		// if a batch doesnt workout, just move on to the next batch. No need to insert duds since no sequence need to be maintained
-		res := serverErrorRetry(
+		res, err := serverErrorRetry(
+			ctx,
 			func() ([]KeyConcept, error) {
 				result, err := client.concepts_chain.Call(
-					ctx.Background(),
+					ctx,
 					map[string]any{
 						"context":    _CONCEPTS_INSTRUCTION,
 						"input_text": batch,
 					},
 				)
 				if err != nil {
-					result, err = retryIfParseError(client.concepts_chain, err)
+					result, err = retryIfParseError(ctx, client.concepts_chain, err)
 				}
 				// now check if there is an error. If there is server error the serverErrorRetry will try again
 				if err != nil {
@@ -94,17 +134,20 @@ func (client *ParrotboxClient) ExtractKeyConcepts(texts []string) []KeyConcept {
 				}
 				return result["value"].(keyConceptList).Items, nil
 			})
+		if err != nil {
+			errs = append(errs, err)
+		}
 		if len(res) > 0 {
 			output = append(output, res...)
 		}
-	})
-	return output
+	}
+	return output, errors.Join(errs...)
 }
 
 // the error can be a parse error because content isn't json, or it can be server error
 // for server error try again multiple times
 // for parser error try with the _RETRY_INSTRUCTION
-func retryIfParseError(chain *JsonValueExtraction, err error) (map[string]any, error) {
+func retryIfParseError(ctx context.Context, chain *JsonValueExtraction, err error) (map[string]any, error) {
 	var result map[string]any
 	// try once and send whatever the result is
 	if parse_err, ok := err.(ParseError); ok {
@@ -112,7 +155,7 @@ func retryIfParseError(chain *JsonValueExtraction, err error) (map[string]any, e
 		log.Println("[parrotboxdriver] Retyring json format extraction.")
 		// reassigning the result and err
 		result, err = chain.Call(
-			ctx.Background(),
+			ctx,
 			map[string]any{
 				"context":    _RETRY_INSTRUCTION,
 				"input_text": parse_err.Text,
@@ -123,12 +166,13 @@ func retryIfParseError(chain *JsonValueExtraction, err error) (map[string]any, e
 	return result, err
 }
 
-func stuffAndBatchInput(texts []string) []string {
-	if CountTokens(texts) > _MODEL_WINDOW {
+func stuffAndBatchInput(texts []string, window int) []string {
+	// a single text that is too long goes as it is
+	if len(texts) > 1 && CountTokens(texts) > window {
 		// split in half and retry recursively
 		return append(
-			stuffAndBatchInput(texts[:len(texts)/2]),
-			stuffAndBatchInput(texts[len(texts)/2:])...)
+			stuffAndBatchInput(texts[:len(texts)/2], window),
+			stuffAndBatchInput(texts[len(texts)/2:], window)...)
 	}
 	// it is within context window so just batch em up all together
 	return []string{strings.Join(texts, _BATCH_DELIMETER)}
@@ -1,6 +1,7 @@
 package nlp
 
 import (
+	"context"
 	"regexp"
 	"time"
 
@@ -14,55 +15,53 @@ const (
 	RETRY_ATTEMPTS = 3
 )
 
-func serverErrorRetry[T any](original_func func() (T, error)) T {
+func serverErrorRetry[T any](ctx context.Context, original_func func() (T, error)) (T, error) {
 	var res T
-	var err error
-
-	retry.Do(
+	err := retry.Do(
 		func() error {
-			if res, err = original_func(); err != nil {
-				// something went wrong with the function so try again
-				return err
-			}
-			// no error
-			return nil
+			var err error
+			// something went wrong with the function so try again
+			res, err = original_func()
+			return err
 		},
+		retry.Context(ctx),
 		retry.Delay(LONG_DELAY),
 		retry.Attempts(RETRY_ATTEMPTS),
+		retry.LastErrorOnly(true),
 		retry.RetryIf(func(err error) bool {
 			// match for 503: Service Unavailable & 429: Rate limit
 			res, err := regexp.MatchString("(?i)(429:.+Rate.+limit|503: Service Unavailable)", err.Error())
 			return err == nil && res
 		}),
 	)
-	return res
+	return res, err
 }
 
-func retryT[T any](original_func func() (T, error)) T {
+func retryT[T any](ctx context.Context, original_func func() (T, error)) (T, error) {
 	var res T
-	var err error
 	// retry for each batch
-	retry.Do(
+	err := retry.Do(
 		func() error {
-			if res, err = original_func(); err != nil {
-				// something went wrong with the function so try again
-				return err
-			}
-			// no error
-			return nil
+			var err error
+			// something went wrong with the function so try again
+			res, err = original_func()
+			return err
 		},
+		retry.Context(ctx),
 		retry.Delay(SHORT_DELAY),
 		retry.Attempts(RETRY_ATTEMPTS),
+		retry.LastErrorOnly(true),
 	)
-	return res
+	return res, err
 }
 
-func postHTTPRequest[T any](url, auth_token string, input any) (T, error) {
+func postHTTPRequest[T any](ctx context.Context, url, auth_token string, input any) (T, error) {
 	var result T
 	req := resty.New().
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Accept", "application/json").
 		R().
+		SetContext(ctx).
 		SetBody(input).
 		SetResult(&result)
 	// if auth token is not empty set it
@@ -75,17 +74,8 @@ func postHTTPRequest[T any](url, auth_token string, input any) (T, error) {
 	return result, err
 }
 
-func postHTTPRequestAndRetryOnFail[T any](url, auth_token string, input any) T {
-	var result T
-	var err error
-	retry.Do(
-		func() error {
-			result, err = postHTTPRequest[T](url, auth_token, input)
-			// no error
-			return err
-		},
-		retry.Attempts(RETRY_ATTEMPTS),
-		retry.Delay(SHORT_DELAY),
-	)
-	return result
+func postHTTPRequestAndRetryOnFail[T any](ctx context.Context, url, auth_token string, input any) (T, error) {
+	return retryT(ctx, func() (T, error) {
+		return postHTTPRequest[T](ctx, url, auth_token, input)
+	})
 }
@@ -1,14 +1,35 @@
 package nlp
 
 import (
+	"log"
+	"sync"
+
 	"github.com/pkoukk/tiktoken-go"
 	datautils "github.com/soumitsalman/data-utils"
 )
 
-const _DEFAULT_TEXT_LENGTH = 2048
+const (
+	_DEFAULT_TEXT_LENGTH = 2048
+	// rough number of characters per token when the encoding isn't available
+	_CHARS_PER_TOKEN = 4
+)
+
+// the encoding gets downloaded the first time so it can be missing when there is no network.
+// The functions below estimate the tokens from the characters in that case
+var encoding = sync.OnceValue(func() *tiktoken.Tiktoken {
+	tk, err := tiktoken.GetEncoding("cl100k_base")
+	if err != nil {
+		log.Println("[tokens] Couldn't load the token encoding. Estimating the token counts.", err)
+		return nil
+	}
+	return tk
+})
 
 func TruncateTextOnTokenCount(text string) string {
-	tk, _ := tiktoken.GetEncoding("cl100k_base")
+	tk := encoding()
+	if tk == nil {
+		return string(datautils.SafeSlice([]rune(text), 0, _DEFAULT_TEXT_LENGTH*_CHARS_PER_TOKEN))
+	}
 	return tk.Decode(
 		datautils.SafeSlice(
 			tk.Encode(text, nil, nil),
@@ -18,8 +39,14 @@ func TruncateTextOnTokenCount(text string) string {
 }
 
 func CountTokens(texts []string) int {
-	tk, _ := tiktoken.GetEncoding("cl100k_base")
+	tk := encoding()
 	total := 0
-	datautils.ForEach(texts, func(text *string) { total += len(tk.Encode(*text, nil, nil)) })
+	datautils.ForEach(texts, func(text *string) {
+		if tk == nil {
+			total += (len([]rune(*text)) + _CHARS_PER_TOKEN - 1) / _CHARS_PER_TOKEN
+		} else {
+			total += len(tk.Encode(*text, nil, nil))
+		}
+	})
 	return total
 }
@@ -1,6 +1,7 @@
 package sdk
 
 import (
+	"context"
 	"log"
 	"sort"
 
@@ -45,6 +46,8 @@ var (
 		"description": 1,
 	}
 	_SORT_BY_UPDATED = store.JSON{"updated": -1}
+	// newest first. url breaks the ties so that the pages are stable
+	_PAGE_BY_UPDATED = []store.SortKey{store.Desc("updated"), store.Desc("url")}
 )
 
 // fuzzy search modes
@@ -53,12 +56,19 @@ const (
 	_TEXT           = 1
 	_VECTOR         = 2
 	_VECTOR_OR_TEXT = 3
+	_HYBRID         = 4
 )
 
-// This retrieves beans using scalar filter instead of fuzzy searching
-func Retrieve(options *SearchOptions) []Bean {
-	return beanstore.Get(
-		options.ScalarFilter,
+// This retrieves beans using scalar filter instead of fuzzy searching.
+// Returns a page of the newest beans and the token for the next page. The token is empty on the last page
+func (sack *BeanSack) Retrieve(ctx context.Context, options *SearchOptions) ([]Bean, string, error) {
+	filter, err := options.beanFilter()
+	if err != nil {
+		return nil, "", err
+	}
+	return sack.beanstore.GetPage(
+		ctx,
+		filter,
 		store.JSON{
 			// for beans
 			"url":     1,
@@ -70,22 +80,34 @@ func Retrieve(options *SearchOptions) []Bean {
 			"created": 1,
 			"text":    1,
 		},
-		_SORT_BY_UPDATED,
+		_PAGE_BY_UPDATED,
 		options.TopN,
+		options.PageToken,
 	)
 }
 
-func TextSearch(keywords []string, settings *SearchOptions) []Bean {
+// Returns a page of beans ordered by text search score and the token for the next page
+func (sack *BeanSack) TextSearch(ctx context.Context, keywords []string, settings *SearchOptions) ([]Bean, string, error) {
 	var beans []Bean
+	var next_page string
+	var err error
 	if settings == nil {
-		beans = beanstore.TextSearch(keywords, store.WithProjection(_PROJECTION_FIELDS))
+		beans, next_page, err = sack.beanstore.TextSearchPage(ctx, keywords, "", store.WithProjection(_PROJECTION_FIELDS))
 	} else {
-		beans = beanstore.TextSearch(keywords,
-			store.WithTextFilter(settings.ScalarFilter),
+		var filter store.JSON
+		if filter, err = settings.beanFilter(); err != nil {
+			return nil, "", err
+		}
+		beans, next_page, err = sack.beanstore.TextSearchPage(ctx, keywords, settings.PageToken,
+			store.WithTextFilter(filter),
 			store.WithProjection(_PROJECTION_FIELDS),
 			store.WithTextTopN(settings.TopN))
 	}
-	return attachMediaNoises(beans)
+	if err != nil {
+		return nil, "", err
+	}
+	beans, err = sack.attachMediaNoises(ctx, beans)
+	return beans, next_page, err
 }
 
 // Searches beans based on search options
@@ -95,99 +117,143 @@ func TextSearch(keywords []string, settings *SearchOptions) []Bean {
 //  3. If NO category texts are found then create embeddings from the conversational context and search with that
 //     3.ALT. If context search does not return a value to a TextSearch
 //  4. If NO vector input is available just do a regular search
-func FuzzySearch(options *SearchOptions) []Bean {
-	mode, embs, vec_field, min_score, keywords := getFuzzySearchMode(options)
+//
+// With a Fusion in the options and texts to search for, the vector search of 1-3 runs together with a text search
+// and the beans are ranked by the fusion of the two rankings.
+// Returns a page of beans and the token for the next page. The token is empty on the last page
+func (sack *BeanSack) FuzzySearch(ctx context.Context, options *SearchOptions) ([]Bean, string, error) {
+	filter, err := options.beanFilter()
+	if err != nil {
+		return nil, "", err
+	}
+	mode, embs, vec_field, min_score, keywords, err := sack.getFuzzySearchMode(ctx, options)
+	if err != nil {
+		return nil, "", err
+	}
+	if options.Fusion != nil && mode == _VECTOR && len(keywords) > 0 {
+		mode = _HYBRID
+	}
 	var beans []Bean
+	var next_page string
 
 	switch mode {
 	case _GET:
-		beans = beanstore.Get(
-			options.ScalarFilter,
+		beans, next_page, err = sack.beanstore.GetPage(
+			ctx,
+			filter,
 			_PROJECTION_FIELDS,
-			store.JSON{"updated": -1},
-			options.TopN)
+			_PAGE_BY_UPDATED,
+			options.TopN,
+			options.PageToken)
 	case _TEXT:
-		beans = TextSearch(keywords, options)
+		// text search already comes with the media noises
+		return sack.TextSearch(ctx, keywords, options)
 	case _VECTOR:
-		beans = beanstore.VectorSearch(
+		beans, next_page, err = sack.beanstore.VectorSearchPage(
+			ctx,
 			embs,
 			vec_field,
-			store.WithVectorFilter(options.ScalarFilter),
+			options.PageToken,
+			store.WithVectorFilter(filter),
 			store.WithProjection(_PROJECTION_FIELDS),
 			store.WithMinSearchScore(min_score),
+			store.WithScoreAggregation(options.ScoreAggregation),
 			store.WithVectorTopN(options.TopN))
 	case _VECTOR_OR_TEXT:
-		beans = beanstore.VectorSearch(
+		beans, next_page, err = sack.beanstore.VectorSearchPage(
+			ctx,
 			embs,
 			vec_field,
-			store.WithVectorFilter(options.ScalarFilter),
+			options.PageToken,
+			store.WithVectorFilter(filter),
 			store.WithProjection(_PROJECTION_FIELDS),
 			store.WithMinSearchScore(min_score),
+			store.WithScoreAggregation(options.ScoreAggregation),
 			store.WithVectorTopN(options.TopN))
 		// vector search score is too restrictive for the embeddings model
 		// do a text search and return the top N as sample
-		if len(beans) <= 0 {
+		// the page tokens of the two searches are not interchangeable so this only applies to the first page
+		if err == nil && len(beans) <= 0 && options.PageToken == "" {
 			// options.TopN = 2
-			beans = TextSearch(keywords, options)
+			return sack.TextSearch(ctx, keywords, options)
 		}
+	case _HYBRID:
+		beans, next_page, err = sack.beanstore.HybridSearchPage(
+			ctx,
+			keywords,
+			embs,
+			vec_field,
+			options.PageToken,
+			*options.Fusion,
+			store.WithVectorFilter(filter),
+			store.WithProjection(_PROJECTION_FIELDS),
+			store.WithMinSearchScore(min_score),
+			store.WithScoreAggregation(options.ScoreAggregation),
+			store.WithVectorTopN(options.TopN))
 	}
-	return attachMediaNoises(beans)
+	if err != nil {
+		return nil, "", err
+	}
+	beans, err = sack.attachMediaNoises(ctx, beans)
+	return beans, next_page, err
 }
 
 // gets parameters for fuzzy search.
-// the outputs are: search_mode, embeddings (if applicable), vector_field (if applicable), min_vector_search_score, keywords (if applicable)
-func getFuzzySearchMode(options *SearchOptions) (int, [][]float32, string, float64, []string) {
-	var embs [][]float32
+// the outputs are: search_mode, embeddings (if applicable), vector_field (if applicable), min_vector_search_score, keywords (if applicable), error from embeddings generation
+func (sack *BeanSack) getFuzzySearchMode(ctx context.Context, options *SearchOptions) (int, [][]float32, string, float64, []string, error) {
 	if len(options.SearchEmbeddings) > 0 {
 		// no need to generate embeddings. search for CATEGORIES defined by these
-		return _VECTOR, options.SearchEmbeddings, _CLASSIFICATION_EMB, _DEFAULT_CLASSIFICATION_MATCH_SCORE, nil
+		return _VECTOR, options.SearchEmbeddings, _CLASSIFICATION_EMB, _DEFAULT_CLASSIFICATION_MATCH_SCORE, nil, nil
 	} else if len(options.SearchTexts) > 0 {
 		// generate embeddings for these categories
 		log.Printf("[beanops] Generating embeddings for %d categories.\n", len(options.SearchTexts))
-		embs = emb_client.CreateBatchTextEmbeddings(options.SearchTexts, nlp.CLASSIFICATION)
-		return _VECTOR, embs, _CLASSIFICATION_EMB, _DEFAULT_CLASSIFICATION_MATCH_SCORE, options.SearchTexts
+		embs, err := sack.emb_client.CreateBatchTextEmbeddings(ctx, options.SearchTexts, nlp.CLASSIFICATION)
+		return _VECTOR, embs, _CLASSIFICATION_EMB, _DEFAULT_CLASSIFICATION_MATCH_SCORE, options.SearchTexts, err
 	} else if len(options.Context) > 0 {
 		// generate embeddings for the context and search using SEARCH EMBEDDINGS
 		log.Println("[beanops] Generating embeddings for:", options.Context)
 		// deprecating search_embedddings
-		// embs = [][]float32{emb_client.CreateTextEmbeddings(options.Context, nlp.SEARCH_QUERY)}
+		// embs = [][]float32{sack.emb_client.CreateTextEmbeddings(options.Context, nlp.SEARCH_QUERY)}
 		// return _VECTOR_OR_TEXT, embs, _SEARCH_EMB, _DEFAULT_CONTEXT_MATCH_SCORE, []string{options.Context}
-		embs = [][]float32{emb_client.CreateTextEmbeddings(options.Context, nlp.CLASSIFICATION)}
-		return _VECTOR, embs, _CLASSIFICATION_EMB, _DEFAULT_CONTEXT_MATCH_SCORE, options.SearchTexts
+		embs, err := sack.emb_client.CreateBatchTextEmbeddings(ctx, []string{options.Context}, nlp.CLASSIFICATION)
+		return _VECTOR, embs, _CLASSIFICATION_EMB, _DEFAULT_CONTEXT_MATCH_SCORE, []string{options.Context}, err
 	} else {
 		log.Println("[beanops] No `vector search` parameter defined.")
-		return _GET, nil, "", 0, nil // none of the other parameters matter
+		return _GET, nil, "", 0, nil, nil // none of the other parameters matter
 	}
 }
 
-func NuggetSearch(nuggets []string, settings *SearchOptions) []Bean {
+func (sack *BeanSack) NuggetSearch(ctx context.Context, nuggets []string, settings *SearchOptions) ([]Bean, error) {
+	if err := settings.Filter.Validate(bean_schema); err != nil {
+		return nil, err
+	}
 	// get all the mapped urls
-	nuggets_filter := store.JSON{
-		"keyphrase": store.JSON{"$in": nuggets},
+	nuggets_filter, err := compileFilter(store.In("keyphrase", nuggets...).And(settings.Filter.Only("updated")), nugget_schema)
+	if err != nil {
+		return nil, err
 	}
-	if updated, ok := settings.ScalarFilter["updated"]; ok {
-		nuggets_filter["updated"] = updated
+	initial_list, err := sack.nuggetstore.Get(ctx, nuggets_filter, store.JSON{"mapped_urls": 1}, store.JSON{"match_count": -1}, settings.TopN)
+	if err != nil {
+		return nil, err
 	}
-	initial_list := nuggetstore.Get(nuggets_filter, store.JSON{"mapped_urls": 1}, store.JSON{"match_count": -1}, settings.TopN)
 
 	// merge mapped_urls into one array
 	mapped_urls := make([]string, 0, len(initial_list)*5)
 	datautils.ForEach(initial_list, func(item *NewsNugget) { mapped_urls = append(mapped_urls, item.BeanUrls...) })
 
 	// find the news articles with the urls in scope
-	bean_filter := store.JSON{
-		"url": store.JSON{"$in": mapped_urls},
-	}
-	if kind, ok := settings.ScalarFilter["kind"]; ok {
-		bean_filter["kind"] = kind
-	}
-	beans := beanstore.Get(
-		bean_filter,
+	bean_filter := store.In("url", mapped_urls...).And(settings.Filter.Only("kind"))
+	beans, err := sack.beanstore.Get(
+		ctx,
+		bean_filter.ToJSON(),
 		_PROJECTION_FIELDS,
 		_SORT_BY_UPDATED, // this way the newest ones are listed first
 		settings.TopN,
 	)
-	return attachMediaNoises(beans)
+	if err != nil {
+		return nil, err
+	}
+	return sack.attachMediaNoises(ctx, beans)
 }
 
 // Finds the trending news nuggets defined by the search parameter such as: by the day/week, by category match
@@ -196,38 +262,50 @@ func NuggetSearch(nuggets []string, settings *SearchOptions) []Bean {
 //  1. Match all the beans irrespective of updated: 0/1 within the category match threshold
 //  2. Find the nuggets that has those URLs as mapped urls for that day
 //  3. Stack rank them by trend score
-func TrendingNuggets(options *SearchOptions) []NewsNugget {
-	// 0. Find all nuggets in that day/week
-	nugget_filter := store.JSON{
-		"match_count": store.JSON{"$gte": 1}, // this a minimum
+func (sack *BeanSack) TrendingNuggets(ctx context.Context, options *SearchOptions) ([]NewsNugget, error) {
+	if err := options.Filter.Validate(bean_schema); err != nil {
+		return nil, err
 	}
-	if updated, ok := options.ScalarFilter["updated"]; ok {
-		nugget_filter["updated"] = updated
+	// 0. Find all nuggets in that day/week
+	nugget_filter := store.Range("match_count", 1, nil).And(options.Filter.Only("updated")) // this a minimum
+	if err := nugget_filter.Validate(nugget_schema); err != nil {
+		return nil, err
 	}
 	initial_urls := make([]string, 0, 10) //default initialization
-	datautils.ForEach(
-		nuggetstore.Get(nugget_filter, store.JSON{"mapped_urls": 1}, nil, -1),
-		func(item *NewsNugget) { initial_urls = append(initial_urls, item.BeanUrls...) })
+	// only the urls are needed so the nuggets don't need to be held in memory
+	err := forEachChunk(ctx, sack.nuggetstore, nugget_filter.ToJSON(), store.JSON{"mapped_urls": 1}, nil, func(ctx context.Context, nuggets []NewsNugget) error {
+		datautils.ForEach(nuggets, func(item *NewsNugget) { initial_urls = append(initial_urls, item.BeanUrls...) })
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	// there is nothing for the day
 	if len(initial_urls) <= 0 {
-		return nil
+		return nil, nil
 	}
 
 	// 1. Match the all beans irrespective of updated: 0/1 within category match
 	beans_options := *options
-	beans_options.ScalarFilter = store.JSON{"url": store.JSON{"$in": initial_urls}}
+	beans_options.Filter = store.In("url", initial_urls...)
 	beans_options.TopN = len(initial_urls) // look for all the items that match and dont shorten to only user provided topN just yet
-	matched_urls := datautils.Transform(FuzzySearch(&beans_options), func(item *Bean) string { return item.Url })
+	beans_options.PageToken = ""
+	matched_beans, _, err := sack.FuzzySearch(ctx, &beans_options)
+	if err != nil {
+		return nil, err
+	}
+	matched_urls := datautils.Transform(matched_beans, func(item *Bean) string { return item.Url })
 	// there is nothing that matches the categories
 	if len(matched_urls) <= 0 {
-		return nil
+		return nil, nil
 	}
 
 	// 2. Find the nuggets that has those URLs as mapped urls for that day
 	// 3. Stack rank them by trend score
-	nugget_filter["mapped_urls"] = store.JSON{"$in": matched_urls} // now find the ones with matched urls
-	return nuggetstore.Get(
-		nugget_filter,
+	nugget_filter = nugget_filter.And(store.In("mapped_urls", matched_urls...)) // now find the ones with matched urls
+	return sack.nuggetstore.Get(
+		ctx,
+		nugget_filter.ToJSON(),
 		store.JSON{
 			"embeddings": 0,
 			"_id":        0,
@@ -243,13 +321,19 @@ func TrendingNuggets(options *SearchOptions) []NewsNugget {
 //  2. Find the nuggets that are mapped to these articles
 //  3. Take the highest nugget trend score and assign to the respective article
 //  4. Stack rank the news/posts by that trend score
-func TrendingBeans(options *SearchOptions) []Bean {
+//
+// Pages follow the pages of FuzzySearch so that the page tokens line up and the beans of each page are ranked by the trend score.
+// The beans without a nugget keep their search score and their FuzzySearch order among the ties
+func (sack *BeanSack) TrendingBeans(ctx context.Context, options *SearchOptions) ([]Bean, string, error) {
 	//  1. Find all the news/posts for that day that matches the categories (match everything if there is no category)
-	beans := FuzzySearch(options)
+	beans, next_page, err := sack.FuzzySearch(ctx, options)
+	if err != nil {
+		return nil, "", err
+	}
 
 	//  2. Find the nuggets that are mapped to these articles
 	urls := datautils.Transform(beans, func(item *Bean) string { return item.Url })
-	nuggets := nuggetstore.Aggregate([]store.JSON{
+	nuggets, err := sack.nuggetstore.Aggregate(ctx, []store.JSON{
 		{
 			"$match": store.JSON{
 				"mapped_urls": store.JSON{"$in": urls},
@@ -276,6 +360,9 @@ func TrendingBeans(options *SearchOptions) []Bean {
 			},
 		},
 	})
+	if err != nil {
+		return nil, "", err
+	}
 
 	// if no nugget was found just return based on search score of the beans
 	if len(nuggets) > 0 {
@@ -288,14 +375,17 @@ func TrendingBeans(options *SearchOptions) []Bean {
 		})
 
 		//  4. Stack rank the news/posts by that trend score
-		sort.Slice(beans, func(i, j int) bool { return beans[i].SearchScore > beans[j].SearchScore })
-		beans = datautils.SafeSlice(beans, 0, options.TopN)
+		sort.SliceStable(beans, func(i, j int) bool { return beans[i].SearchScore > beans[j].SearchScore })
 	}
-	return attachMediaNoises(beans)
+	beans, err = sack.attachMediaNoises(ctx, beans)
+	return beans, next_page, err
 }
 
-func attachMediaNoises(beans []Bean) []Bean {
-	noises := getMediaNoises(beans, false)
+func (sack *BeanSack) attachMediaNoises(ctx context.Context, beans []Bean) ([]Bean, error) {
+	noises, err := sack.getMediaNoises(ctx, beans, false)
+	if err != nil {
+		return nil, err
+	}
 	if len(noises) > 0 {
 		beans = datautils.ForEach(beans, func(bn *Bean) {
 			i := datautils.IndexAny(noises, func(mn *MediaNoise) bool { return bn.Url == mn.BeanUrl })
@@ -304,12 +394,12 @@ func attachMediaNoises(beans []Bean) []Bean {
 			}
 		})
 	}
-	return beans
+	return beans, nil
 }
 
-func getMediaNoises(beans []Bean, total bool) []MediaNoise {
+func (sack *BeanSack) getMediaNoises(ctx context.Context, beans []Bean, total bool) ([]MediaNoise, error) {
 	if len(beans) == 0 {
-		return nil
+		return nil, nil
 	}
 	urls := datautils.Transform(beans, func(item *Bean) string { return item.Url })
 	// log.Println(datautils.ToJsonString(urls))
@@ -372,5 +462,5 @@ func getMediaNoises(beans []Bean, total bool) []MediaNoise {
 			},
 		})
 	}
-	return noisestore.Aggregate(pipeline)
+	return sack.noisestore.Aggregate(ctx, pipeline)
 }
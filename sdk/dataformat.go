@@ -1,6 +1,9 @@
 package sdk
 
-import "github.com/soumitsalman/beansack/nlp"
+import (
+	"github.com/soumitsalman/beansack/nlp"
+	"github.com/soumitsalman/beansack/store"
+)
 
 const (
 	CHANNEL = "channel"
@@ -45,6 +48,7 @@ type MediaNoise struct {
 	Digest        string  `json:"digest,omitempty" bson:"digest,omitempty"`
 }
 
+// Deprecated: keyword maps are not stored anymore
 type KeywordMap struct {
 	Updated int64  `json:"updated,omitempty" bson:"updated,omitempty"`
 	BeanUrl string `json:"url,omitempty" bson:"url,omitempty"`         // the id is 1:1 mapping with Bean.Id
@@ -63,6 +67,12 @@ type NewsNugget struct {
 	BeanUrls    []string  `json:"mapped_urls,omitempty" bson:"mapped_urls,omitempty"`
 }
 
+// field names of the stored data types for validating filters
+var (
+	bean_schema   = store.SchemaOf[Bean]()
+	nugget_schema = store.SchemaOf[NewsNugget]()
+)
+
 func toNewsNugget(concept *nlp.KeyConcept) NewsNugget {
 	return NewsNugget{
 		KeyPhrase:   concept.KeyPhrase,
@@ -1,6 +1,10 @@
 package sdk
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"log"
 	"time"
 
@@ -26,20 +30,22 @@ const (
 // removing search embeddings
 var _GENERATED_FIELDS = []string{_CLASSIFICATION_EMB, _SUMMARY}
 
-func Cleanup(delete_window int) {
+func (sack *BeanSack) Cleanup(ctx context.Context, delete_window int) error {
 	delete_filter := store.JSON{
 		"updated": store.JSON{"$lte": timeValue(delete_window)},
 	}
 	// delete old stuff
-	beanstore.Delete(
+	_, beans_err := sack.beanstore.Delete(
+		ctx,
 		datautils.AppendMaps(
 			delete_filter,
 			store.JSON{
 				"kind": store.JSON{"$ne": CHANNEL},
 			}),
 	)
-	noisestore.Delete(delete_filter)
-	nuggetstore.Delete(delete_filter)
+	_, noises_err := sack.noisestore.Delete(ctx, delete_filter)
+	_, nuggets_err := sack.nuggetstore.Delete(ctx, delete_filter)
+	return errors.Join(beans_err, noises_err, nuggets_err)
 }
 
 // Adding feeds from news sources and social media
@@ -52,7 +58,15 @@ func Cleanup(delete_window int) {
 //  6. Create embeddings for news nuggets and add to db
 //  7. Create generated fields for the beans and add them to database
 //  8. Map the news nuggets to the beans
-func AddBeans(beans []Bean) {
+//
+// Steps 3 and 4 are all or nothing: if AddBeans returns any error other than an EnrichmentError none of the beans
+// or media noises got stored. An EnrichmentError means they got stored but step 7 failed for some of them. Rectify fills those in later.
+// Steps 5, 6 and 8 run in the background after AddBeans returns. They are not cancelled with ctx
+// and their errors are only logged. Shutdown waits for them to finish
+func (sack *BeanSack) AddBeans(ctx context.Context, beans []Bean) error {
+	if sack.isClosed() {
+		return BeanSackError("BeanSack is closed.")
+	}
 	// 1. Filter out the tiny ones and the channels for now
 	beans = datautils.Filter(beans, func(item *Bean) bool { return (len(item.Text) >= _MIN_TEXT_LENGTH) && (item.Kind != CHANNEL) })
 
@@ -75,31 +89,12 @@ func AddBeans(beans []Bean) {
 	})
 
 	// 3. Add the beans to the database
-	// notice that the beans get reassigned for custom fields generation
-	// since if certain bean does not get added it has already been processed and linked
-	beans, err := beanstore.Add(beans)
-	if err != nil {
-		log.Println("[beansack|Indexer] Failed to add new beans. Terminating early.", err)
-		return
-	}
-
 	// 4. Add media noise to database
-	if len(medianoises) > 0 {
-		// If a bean with the same url exists it will not get added but if it has a media noise it should get updated with the current updated date
-		beans_update := make([]any, 0, len(medianoises))
-		beans_ids := make([]store.JSON, 0, len(medianoises))
-
-		datautils.ForEach(medianoises, func(item *MediaNoise) {
-			item.Updated = update_time
-			item.Digest = nlp.TruncateTextOnTokenCount(item.Digest)
-			// create the update times for the beans
-			beans_update = append(beans_update, store.JSON{"updated": update_time})
-			beans_ids = append(beans_ids, store.JSON{"url": item.BeanUrl})
-		})
-		// now store the medianoises. But no need to check for error since their storage is auxiliary for the overall experience
-		noisestore.Add(medianoises)
-		// update the beans with medianoise
-		beanstore.Update(beans_update, beans_ids)
+	// both happen in one transaction so that a failure doesn't leave beans without their noises
+	beans, err := sack.storeBeansAndNoises(ctx, beans, medianoises, update_time)
+	if err != nil {
+		log.Println("[beansack|Indexer] Failed to store beans and media noises. Nothing got stored.", err)
+		return err
 	}
 
 	// if no new bean got added then no need to go through hoops for these
@@ -108,24 +103,109 @@ func AddBeans(beans []Bean) {
 		// 6. Create embeddings for news nuggets and add to db
 		// parallelizing this one since its a different server than the embeddings
 		// this will be faster than going through the custom fields
-		go generateNewsNuggets(beans)
+		sack.runInBackground(ctx, func(ctx context.Context) {
+			if err := sack.generateNewsNuggets(ctx, beans); err != nil {
+				log.Println("[beansack|Indexer] News nuggets generation failed.", err)
+			}
+		})
 
 		// 7. Create generated fields for the beans and add them to database
-		generateCustomFieldsForBeans(beans)
+		if err := sack.generateCustomFieldsForBeans(ctx, beans); err != nil {
+			return EnrichmentError{err: err}
+		}
 
 		// 8. Map the news nuggets to the beans
 		// this is remap across the board that will take place for each Add Beans to keep the mapping fresh
 		// even if not all the nuggets have been generated the new incoming nuggests will get mapped during the next rounds
 		// this can happen in parallel and does not need to block the call
-		go remapNewsNuggets(_MIN_RECTIFY_WINDOW)
+		sack.runInBackground(ctx, func(ctx context.Context) {
+			if err := sack.remapNewsNuggets(ctx, _MIN_RECTIFY_WINDOW); err != nil {
+				log.Println("[beansack|Indexer] News nuggets remapping failed.", err)
+			}
+		})
+	}
+	return nil
+}
+
+// Adds the beans and the media noises and bumps the updated time of the beans that got noises in one transaction.
+// Without database transactions the writes get undone when one of them fails.
+// Returns the beans that were added or replaced
+func (sack *BeanSack) storeBeansAndNoises(ctx context.Context, beans []Bean, medianoises []MediaNoise, update_time int64) ([]Bean, error) {
+	var stored []Bean
+	err := sack.beanstore.Transaction(ctx, func(ctx context.Context, tx *store.Transaction) error {
+		urls := datautils.Transform(beans, func(item *Bean) any { return item.Url })
+		if err := sack.beanstore.CheckpointIn(ctx, tx, nil, "url", urls); err != nil {
+			return err
+		}
+		// noises don't get replaced so the ones of this batch are the ones to undo
+		if err := sack.noisestore.CheckpointIn(ctx, tx, store.JSON{"updated": update_time}, "mapped_url", urls); err != nil {
+			return err
+		}
+
+		// notice that the beans get reassigned for custom fields generation
+		// since if certain bean does not get added it has already been processed and linked.
+		// A bean that already exists but whose content changed gets replaced and goes through the generation again
+		var err error
+		if stored, err = sack.beanstore.Add(ctx, beans); err != nil || len(medianoises) == 0 {
+			return err
+		}
+
+		// If a bean with the same url exists it will not get added but if it has a media noise it should get updated with the current updated date
+		beans_update := make([]any, 0, len(medianoises))
+		beans_ids := make([]store.JSON, 0, len(medianoises))
+		datautils.ForEach(medianoises, func(item *MediaNoise) {
+			item.Updated = update_time
+			item.Digest = nlp.TruncateTextOnTokenCount(item.Digest)
+			// create the update times for the beans
+			beans_update = append(beans_update, store.JSON{"updated": update_time})
+			beans_ids = append(beans_ids, store.JSON{"url": item.BeanUrl})
+		})
+		if _, err = sack.noisestore.Add(ctx, medianoises); err != nil {
+			return err
+		}
+		// a failed update aborts a database transaction so there is no retrying in it
+		if tx.Native() {
+			_, err = sack.beanstore.Update(ctx, beans_update, beans_ids)
+			return err
+		}
+		return updateAndRetryFailed(ctx, sack.beanstore, beans_update, beans_ids)
+	})
+	if err != nil {
+		return nil, err
 	}
+	return stored, nil
 }
 
-func generateCustomFieldsForBeans(beans []Bean) {
-	datautils.ForEach(_GENERATED_FIELDS, func(field_name *string) { generateFieldForBeans(beans, *field_name) })
+// the background work should outlive the caller's request so it keeps the values of ctx but not its cancellation.
+// It gets cancelled only when Shutdown runs out of time waiting for it
+func (sack *BeanSack) runInBackground(ctx context.Context, task func(ctx context.Context)) {
+	sack.lock.Lock()
+	defer sack.lock.Unlock()
+	if sack.closed {
+		log.Println("[beansack|Indexer] BeanSack is closed. Skipping background task.")
+		return
+	}
+	task_ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(sack.background, cancel)
+	sack.tasks.Add(1)
+	go func() {
+		defer sack.tasks.Done()
+		defer cancel()
+		defer stop()
+		task(task_ctx)
+	}()
 }
 
-func generateFieldForBeans(beans []Bean, field_name string) {
+func (sack *BeanSack) generateCustomFieldsForBeans(ctx context.Context, beans []Bean) error {
+	errs := make([]error, 0, len(_GENERATED_FIELDS))
+	for _, field_name := range _GENERATED_FIELDS {
+		errs = append(errs, sack.generateFieldForBeans(ctx, beans, field_name))
+	}
+	return errors.Join(errs...)
+}
+
+// the items that failed generation get a dud update and the error is returned after the rest have been stored
+func (sack *BeanSack) generateFieldForBeans(ctx context.Context, beans []Bean, field_name string) error {
 	log.Printf("[beanops] Generating %s for a batch of %d beans", field_name, len(beans))
 
 	// get identifier and text content for processing
@@ -133,28 +213,35 @@ func generateFieldForBeans(beans []Bean, field_name string) {
 	texts := getTextFields(beans)
 	// generate whatever needs to be generated
 	var updates []any
+	var gen_err error
 	switch field_name {
 	case _CLASSIFICATION_EMB:
-		cat_embs := emb_client.CreateBatchTextEmbeddings(texts, nlp.CLASSIFICATION)
+		var cat_embs [][]float32
+		cat_embs, gen_err = sack.emb_client.CreateBatchTextEmbeddings(ctx, texts, nlp.CLASSIFICATION)
 		updates = datautils.Transform(cat_embs, func(emb *[]float32) any {
 			return Bean{CategoryEmbeddings: *emb}
 		})
 	// case _SEARCH_EMB:
-	// 	search_embs := emb_client.CreateBatchTextEmbeddings(texts, nlp.SEARCH_DOCUMENT)
+	// 	search_embs := sack.emb_client.CreateBatchTextEmbeddings(texts, nlp.SEARCH_DOCUMENT)
 	// 	updates = datautils.Transform(search_embs, func(emb *[]float32) any {
 	// 		return Bean{SearchEmbeddings: *emb}
 	// 	})
 	case _SUMMARY:
 		// summary and topic. but topic is low priority field and it comes with summary
-		digests := pb_client.ExtractDigests(texts)
+		var digests []nlp.Digest
+		digests, gen_err = sack.pb_client.ExtractDigests(ctx, texts)
 		updates = datautils.Transform(digests, func(item *nlp.Digest) any { return item })
 	}
-	beanstore.Update(updates, filters)
+	// if the generation got cut short the filters need to line up with the updates
+	// the ones that still fail don't get the field and Rectify picks them up later
+	err := updateAndRetryFailed(ctx, sack.beanstore, updates, filters[:len(updates)])
+	return errors.Join(gen_err, err)
 }
 
-func generateNewsNuggets(beans []Bean) {
+func (sack *BeanSack) generateNewsNuggets(ctx context.Context, beans []Bean) error {
 	// extract key newsnuggets
-	keyconcepts := pb_client.ExtractKeyConcepts(getTextFields(beans))
+	// the concepts from the batches that worked are still worth storing
+	keyconcepts, gen_err := sack.pb_client.ExtractKeyConcepts(ctx, getTextFields(beans))
 	// remove the duds
 	nuggets := datautils.FilterAndTransform(keyconcepts, func(keyconcept *nlp.KeyConcept) (bool, NewsNugget) {
 		nugget := toNewsNugget(keyconcept)
@@ -173,34 +260,45 @@ func generateNewsNuggets(beans []Bean) {
 	log.Printf("[beanops] Generating embeddings for %d News Nuggets.\n", len(nuggets))
 	descriptions := datautils.Transform(nuggets, func(item *NewsNugget) string { return item.Description })
 	// deprecating categorization
-	// embs := emb_client.CreateBatchTextEmbeddings(descriptions, nlp.CATEGORIZATION)
-	embs := emb_client.CreateBatchTextEmbeddings(descriptions, nlp.SEARCH_QUERY)
+	// embs := sack.emb_client.CreateBatchTextEmbeddings(descriptions, nlp.CATEGORIZATION)
+	// the ones that fail get a dud embedding and get picked up by Rectify later
+	embs, emb_err := sack.emb_client.CreateBatchTextEmbeddings(ctx, descriptions, nlp.SEARCH_QUERY)
 	for i := range nuggets {
 		nuggets[i].Embeddings = embs[i]
 	}
 
 	// now store the nuggets
-	nuggetstore.Add(nuggets)
+	_, err := sack.nuggetstore.Add(ctx, nuggets)
+	return errors.Join(gen_err, emb_err, err)
 }
 
-func generateCustomFieldForNuggets(nuggets []NewsNugget) {
+func (sack *BeanSack) generateCustomFieldForNuggets(ctx context.Context, nuggets []NewsNugget) error {
 	log.Printf("[beanops] Generating embeddings for %d News Nuggets.\n", len(nuggets))
 
 	descriptions := datautils.Transform(nuggets, func(item *NewsNugget) string { return item.Description })
+	vecs, emb_err := sack.emb_client.CreateBatchTextEmbeddings(ctx, descriptions, nlp.CLASSIFICATION)
 	embs := datautils.Transform(
-		emb_client.CreateBatchTextEmbeddings(descriptions, nlp.CLASSIFICATION),
+		vecs,
 		func(item *[]float32) any {
 			return NewsNugget{Embeddings: *item}
 		})
 
 	if len(embs) == len(descriptions) {
 		ids := getNewsNuggetIds(nuggets)
-		nuggetstore.Update(embs, ids)
+		if err := updateAndRetryFailed(ctx, sack.nuggetstore, embs, ids); err != nil {
+			return errors.Join(emb_err, err)
+		}
 	}
+	return emb_err
 }
 
-func remapNewsNuggets(window int) {
-	nuggets := nuggetstore.Get(
+func (sack *BeanSack) remapNewsNuggets(ctx context.Context, window int) error {
+	url_fields := store.JSON{"url": 1}
+	non_channels := store.JSON{
+		"kind": store.JSON{"$ne": CHANNEL},
+	}
+	// the mappings of each chunk get stored before moving on to the next one
+	return forEachChunk(ctx, sack.nuggetstore,
 		store.JSON{
 			"embeddings": store.JSON{"$exists": true}, // ignore if a nugget if it doesnt have an embedding
 			"updated":    store.JSON{"$gte": timeValue(window)},
@@ -208,47 +306,59 @@ func remapNewsNuggets(window int) {
 		store.JSON{
 			"_id":        1,
 			"embeddings": 1,
-		}, nil, -1)
-
-	url_fields := store.JSON{"url": 1}
-	non_channels := store.JSON{
-		"kind": store.JSON{"$ne": CHANNEL},
-	}
-	updates := datautils.Transform(nuggets, func(km *NewsNugget) any {
-		// search with vector embedding
-		// this is still a fuzzy search and it does not always work well
-		// if it doesn't do a text search
-		beans := beanstore.VectorSearch([][]float32{km.Embeddings},
-			_CLASSIFICATION_EMB,
-			store.WithVectorFilter(non_channels),
-			store.WithMinSearchScore(_DEFAULT_NUGGET_MATCH_SCORE),
-			store.WithVectorTopN(_MAX_TOPN),
-			store.WithProjection(url_fields))
-		// when vector search didn't pan out well do a text search and take the top 2
-		if len(beans) == 0 {
-			beans = beanstore.TextSearch([]string{km.KeyPhrase, km.Event},
-				store.WithTextFilter(non_channels),
-				store.WithMinSearchScore(_DEFAULT_NUGGET_TEXT_MATCH_SCORE),
-				store.WithTextTopN(2), // i might have to change this
+		}, nil,
+		func(ctx context.Context, nuggets []NewsNugget) error {
+			// search with vector embedding
+			// this is still a fuzzy search and it does not always work well
+			// if it doesn't do a text search
+			// the searches of the whole chunk go in one round trip
+			matches, err := sack.beanstore.BatchVectorSearch(ctx,
+				datautils.Transform(nuggets, func(item *NewsNugget) []float32 { return item.Embeddings }),
+				_CLASSIFICATION_EMB,
+				store.WithVectorFilter(non_channels),
+				store.WithMinSearchScore(_DEFAULT_NUGGET_MATCH_SCORE),
+				store.WithVectorTopN(_MAX_TOPN),
 				store.WithProjection(url_fields))
-		}
-		// get media noises and add up the score to reflect in the Nugget Score
-
-		return NewsNugget{
-			TrendScore: calculateNuggetScore(beans), // score = 5 x number_of_unique_urls + sum (noise_score)
-			BeanUrls:   datautils.Transform(beans, func(item *Bean) string { return item.Url }),
-		}
-	})
-	ids := getNewsNuggetIds(nuggets)
-	nuggetstore.Update(updates, ids)
+			if err != nil {
+				return err
+			}
+			updates := make([]any, 0, len(nuggets))
+			for i, km := range nuggets {
+				beans := matches[i]
+				// when vector search didn't pan out well do a text search and take the top 2
+				if len(beans) == 0 {
+					beans, err = sack.beanstore.TextSearch(ctx, []string{km.KeyPhrase, km.Event},
+						store.WithTextFilter(non_channels),
+						store.WithMinSearchScore(_DEFAULT_NUGGET_TEXT_MATCH_SCORE),
+						store.WithTextTopN(2), // i might have to change this
+						store.WithProjection(url_fields))
+				}
+				if err != nil {
+					return err
+				}
+				// get media noises and add up the score to reflect in the Nugget Score
+				score, err := sack.calculateNuggetScore(ctx, beans) // score = 5 x number_of_unique_urls + sum (noise_score)
+				if err != nil {
+					return err
+				}
+				updates = append(updates, NewsNugget{
+					TrendScore: score,
+					BeanUrls:   datautils.Transform(beans, func(item *Bean) string { return item.Url }),
+				})
+			}
+			// the ones that still fail get remapped in the next round
+			return updateAndRetryFailed(ctx, sack.nuggetstore, updates, getNewsNuggetIds(nuggets))
+		})
 }
 
 // this is for any recurring service
 // this is currently not being run as a recurring service
-func Rectify() {
+// Generation failures don't stop the rest of the steps. All the errors are returned together at the end
+func (sack *BeanSack) Rectify(ctx context.Context) error {
+	var errs []error
 	// BEANS: generate the fields that do not exist
 	for _, field_name := range _GENERATED_FIELDS {
-		beans := beanstore.Get(
+		err := forEachChunk(ctx, sack.beanstore,
 			store.JSON{
 				field_name: store.JSON{"$exists": false},
 				"updated":  store.JSON{"$gte": timeValue(_MAX_RECTIFY_WINDOW)},
@@ -259,10 +369,16 @@ func Rectify() {
 				"text": 1,
 			},
 			_SORT_BY_UPDATED, // this way the newest ones get priority
-			-1,
-		)
-		// store generated field
-		generateFieldForBeans(beans, field_name)
+			func(ctx context.Context, beans []Bean) error {
+				// store generated field
+				if err := sack.generateFieldForBeans(ctx, beans, field_name); err != nil {
+					errs = append(errs, err)
+				}
+				return nil
+			})
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
 	}
 
 	// TODO: if certain bean doesn't have a nugget regenerate then
@@ -271,7 +387,7 @@ func Rectify() {
 	// process data in batches so that there is at least partial success
 	// it is possible that embeddings generation failed even after retry.
 	// if things failed no need to insert those items
-	nuggets := nuggetstore.Get(
+	err := forEachChunk(ctx, sack.nuggetstore,
 		store.JSON{
 			"embeddings": store.JSON{"$exists": false},
 			"updated":    store.JSON{"$gte": timeValue(_MAX_RECTIFY_WINDOW)},
@@ -281,27 +397,79 @@ func Rectify() {
 			"description": 1,
 		},
 		_SORT_BY_UPDATED, // this way the newest ones get priority
-		-1,
-	)
-	generateCustomFieldForNuggets(nuggets)
+		func(ctx context.Context, nuggets []NewsNugget) error {
+			if err := sack.generateCustomFieldForNuggets(ctx, nuggets); err != nil {
+				errs = append(errs, err)
+			}
+			return nil
+		})
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
 	// MAPPING: now that the beans and nuggets have embeddings, remap them
-	remapNewsNuggets(_MAX_RECTIFY_WINDOW)
+	if err = sack.remapNewsNuggets(ctx, _MAX_RECTIFY_WINDOW); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// updates the items and retries the ones that failed once more.
+// The ones that still fail are logged with their ids and their error is returned
+func updateAndRetryFailed[T any](ctx context.Context, items *store.Store[T], updates []any, filters []store.JSON) error {
+	res, err := items.Update(ctx, updates, filters)
+	failed := res.FailedDocs()
+	if err == nil || len(failed) == 0 {
+		return err
+	}
+	retry_updates := make([]any, len(failed))
+	retry_filters := make([]store.JSON, len(failed))
+	for i, pos := range failed {
+		retry_updates[i], retry_filters[i] = updates[pos], filters[pos]
+	}
+	log.Printf("[beansack|Indexer] Retrying %d failed updates.\n", len(failed))
+	res, err = items.Update(ctx, retry_updates, retry_filters)
+	for _, pos := range res.FailedDocs() {
+		log.Printf("[beansack|Indexer] Giving up on update for %s. %v\n", datautils.ToJsonString(retry_filters[pos]), res.Failed[pos])
+	}
+	return err
+}
+
+// streams the items that match the filter and processes them in chunks of _RECT_BATCH_SIZE
+// so that the batch jobs don't pull everything in memory at once
+func forEachChunk[T any](ctx context.Context, items *store.Store[T], filter, fields, sort_by store.JSON, process func(ctx context.Context, chunk []T) error) error {
+	iter, err := items.Iterate(ctx, filter, fields, sort_by, -1)
+	if err != nil {
+		return err
+	}
+	return store.ForEachChunk(ctx, iter, _RECT_BATCH_SIZE, process)
 }
 
 // current calculation score: 5 x number_of_unique_articles_or_posts + sum_of(noise_scores)
-func calculateNuggetScore(beans []Bean) int {
+func (sack *BeanSack) calculateNuggetScore(ctx context.Context, beans []Bean) (int, error) {
 	var base = len(beans) * 5
-	score := getMediaNoises(beans, true)
+	score, err := sack.getMediaNoises(ctx, beans, true)
+	if err != nil {
+		return 0, err
+	}
 	if len(score) == 1 {
 		base += score[0].Score
 	}
-	return base
+	return base, nil
 }
 
 func getBeanId(bean *Bean) store.JSON {
 	return store.JSON{"url": bean.Url}
 }
 
+// the beans that have the same title and text don't need to be processed again
+func getBeanContentHash(bean *Bean) string {
+	hash := sha256.New()
+	hash.Write([]byte(bean.Title))
+	hash.Write([]byte{0})
+	hash.Write([]byte(bean.Text))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
 func getBeanIdFilters(beans []Bean) []store.JSON {
 	return datautils.Transform(beans, func(bean *Bean) store.JSON {
 		return getBeanId(bean)
@@ -0,0 +1,163 @@
+package sdk
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/soumitsalman/beansack/nlp"
+	"github.com/tmc/langchaingo/llms"
+)
+
+const _STUB = "stub"
+
+// embeds the texts by the topics they mention so that the beans and the nuggets of the same topic match
+type stubEmbedder struct{}
+
+func (stubEmbedder) CreateBatchTextEmbeddings(ctx context.Context, texts []string, task_type string) ([][]float32, error) {
+	embs := make([][]float32, len(texts))
+	for i, text := range texts {
+		text = strings.ToLower(text)
+		embs[i] = []float32{0, 0, 0.1}
+		if strings.Contains(text, "golang") {
+			embs[i][0] = 1
+		}
+		if strings.Contains(text, "rust") {
+			embs[i][1] = 1
+		}
+	}
+	return embs, nil
+}
+
+func (stubEmbedder) Dimensions() int {
+	return 3
+}
+
+func (stubEmbedder) ModelID() string {
+	return _STUB
+}
+
+func init() {
+	nlp.RegisterEmbedder(_STUB, func(config nlp.EmbedderConfig) (nlp.Embedder, error) { return stubEmbedder{}, nil })
+}
+
+// answers the digest and the key concept prompts with fixed json
+type stubLLM struct{}
+
+func (llm stubLLM) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	system := fmt.Sprint(messages[0].Parts)
+	content := `{"summary": "a new golang release", "topic": "Golang"}`
+	if strings.Contains(system, `"concepts"`) {
+		content = `{"concepts": [{"keyphrase": "Golang", "event": "release", "description": "Golang ships a new release"}]}`
+	}
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{{Content: content}}}, nil
+}
+
+func (llm stubLLM) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, llm, prompt, options...)
+}
+
+func newTestBeanSack(t *testing.T) *BeanSack {
+	t.Helper()
+	sack, err := NewBeanSack("memory://"+t.Name(), "", "",
+		WithEmbedder(nlp.EmbedderConfig{Driver: _STUB}),
+		WithParrotboxOptions(nlp.WithLLM(stubLLM{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sack.Shutdown(context.Background()) })
+	return sack
+}
+
+func testBean(url, topic string, noise *MediaNoise) Bean {
+	return Bean{
+		Url:        url,
+		Kind:       ARTICLE,
+		Title:      topic + " news",
+		Text:       strings.Repeat(fmt.Sprintf("%s is getting a new release this week. ", topic), 5),
+		MediaNoise: noise,
+	}
+}
+
+func TestAddBeansToTrendingBeans(t *testing.T) {
+	ctx := context.Background()
+	sack := newTestBeanSack(t)
+	beans := []Bean{
+		testBean("https://a.com/golang", "Golang", &MediaNoise{Source: "reddit", Comments: 2, ThumbsupCount: 4}),
+		testBean("https://b.com/golang", "Golang", nil),
+		testBean("https://c.com/rust", "Rust", nil),
+		// too short to be processed
+		{Url: "https://d.com/short", Kind: ARTICLE, Text: "Golang"},
+	}
+	if err := sack.AddBeans(ctx, beans); err != nil {
+		t.Fatal(err)
+	}
+	// the nuggets get generated in the background
+	sack.tasks.Wait()
+
+	stored, err := sack.beanstore.Get(ctx, nil, nil, nil, -1)
+	if err != nil || len(stored) != 3 {
+		t.Fatalf("expected the 3 long beans, got %d %v", len(stored), err)
+	}
+	for _, bean := range stored {
+		if bean.Summary == "" || len(bean.CategoryEmbeddings) != 3 {
+			t.Fatalf("%s didn't get its generated fields: %+v", bean.Url, bean)
+		}
+	}
+
+	// the background remap can run before the nuggets are stored
+	if err := sack.remapNewsNuggets(ctx, _MIN_RECTIFY_WINDOW); err != nil {
+		t.Fatal(err)
+	}
+	nuggets, err := sack.nuggetstore.Get(ctx, nil, nil, nil, -1)
+	if err != nil || len(nuggets) != 1 {
+		t.Fatalf("expected 1 nugget, got %d %v", len(nuggets), err)
+	}
+	// 5 for each of the 2 golang beans and 3 x comments + likes of the media noise
+	if nugget := nuggets[0]; nugget.TrendScore != 20 || len(nugget.BeanUrls) != 2 {
+		t.Fatalf("unexpected nugget mapping %+v", nugget)
+	}
+
+	// the pages of the trending beans follow the pages of the fuzzy search
+	options := NewSearchOptions().WithTimeWindow(1).WithTopN(2)
+	scores := make(map[string]float64)
+	for page := 0; page == 0 || options.PageToken != ""; page++ {
+		trending, next_page, err := sack.TrendingBeans(ctx, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, bean := range trending {
+			scores[bean.Url] = bean.SearchScore
+			if (bean.MediaNoise != nil) != (bean.Url == "https://a.com/golang") {
+				t.Fatalf("unexpected media noise for %s: %+v", bean.Url, bean.MediaNoise)
+			}
+		}
+		options.PageToken = next_page
+	}
+	expected := map[string]float64{"https://a.com/golang": 20, "https://b.com/golang": 20, "https://c.com/rust": 0}
+	if fmt.Sprint(scores) != fmt.Sprint(expected) {
+		t.Fatalf("expected the trend scores %v, got %v", expected, scores)
+	}
+
+	// the page of the fuzzy search is newest first and then by url which puts the rust bean first
+	trending, _, err := sack.TrendingBeans(ctx, NewSearchOptions().WithTimeWindow(1).WithTopN(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := make([]string, len(trending))
+	for i, bean := range trending {
+		urls[i] = bean.Url
+	}
+	if actual := fmt.Sprint(urls); actual != "[https://b.com/golang https://a.com/golang https://c.com/rust]" {
+		t.Fatalf("expected the beans ranked by trend score, got %s", actual)
+	}
+
+	// searching for a topic only returns its beans
+	options = NewSearchOptions().WithTimeWindow(1)
+	options.SearchTexts = []string{"golang"}
+	trending, _, err = sack.TrendingBeans(ctx, options)
+	if err != nil || len(trending) != 2 {
+		t.Fatalf("expected the 2 golang beans, got %d %v", len(trending), err)
+	}
+}
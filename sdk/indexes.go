@@ -0,0 +1,56 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+
+	"github.com/soumitsalman/beansack/store"
+)
+
+// indexes of the beansack collections. store/mongosh.js has the same definitions for creating them by hand
+const (
+	_BEANS_VECTOR_INDEX   = "beans_category_search"
+	_NUGGETS_VECTOR_INDEX = "concept_vector_search"
+)
+
+var (
+	// fields of beans_text_search and concept_text_search
+	_BEANS_TEXT_FIELDS   = []string{"title", "summary", "topic", "keywords"}
+	_NUGGETS_TEXT_FIELDS = []string{"keyphrase", "event"}
+)
+
+func (sack *BeanSack) beanIndexes() []store.IndexSpec {
+	return []store.IndexSpec{
+		// the scalar fields that the bean searches filter on
+		sack.vectorIndexSpec(_BEANS_VECTOR_INDEX, _CLASSIFICATION_EMB, "updated", "kind", "url"),
+		// these need to exist for using the fields as filters in vector search
+		store.ScalarIndexSpec("beans_scalar_search", store.Desc("updated"), store.Asc("kind")),
+		store.TextIndexSpec("beans_text_search", _BEANS_TEXT_FIELDS...),
+		store.UniqueIndexSpec("url"),
+	}
+}
+
+func (sack *BeanSack) nuggetIndexes() []store.IndexSpec {
+	return []store.IndexSpec{
+		store.TextIndexSpec("concept_text_search", _NUGGETS_TEXT_FIELDS...),
+		store.ScalarIndexSpec("concept_scalar_search", store.Desc("updated"), store.Desc("match_count")),
+		store.ScalarIndexSpec("concept_scalar_search_url", store.Asc("mapped_urls")),
+		sack.vectorIndexSpec(_NUGGETS_VECTOR_INDEX, "embeddings"),
+	}
+}
+
+func (sack *BeanSack) vectorIndexSpec(name, vec_path string, filter_fields ...string) store.IndexSpec {
+	spec := store.VectorIndexSpec(name, vec_path, sack.embedding_dimensions, filter_fields...)
+	spec.Quantization = sack.embedding_quantization
+	return spec
+}
+
+// Creates the indexes of the beansack collections that don't exist yet and reports the ones that differ from the expected definitions.
+// Existing indexes are never dropped or rebuilt. Returns the reports by collection name
+func (sack *BeanSack) EnsureIndexes(ctx context.Context) (map[string]store.IndexReport, error) {
+	reports := make(map[string]store.IndexReport, 2)
+	var beans_err, nuggets_err error
+	reports[BEANS], beans_err = sack.beanstore.EnsureIndexes(ctx, sack.beanIndexes()...)
+	reports[NEWSNUGGETS], nuggets_err = sack.nuggetstore.EnsureIndexes(ctx, sack.nuggetIndexes()...)
+	return reports, errors.Join(beans_err, nuggets_err)
+}
@@ -1,6 +1,13 @@
 package sdk
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
 	"github.com/soumitsalman/beansack/nlp"
 	"github.com/soumitsalman/beansack/store"
 )
@@ -13,13 +20,36 @@ const (
 	NEWSNUGGETS = "concepts"
 )
 
-var (
+// BeanSack is a client for one beansack database and one set of model endpoints.
+// Each instance carries its own stores and drivers so multiple instances can live in the same process
+type BeanSack struct {
 	beanstore   *store.Store[Bean]
 	nuggetstore *store.Store[NewsNugget]
 	noisestore  *store.Store[MediaNoise]
-	emb_client  *nlp.EmbeddingsDriver
-	pb_client   *nlp.ParrotboxClient
-)
+	// schema versions of the collections for Migrate
+	versionstore *store.Store[store.SchemaVersion]
+	emb_client   nlp.Embedder
+	emb_config   nlp.EmbedderConfig
+	pb_client    *nlp.ParrotboxClient
+	pb_options   []nlp.ParrotboxOption
+	// size of the embeddings. The vector indexes are created with it
+	embedding_dimensions int
+	// how the bean and nugget embeddings are stored
+	embedding_quantization store.Quantization
+	// nil for the dialect that the store detects from the host of db_conn_str
+	vector_search_dialect store.VectorSearchDialect
+	tenant                store.Tenant
+
+	// background enrichment started by AddBeans
+	lock       sync.Mutex
+	closed     bool
+	tasks      sync.WaitGroup
+	background context.Context // cancelling this cancels the in-flight background tasks
+	cancel     context.CancelFunc
+}
+
+// the instance behind the package level functions. It is set by InitializeBeanSack
+var default_sack *BeanSack
 
 const (
 	// _SEARCH_EMB = "search_embeddings"
@@ -27,27 +57,289 @@ const (
 	_SUMMARY            = "summary"
 )
 
+const (
+	_INDEX_BOOTSTRAP_TIMEOUT = time.Minute
+)
+
+type BeanSackOption func(sack *BeanSack)
+
+// size of the embeddings that the embedder creates. Default is what the embedder reports, 768 for the built-in drivers
+func WithEmbeddingDimensions(dimensions int) BeanSackOption {
+	return func(sack *BeanSack) {
+		sack.embedding_dimensions = dimensions
+	}
+}
+
+// picks the embeddings driver and its model such as nlp.HUGGINGFACE. See nlp.RegisterEmbedder for adding drivers.
+// emb_base_url of NewBeanSack is the base url when the config doesn't have one. Default is the embeddings service
+func WithEmbedder(config nlp.EmbedderConfig) BeanSackOption {
+	return func(sack *BeanSack) {
+		sack.emb_config = config
+	}
+}
+
+// stores the category embeddings of the beans and the embeddings of the nuggets as int8 or binary vectors.
+// They read back as float arrays and the searches rescore the candidates with the full precision query
+// so the match score thresholds stay the same. Existing items keep their full precision embeddings until they get rewritten.
+// Only the atlas vector search can search quantized vectors so NewBeanSack fails for Cosmos DB and self hosted mongo
+func WithEmbeddingQuantization(quantization store.Quantization) BeanSackOption {
+	return func(sack *BeanSack) {
+		sack.embedding_quantization = quantization
+	}
+}
+
+// vector search dialect of the beans and the nuggets such as store.AtlasVectorSearch() for a cluster behind a custom DNS name.
+// Default is what the host of db_conn_str looks like and the exact search for the hosts that are not cosmos or atlas
+func WithVectorSearchDialect(dialect store.VectorSearchDialect) BeanSackOption {
+	return func(sack *BeanSack) {
+		sack.vector_search_dialect = dialect
+	}
+}
+
+// where and how the digests and key concepts get generated e.g. a local ollama or llama.cpp server instead of Groq.
+// pb_auth_token of NewBeanSack goes to the endpoints that don't have their own key
+func WithParrotboxOptions(opts ...nlp.ParrotboxOption) BeanSackOption {
+	return func(sack *BeanSack) {
+		sack.pb_options = append(sack.pb_options, opts...)
+	}
+}
+
+// scopes everything the BeanSack stores, searches and computes to the tenant such as a topic focused beansack.
+// BeanSacks of different tenants can share the same database. See store.Tenant for the two ways of separating them
+func WithTenant(tenant store.Tenant) BeanSackOption {
+	return func(sack *BeanSack) {
+		sack.tenant = tenant
+	}
+}
+
 type BeanSackError string
 
 func (err BeanSackError) Error() string {
 	return string(err)
 }
 
-func InitializeBeanSack(db_conn_str, emb_base_url string, pb_auth_token string) error {
-	beanstore = store.New(db_conn_str, BEANSACK, BEANS,
+// returned by AddBeans when the beans got stored but generating their fields failed
+type EnrichmentError struct {
+	err error
+}
+
+func (err EnrichmentError) Error() string {
+	return "enrichment failed: " + err.err.Error()
+}
+
+func (err EnrichmentError) Unwrap() error {
+	return err.err
+}
+
+// db_conn_str picks the store backend by its scheme: mongodb:// or mongodb+srv:// for mongo/cosmos db,
+// file://<directory> for a local embedded store or memory://<name> for an in-process store.
+// Add ?vector_index=hnsw to the last two for approximate instead of exact vector search on big collections.
+// The stores share one client per db_conn_str. Use store.ConfigurePool before this to set its connection pool.
+// The indexes that don't exist yet get created. See EnsureIndexes
+func NewBeanSack(db_conn_str, emb_base_url string, pb_auth_token string, opts ...BeanSackOption) (*BeanSack, error) {
+	sack := &BeanSack{}
+	for _, opt := range opts {
+		opt(sack)
+	}
+	bean_options := []store.StoreOption[Bean]{
 		// store.WithMinSearchScore[Bean](0.55), // TODO: change this to 0.8 in future
 		// store.WithSearchTopN[Bean](10),
 		store.WithDataIDAndEqualsFunction(getBeanId, Equals),
-	)
-	noisestore = store.New[MediaNoise](db_conn_str, BEANSACK, NOISES)
-	nuggetstore = store.New[NewsNugget](db_conn_str, BEANSACK, NEWSNUGGETS)
+		// lets Add insert big batches without looking up the existing urls first
+		store.WithUniqueIndex[Bean]("url"),
+		// re-published beans with corrected title or text replace the stale ones
+		store.WithWritePolicy[Bean](store.ReplaceIfChanged),
+		store.WithContentHash(getBeanContentHash),
+		// url breaks the ties in pagination
+		store.WithUniqueField[Bean]("url"),
+		// same fields as beans_text_search index
+		store.WithTextSearchFields[Bean](_BEANS_TEXT_FIELDS...),
+		store.WithVectorIndex[Bean](_CLASSIFICATION_EMB, _BEANS_VECTOR_INDEX),
+		store.WithQuantizedVectors[Bean](sack.embedding_quantization, _CLASSIFICATION_EMB),
+	}
+	nugget_options := []store.StoreOption[NewsNugget]{
+		// same fields as concept_text_search index
+		store.WithTextSearchFields[NewsNugget](_NUGGETS_TEXT_FIELDS...),
+		store.WithVectorIndex[NewsNugget]("embeddings", _NUGGETS_VECTOR_INDEX),
+		store.WithQuantizedVectors[NewsNugget](sack.embedding_quantization, "embeddings"),
+	}
+	if sack.vector_search_dialect != nil {
+		bean_options = append(bean_options, store.WithVectorSearchDialect[Bean](sack.vector_search_dialect))
+		nugget_options = append(nugget_options, store.WithVectorSearchDialect[NewsNugget](sack.vector_search_dialect))
+	}
+	sack.beanstore = store.NewForTenant(db_conn_str, BEANSACK, BEANS, sack.tenant, bean_options...)
+	sack.noisestore = store.NewForTenant[MediaNoise](db_conn_str, BEANSACK, NOISES, sack.tenant)
+	sack.nuggetstore = store.NewForTenant(db_conn_str, BEANSACK, NEWSNUGGETS, sack.tenant, nugget_options...)
+
+	sack.versionstore = store.NewSchemaVersionStoreForTenant(db_conn_str, BEANSACK, sack.tenant)
+
+	if sack.beanstore == nil || sack.nuggetstore == nil || sack.noisestore == nil || sack.versionstore == nil {
+		sack.closeStores(context.Background())
+		return nil, storesError(db_conn_str, sack.tenant, bean_options)
+	}
+
+	sack.pb_client = nlp.NewParrotboxClient(pb_auth_token, sack.pb_options...)
+	if sack.pb_client == nil {
+		sack.closeStores(context.Background())
+		return nil, BeanSackError("Initialization Failed. Parrotbox client not working.")
+	}
+	if sack.emb_config.BaseURL == "" {
+		sack.emb_config.BaseURL = emb_base_url
+	}
+	if sack.emb_config.Dimensions == 0 {
+		sack.emb_config.Dimensions = sack.embedding_dimensions
+	}
+	emb_client, err := nlp.NewEmbedder(sack.emb_config)
+	if err != nil {
+		sack.closeStores(context.Background())
+		return nil, BeanSackError(fmt.Sprintf("Initialization Failed. Embedder not working. %v", err))
+	}
+	sack.emb_client = emb_client
+	sack.embedding_dimensions = emb_client.Dimensions()
+	sack.background, sack.cancel = context.WithCancel(context.Background())
+
+	// failing to create the indexes doesn't stop the initialization since they might be managed by hand
+	ctx, cancel := context.WithTimeout(context.Background(), _INDEX_BOOTSTRAP_TIMEOUT)
+	defer cancel()
+	if _, err := sack.EnsureIndexes(ctx); err != nil {
+		log.Println("[beansack] Couldn't create the indexes.", err)
+	}
 
-	if beanstore == nil || nuggetstore == nil {
+	return sack, nil
+}
+
+// tells the stores that refused quantized embeddings apart from a db_conn_str that doesn't work
+func storesError(db_conn_str string, tenant store.Tenant, bean_options []store.StoreOption[Bean]) error {
+	// the option goes last so that it turns off the quantization of bean_options
+	probe := store.NewForTenant(db_conn_str, BEANSACK, BEANS, tenant,
+		append(bean_options, store.WithQuantizedVectors[Bean](store.NoQuantization, _CLASSIFICATION_EMB))...)
+	if probe == nil {
 		return BeanSackError("Initialization Failed. db_conn_str Not working.")
 	}
+	probe.Close(context.Background())
+	return BeanSackError("Initialization Failed. The vector search of the database can't search quantized embeddings. Use WithVectorSearchDialect(store.AtlasVectorSearch()) for atlas or store.NoQuantization.")
+}
+
+// Waits for the in-flight background enrichment to finish and then releases the database connections.
+// If ctx is done before that the background tasks get cancelled and ctx.Err() is returned after they have stopped.
+// New AddBeans calls fail once Shutdown has started
+func (sack *BeanSack) Shutdown(ctx context.Context) error {
+	sack.lock.Lock()
+	sack.closed = true
+	sack.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		sack.tasks.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		// the tasks check their context so they will return shortly
+		sack.cancel()
+		<-done
+	}
+	sack.cancel()
+	// the connections are released with a fresh context since ctx might be done already
+	return errors.Join(err, sack.closeStores(context.WithoutCancel(ctx)))
+}
+
+// same as Shutdown without a deadline
+func (sack *BeanSack) Close() error {
+	return sack.Shutdown(context.Background())
+}
 
-	pb_client = nlp.NewParrotboxClient(pb_auth_token)
-	emb_client = nlp.NewEmbeddingsDriver(emb_base_url)
+func (sack *BeanSack) isClosed() bool {
+	sack.lock.Lock()
+	defer sack.lock.Unlock()
+	return sack.closed
+}
 
+func (sack *BeanSack) closeStores(ctx context.Context) error {
+	var errs []error
+	if sack.beanstore != nil {
+		errs = append(errs, sack.beanstore.Close(ctx))
+	}
+	if sack.nuggetstore != nil {
+		errs = append(errs, sack.nuggetstore.Close(ctx))
+	}
+	if sack.noisestore != nil {
+		errs = append(errs, sack.noisestore.Close(ctx))
+	}
+	if sack.versionstore != nil {
+		errs = append(errs, sack.versionstore.Close(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// Initializes the default BeanSack that the package level functions use.
+// Use NewBeanSack for talking to more than one database or set of model endpoints
+func InitializeBeanSack(db_conn_str, emb_base_url string, pb_auth_token string, opts ...BeanSackOption) error {
+	sack, err := NewBeanSack(db_conn_str, emb_base_url, pb_auth_token, opts...)
+	if err != nil {
+		return err
+	}
+	default_sack = sack
 	return nil
 }
+
+// package level functions for the default BeanSack
+
+func Retrieve(ctx context.Context, options *SearchOptions) ([]Bean, string, error) {
+	return default_sack.Retrieve(ctx, options)
+}
+
+func TextSearch(ctx context.Context, keywords []string, settings *SearchOptions) ([]Bean, string, error) {
+	return default_sack.TextSearch(ctx, keywords, settings)
+}
+
+func FuzzySearch(ctx context.Context, options *SearchOptions) ([]Bean, string, error) {
+	return default_sack.FuzzySearch(ctx, options)
+}
+
+func NuggetSearch(ctx context.Context, nuggets []string, settings *SearchOptions) ([]Bean, error) {
+	return default_sack.NuggetSearch(ctx, nuggets, settings)
+}
+
+func TrendingNuggets(ctx context.Context, options *SearchOptions) ([]NewsNugget, error) {
+	return default_sack.TrendingNuggets(ctx, options)
+}
+
+func TrendingBeans(ctx context.Context, options *SearchOptions) ([]Bean, string, error) {
+	return default_sack.TrendingBeans(ctx, options)
+}
+
+func AddBeans(ctx context.Context, beans []Bean) error {
+	return default_sack.AddBeans(ctx, beans)
+}
+
+func Cleanup(ctx context.Context, delete_window int) error {
+	return default_sack.Cleanup(ctx, delete_window)
+}
+
+func Rectify(ctx context.Context) error {
+	return default_sack.Rectify(ctx)
+}
+
+func EnsureIndexes(ctx context.Context) (map[string]store.IndexReport, error) {
+	return default_sack.EnsureIndexes(ctx)
+}
+
+func Migrate(ctx context.Context, dry_run bool) (map[string]store.MigrationReport, error) {
+	return default_sack.Migrate(ctx, dry_run)
+}
+
+func Shutdown(ctx context.Context) error {
+	return default_sack.Shutdown(ctx)
+}
+
+func SubscribeNewBeans(ctx context.Context, options *SearchOptions, resume_token string) (<-chan BeanNotification, error) {
+	return default_sack.SubscribeNewBeans(ctx, options, resume_token)
+}
+
+func SubscribeNuggetTrends(ctx context.Context, options *SearchOptions, resume_token string) (<-chan NuggetNotification, error) {
+	return default_sack.SubscribeNuggetTrends(ctx, options, resume_token)
+}
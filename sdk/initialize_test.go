@@ -0,0 +1,72 @@
+package sdk
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/soumitsalman/beansack/nlp"
+	"github.com/soumitsalman/beansack/store"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// a backend without any of the optional interfaces. Its vector search can't search quantized vectors
+type plainBackend struct{}
+
+func (plainBackend) Add(ctx context.Context, docs []any) (store.InsertResult, error) {
+	return store.InsertResult{}, nil
+}
+
+func (plainBackend) Update(ctx context.Context, docs []any, filters []store.JSON) (store.UpdateResult, error) {
+	return store.UpdateResult{}, nil
+}
+
+func (plainBackend) Replace(ctx context.Context, docs []any, filters []store.JSON) (store.UpdateResult, error) {
+	return store.UpdateResult{}, nil
+}
+
+func (plainBackend) Get(ctx context.Context, filter, fields, sort_by store.JSON, top_n int) ([]bson.Raw, error) {
+	return nil, nil
+}
+
+func (plainBackend) Aggregate(ctx context.Context, pipeline any) ([]bson.Raw, error) {
+	return nil, nil
+}
+
+func (plainBackend) TextSearch(ctx context.Context, query_texts []string, params *store.SearchParams) ([]bson.Raw, error) {
+	return nil, nil
+}
+
+func (plainBackend) VectorSearch(ctx context.Context, query_embedding []float32, vec_path string, params *store.SearchParams) ([]bson.Raw, error) {
+	return nil, nil
+}
+
+func (plainBackend) Delete(ctx context.Context, filter store.JSON) (int, error) {
+	return 0, nil
+}
+
+func init() {
+	store.RegisterBackend("plain", func(connection_string, database, collection string) (store.Backend, error) {
+		return plainBackend{}, nil
+	})
+}
+
+func TestNewBeanSackQuantizationError(t *testing.T) {
+	opts := []BeanSackOption{
+		WithEmbedder(nlp.EmbedderConfig{Driver: _STUB}),
+		WithParrotboxOptions(nlp.WithLLM(stubLLM{})),
+	}
+	_, err := NewBeanSack("plain://", "", "", append(opts, WithEmbeddingQuantization(store.Int8Quantization))...)
+	if err == nil || !strings.Contains(err.Error(), "quantized") {
+		t.Fatalf("expected the quantization to be called out, got %v", err)
+	}
+	_, err = NewBeanSack("unknown://", "", "", append(opts, WithEmbeddingQuantization(store.Int8Quantization))...)
+	if err == nil || !strings.Contains(err.Error(), "db_conn_str") {
+		t.Fatalf("expected the connection string to be called out, got %v", err)
+	}
+	sack, err := NewBeanSack("plain://", "", "", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sack.Shutdown(context.Background())
+}
@@ -0,0 +1,39 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+
+	"github.com/soumitsalman/beansack/store"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// schema migrations of each collection in the order of their versions. New migrations go at the end with the next version.
+// Migrations that have been released should not be changed since the databases that ran them won't run them again
+var (
+	_BEANS_MIGRATIONS = []store.Migration{
+		{
+			Version:     1,
+			Description: "drop deprecated search_embeddings",
+			Filter:      store.JSON{"search_embeddings": store.JSON{"$exists": true}},
+			Migrate: func(doc bson.M) (bson.M, error) {
+				delete(doc, "search_embeddings")
+				return doc, nil
+			},
+		},
+	}
+	_NUGGETS_MIGRATIONS = []store.Migration{}
+	_NOISES_MIGRATIONS  = []store.Migration{}
+)
+
+// Brings the documents of the beansack collections up to the latest schema version.
+// This does not run on its own. A dry run reports what would change without writing anything.
+// An interrupted run continues from where it stopped when it runs again. Returns the reports by collection name
+func (sack *BeanSack) Migrate(ctx context.Context, dry_run bool) (map[string]store.MigrationReport, error) {
+	reports := make(map[string]store.MigrationReport, 3)
+	var beans_err, nuggets_err, noises_err error
+	reports[BEANS], beans_err = sack.beanstore.Migrate(ctx, sack.versionstore, _BEANS_MIGRATIONS, dry_run)
+	reports[NEWSNUGGETS], nuggets_err = sack.nuggetstore.Migrate(ctx, sack.versionstore, _NUGGETS_MIGRATIONS, dry_run)
+	reports[NOISES], noises_err = sack.noisestore.Migrate(ctx, sack.versionstore, _NOISES_MIGRATIONS, dry_run)
+	return reports, errors.Join(beans_err, nuggets_err, noises_err)
+}
@@ -12,27 +12,36 @@ const (
 )
 
 type SearchOptions struct {
-	ScalarFilter     store.JSON
+	// scalar filter on the beans. Build it with store.Eq, store.In, store.Range etc. or the With* functions below
+	Filter           store.Filter
 	TopN             int
 	SearchTexts      []string
 	SearchEmbeddings [][]float32
 	Context          string
+	// token of the page to return. Empty for the first page. The search functions return the token for the next page
+	PageToken string
+	// how the scores of a bean across the search texts or embeddings get combined. Default is the best of them
+	ScoreAggregation store.ScoreAggregation
+	// when set FuzzySearch runs both the text and the vector search and ranks the beans by the fusion of the two.
+	// It needs search texts or a context for the text search
+	Fusion *store.Fusion
 }
 
 func NewSearchOptions() *SearchOptions {
 	return &SearchOptions{
-		ScalarFilter: make(store.JSON),
-		TopN:         _DEFAULT_TOPN,
+		TopN: _DEFAULT_TOPN,
 	}
 }
 
+// replaces the conditions on updated that the filter already has
 func (settings *SearchOptions) WithTimeWindow(time_window int) *SearchOptions {
-	settings.ScalarFilter["updated"] = store.JSON{"$gte": timeValue(time_window)}
+	settings.Filter = settings.Filter.Without("updated").And(store.Range("updated", timeValue(time_window), nil))
 	return settings
 }
 
+// replaces the conditions on kind that the filter already has
 func (settings *SearchOptions) WithKind(kinds []string) *SearchOptions {
-	settings.ScalarFilter["kind"] = store.JSON{"$in": kinds}
+	settings.Filter = settings.Filter.Without("kind").And(store.In("kind", kinds...))
 	return settings
 }
 
@@ -47,13 +56,53 @@ func (settings *SearchOptions) WithTopN(topn int) *SearchOptions {
 	return settings
 }
 
+// replaces the conditions on url that the filter already has
 func (settings *SearchOptions) WithURLs(urls []string) *SearchOptions {
 	if len(urls) > 0 {
-		settings.ScalarFilter["url"] = store.JSON{"$in": urls}
+		settings.Filter = settings.Filter.Without("url").And(store.In("url", urls...))
 	}
 	return settings
 }
 
+func (settings *SearchOptions) WithPageToken(page_token string) *SearchOptions {
+	settings.PageToken = page_token
+	return settings
+}
+
+// with store.SumScore or store.MeanScore the beans that match more of the search texts rank higher
+func (settings *SearchOptions) WithScoreAggregation(aggregation store.ScoreAggregation) *SearchOptions {
+	settings.ScoreAggregation = aggregation
+	return settings
+}
+
+// hybrid search with reciprocal rank fusion. The weights are how much each ranking counts. A weight of 0 leaves that search out
+func (settings *SearchOptions) WithHybridSearch(text_weight, vector_weight float64) *SearchOptions {
+	return settings.WithFusion(store.Fusion{Method: store.ReciprocalRankFusion, TextWeight: text_weight, VectorWeight: vector_weight})
+}
+
+func (settings *SearchOptions) WithFusion(fusion store.Fusion) *SearchOptions {
+	settings.Fusion = &fusion
+	return settings
+}
+
+// adds the filter to the existing ones. Both have to match
+func (settings *SearchOptions) WithFilter(filter store.Filter) *SearchOptions {
+	settings.Filter = settings.Filter.And(filter)
+	return settings
+}
+
+func (settings *SearchOptions) beanFilter() (store.JSON, error) {
+	return compileFilter(settings.Filter, bean_schema)
+}
+
+// validates the filter against the schema so that a typo in a field name fails instead of returning nothing
+func compileFilter(filter store.Filter, schema store.Schema) (store.JSON, error) {
+	if err := filter.Validate(schema); err != nil {
+		return nil, err
+	}
+	return filter.ToJSON(), nil
+}
+
 func timeValue(time_window int) int64 {
 	return time.Now().AddDate(0, 0, -checkAndFixTimeWindow(time_window)).Unix()
 }
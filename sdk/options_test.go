@@ -0,0 +1,29 @@
+package sdk
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/soumitsalman/beansack/store"
+)
+
+func TestSearchOptionsReplaceConditions(t *testing.T) {
+	options := NewSearchOptions().
+		WithTimeWindow(1).WithKind([]string{POST}).WithURLs([]string{"a"}).
+		WithFilter(store.Eq("source", "reddit")).
+		WithTimeWindow(7).WithKind([]string{ARTICLE}).WithURLs([]string{"b"})
+	expected := store.JSON{
+		"updated": store.JSON{"$gte": timeValue(7)},
+		"kind":    store.JSON{"$in": []any{ARTICLE}},
+		"url":     store.JSON{"$in": []any{"b"}},
+		"source":  store.JSON{"$eq": "reddit"},
+	}
+	actual, err := options.beanFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the values of In can be any kind of slice
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, actual)
+	}
+}
@@ -0,0 +1,155 @@
+package sdk
+
+import (
+	"context"
+	"log"
+	"slices"
+
+	"github.com/soumitsalman/beansack/store"
+)
+
+// BeanNotification is a bean that a subscription picked up
+type BeanNotification struct {
+	Bean Bean
+	// pass it to the subscription to continue after this bean
+	ResumeToken string
+}
+
+// NuggetNotification is a news nugget whose trend score changed
+type NuggetNotification struct {
+	Nugget      NewsNugget
+	ResumeToken string
+}
+
+// Notifies about the beans that get added and match the options.
+// With SearchEmbeddings, SearchTexts or Context in the options a bean matches once its category embeddings are computed and
+// they are as close to the search embeddings as FuzzySearch requires. Otherwise every new bean that matches the filter gets delivered.
+// TopN and PageToken don't apply. Databases without change streams get polled so the options should have a time window.
+// Without the search options only the beans with a new update time get polled after the first poll.
+// resume_token is the token of the last notification that got handled or empty to start from now.
+// The channel gets closed when ctx is done, the sack shuts down or the subscription fails
+func (sack *BeanSack) SubscribeNewBeans(ctx context.Context, options *SearchOptions, resume_token string) (<-chan BeanNotification, error) {
+	if sack.isClosed() {
+		return nil, BeanSackError("BeanSack is closed.")
+	}
+	filter, err := options.beanFilter()
+	if err != nil {
+		return nil, err
+	}
+	mode, embs, _, min_score, _, err := sack.getFuzzySearchMode(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	matches := func(change store.Change[Bean]) bool {
+		switch {
+		case change.Kind == store.ChangeDelete:
+			return false
+		case mode == _GET:
+			return change.Kind == store.ChangeInsert
+		case change.Kind == store.ChangeUpdate && !slices.Contains(change.Fields, _CLASSIFICATION_EMB):
+			// the bean was checked when its embeddings came in
+			return false
+		}
+		for _, emb := range embs {
+			if store.CosineSimilarity(emb, change.Item.CategoryEmbeddings) >= min_score {
+				return true
+			}
+		}
+		return false
+	}
+
+	watch_options := []store.WatchOption{store.WithResumeToken(resume_token), store.WithWatermarkField("updated")}
+	if mode == _GET {
+		// new beans come with a new update time. The embeddings come in without one so the searches poll all the beans
+		watch_options = append(watch_options, store.WithIncrementalPolling())
+	}
+	ctx, cancel := sack.subscriptionContext(ctx)
+	sub, err := sack.beanstore.Watch(ctx, filter, watch_options...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	notifications := make(chan BeanNotification)
+	go func() {
+		defer cancel()
+		defer close(notifications)
+		notify(ctx, sub, notifications, func(change store.Change[Bean]) (BeanNotification, bool) {
+			if !matches(change) {
+				return BeanNotification{}, false
+			}
+			bean := change.Item
+			bean.SearchEmbeddings, bean.CategoryEmbeddings = nil, nil
+			return BeanNotification{Bean: bean, ResumeToken: change.ResumeToken}, true
+		})
+	}()
+	return notifications, nil
+}
+
+// Notifies when the trend score of a news nugget changes. Like TrendingNuggets only the updated range of the filter applies.
+// resume_token is the token of the last notification that got handled or empty to start from now.
+// The channel gets closed when ctx is done, the sack shuts down or the subscription fails
+func (sack *BeanSack) SubscribeNuggetTrends(ctx context.Context, options *SearchOptions, resume_token string) (<-chan NuggetNotification, error) {
+	if sack.isClosed() {
+		return nil, BeanSackError("BeanSack is closed.")
+	}
+	if err := options.Filter.Validate(bean_schema); err != nil {
+		return nil, err
+	}
+	filter, err := compileFilter(store.Range("match_count", 1, nil).And(options.Filter.Only("updated")), nugget_schema)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := sack.subscriptionContext(ctx)
+	sub, err := sack.nuggetstore.Watch(ctx, filter, store.WithResumeToken(resume_token), store.WithWatermarkField("updated"))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	notifications := make(chan NuggetNotification)
+	go func() {
+		defer cancel()
+		defer close(notifications)
+		notify(ctx, sub, notifications, func(change store.Change[NewsNugget]) (NuggetNotification, bool) {
+			// the filter only lets in the nuggets that have a trend score so a new one has a score that changed from nothing
+			scored := change.Kind == store.ChangeInsert || change.Kind == store.ChangeReplace ||
+				(change.Kind == store.ChangeUpdate && slices.Contains(change.Fields, "match_count"))
+			if !scored {
+				return NuggetNotification{}, false
+			}
+			nugget := change.Item
+			nugget.Embeddings = nil
+			return NuggetNotification{Nugget: nugget, ResumeToken: change.ResumeToken}, true
+		})
+	}()
+	return notifications, nil
+}
+
+// subscriptions stop when ctx is done or the sack shuts down
+func (sack *BeanSack) subscriptionContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(sack.background, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// forwards the changes that convert takes until the subscription stops or ctx is done
+func notify[T any, N any](ctx context.Context, sub *store.Subscription[T], notifications chan<- N, convert func(change store.Change[T]) (N, bool)) {
+	defer sub.Close()
+	for change := range sub.Changes() {
+		notification, ok := convert(change)
+		if !ok {
+			continue
+		}
+		select {
+		case notifications <- notification:
+		case <-ctx.Done():
+			return
+		}
+	}
+	if err := sub.Err(); err != nil {
+		log.Println("[beansack] Subscription stopped.", err)
+	}
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Backend is the storage engine behind a Store.
+// Backends work with raw BSON documents and mongo style filters/pipelines so that
+// Store can take care of serializing and de-serializing the data type.
+// Empty results are returned as nil slice with nil error. Errors are only for things that failed
+type Backend interface {
+	// inserts the docs as is without stopping at the first failure. Docs that violate a unique index are reported as duplicates.
+	// The error is for the docs that failed for any other reason
+	Add(ctx context.Context, docs []any) (InsertResult, error)
+	// does a `$set` of docs[i] on the item that matches filters[i]. The error is for the docs that failed
+	Update(ctx context.Context, docs []any, filters []JSON) (UpdateResult, error)
+	// replaces the item that matches filters[i] with docs[i]. The item keeps its _id. The error is for the docs that failed
+	Replace(ctx context.Context, docs []any, filters []JSON) (UpdateResult, error)
+	Get(ctx context.Context, filter JSON, fields JSON, sort_by JSON, top_n int) ([]bson.Raw, error)
+	Aggregate(ctx context.Context, pipeline any) ([]bson.Raw, error)
+	TextSearch(ctx context.Context, query_texts []string, params *SearchParams) ([]bson.Raw, error)
+	VectorSearch(ctx context.Context, query_embedding []float32, vec_path string, params *SearchParams) ([]bson.Raw, error)
+	// Returns the number of deleted docs
+	Delete(ctx context.Context, filter JSON) (int, error)
+}
+
+// what happened to each doc passed to Backend.Add. The values are positions in the docs
+type InsertResult struct {
+	Inserted   []int
+	Duplicates []int // an item with the same values for the unique index already exists
+	Failed     []int
+}
+
+// what happened to the docs passed to Backend.Update or Backend.Replace.
+// Mongo only reports how many items matched and changed for a bulk write so those are totals.
+// Failures are per doc so that the caller can retry exactly those
+type UpdateResult struct {
+	Matched  int           // number of items that matched the filters
+	Modified int           // number of matched items that changed. Setting the values an item already has doesn't change it
+	Failed   map[int]error // why docs[i] didn't get written
+}
+
+// positions of the failed docs in ascending order
+func (res UpdateResult) FailedDocs() []int {
+	failed := make([]int, 0, len(res.Failed))
+	for i := range res.Failed {
+		failed = append(failed, i)
+	}
+	sort.Ints(failed)
+	return failed
+}
+
+// the errors of the failed docs joined in the order of the docs. nil if nothing failed
+func (res UpdateResult) Err() error {
+	errs := make([]error, 0, len(res.Failed))
+	for _, i := range res.FailedDocs() {
+		errs = append(errs, fmt.Errorf("docs[%d]: %w", i, res.Failed[i]))
+	}
+	return errors.Join(errs...)
+}
+
+func (res *UpdateResult) fail(i int, err error) {
+	if res.Failed == nil {
+		res.Failed = make(map[int]error)
+	}
+	res.Failed[i] = err
+}
+
+// BackendFactory creates a Backend for a collection in the database that the connection string points to
+type BackendFactory func(connection_string, database, collection string) (Backend, error)
+
+type StoreError string
+
+func (err StoreError) Error() string {
+	return string(err)
+}
+
+// backends are picked based on the scheme of the connection string such as mongodb://
+var backend_factories = map[string]BackendFactory{}
+
+// Registers a backend factory for a connection string scheme such as "mongodb" or "mongodb+srv".
+// Registering the same scheme again replaces the existing factory
+func RegisterBackend(scheme string, factory BackendFactory) {
+	backend_factories[strings.ToLower(scheme)] = factory
+}
+
+func openBackend(connection_string, database, collection string) (Backend, error) {
+	scheme, _, found := strings.Cut(connection_string, "://")
+	if !found {
+		return nil, StoreError("connection string does not have a scheme")
+	}
+	factory, ok := backend_factories[strings.ToLower(scheme)]
+	if !ok {
+		return nil, StoreError(fmt.Sprintf("no backend registered for scheme %s", scheme))
+	}
+	return factory(connection_string, database, collection)
+}
+
+// Backends that evaluate text search in process need to know which fields make up the text index.
+// The mongo backend doesn't need this since the text index is defined in the database
+type TextIndexer interface {
+	SetTextFields(fields []string)
+}
+
+// Backends that run vector search on a vector index in the database.
+// The dialect defines the search stages and some dialects need the name of the vector index
+type VectorIndexer interface {
+	SetVectorSearchDialect(dialect VectorSearchDialect)
+	SetVectorIndex(vec_path, index_name string)
+}
+
+// Backends that can search vectors stored by WithQuantizedVectors. Stores with quantized vectors need one that can
+type QuantizedVectorSearcher interface {
+	SearchesQuantizedVectors() bool
+}
+
+// Backends that hold on to connections or other resources release them in Close.
+// Store.Close calls it if the backend implements it
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+// 0, 1, ..., n-1
+func positions(n int) []int {
+	res := make([]int, n)
+	for i := range res {
+		res[i] = i
+	}
+	return res
+}
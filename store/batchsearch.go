@@ -0,0 +1,54 @@
+package store
+
+import (
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Backends that can run the vector searches of several query embeddings in one round trip.
+// results[i] are the results of query_embeddings[i]
+type BatchVectorSearcher interface {
+	BatchVectorSearch(ctx context.Context, query_embeddings [][]float32, vec_path string, params *SearchParams) ([][]bson.Raw, error)
+}
+
+// Searches with each of the query embeddings in as few round trips as the backend allows.
+// results[i] are the results of query_embeddings[i] in the order of their search score and the options apply to each of them.
+// Backends that can't batch the searches run them one after the other
+func (store *Store[T]) BatchVectorSearch(ctx context.Context, query_embeddings [][]float32, vec_path string, options ...SearchOption) ([][]T, error) {
+	results, err := store.batchVectorSearch(ctx, query_embeddings, vec_path, NewSearchParams(options...))
+	if err != nil {
+		log.Printf("[%s]: Search failed. %v\n", store.name, err)
+		return nil, err
+	}
+	items := make([][]T, len(results))
+	for i, raws := range results {
+		if items[i], err = store.decode(raws, nil); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+func (store *Store[T]) batchVectorSearch(ctx context.Context, query_embeddings [][]float32, vec_path string, params *SearchParams) ([][]bson.Raw, error) {
+	if quantization := store.quantized[vec_path]; quantization != NoQuantization {
+		return store.rescoredVectorSearch(ctx, query_embeddings, vec_path, params, quantization)
+	}
+	return store.batchSearch(ctx, query_embeddings, vec_path, params)
+}
+
+func (store *Store[T]) batchSearch(ctx context.Context, query_embeddings [][]float32, vec_path string, params *SearchParams) ([][]bson.Raw, error) {
+	if searcher, ok := store.backend.(BatchVectorSearcher); ok && len(query_embeddings) > 1 {
+		return searcher.BatchVectorSearch(ctx, query_embeddings, vec_path, params)
+	}
+	results := make([][]bson.Raw, len(query_embeddings))
+	for i, vec := range query_embeddings {
+		raws, err := store.backend.VectorSearch(ctx, vec, vec_path, params)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = raws
+	}
+	return results, nil
+}
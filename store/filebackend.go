@@ -0,0 +1,190 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// file://<directory> keeps each collection in a bbolt database file at <directory>/<database>/<collection>.db
+// and a copy of its documents in memory for the queries. Search works the same way as the memory backend i.e. in-process vector indexes and text search.
+// Each write is one bbolt transaction that only touches the documents it changes. It is on disk before it shows up in memory
+// so a crash never loses an acknowledged write. The vector indexes get saved next to the collection as <collection>.<vector field>.ann
+// when the last store on the collection is closed and get rebuilt if they are out of date.
+// This is meant for single node deployments. Only one process can open the file at a time
+func init() {
+	RegisterBackend("file", newFileBackend)
+}
+
+const (
+	_FILE_EXTENSION       = ".db"
+	_INDEX_FILE_EXTENSION = ".ann"
+	// how long opening the file waits for another process to let go of it
+	_FILE_LOCK_TIMEOUT = time.Second
+)
+
+var (
+	// documents by their insertion sequence so that they load in the order they were added
+	_DOCS_BUCKET = []byte("docs")
+	// insertion sequence by _id
+	_IDS_BUCKET = []byte("ids")
+)
+
+type fileCollection struct {
+	backend *memoryBackend
+	db      *bolt.DB
+	// number of stores that opened the collection and haven't closed it yet
+	refs int
+}
+
+var file_collections = struct {
+	sync.Mutex
+	items map[string]*fileCollection
+}{items: make(map[string]*fileCollection)}
+
+func newFileBackend(connection_string, database, collection string) (Backend, error) {
+	root, _, _ := strings.Cut(strings.TrimPrefix(connection_string, "file://"), "?")
+	dir := filepath.Join(root, database)
+	file_path, err := filepath.Abs(filepath.Join(dir, collection+_FILE_EXTENSION))
+	if err != nil {
+		return nil, err
+	}
+
+	file_collections.Lock()
+	defer file_collections.Unlock()
+	// stores in the same process share the same backend so that they see each other's writes
+	if existing, ok := file_collections.items[file_path]; ok {
+		existing.refs++
+		return existing.backend, nil
+	}
+
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(file_path, 0o644, &bolt.Options{Timeout: _FILE_LOCK_TIMEOUT})
+	if err != nil {
+		return nil, StoreError(fmt.Sprintf("couldn't open %s. %v", file_path, err))
+	}
+	docs, err := loadDocuments(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	file := &fileCollection{db: db, refs: 1}
+	file.backend = &memoryBackend{
+		name:     fmt.Sprintf("%s/%s", database, collection),
+		docs:     docs,
+		persist:  file.persist,
+		on_close: func() error { return closeFileCollection(file_path) },
+		index_path: func(vec_path string) string {
+			return strings.TrimSuffix(file_path, _FILE_EXTENSION) + "." + vec_path + _INDEX_FILE_EXTENSION
+		},
+		vector_index_kind: vectorIndexKind(connection_string),
+	}
+	file_collections.items[file_path] = file
+	return file.backend, nil
+}
+
+// creates the buckets of a new file and reads the documents in the order they were added
+func loadDocuments(db *bolt.DB) ([]bson.M, error) {
+	docs := make([]bson.M, 0)
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(_IDS_BUCKET); err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucketIfNotExists(_DOCS_BUCKET)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(_, data []byte) error {
+			var doc bson.M
+			if err := bson.Unmarshal(data, &doc); err != nil {
+				return err
+			}
+			docs = append(docs, doc)
+			return nil
+		})
+	})
+	return docs, err
+}
+
+// writes the changed documents in one transaction. Nothing gets written if any of them fails
+func (file *fileCollection) persist(changes []docChange) error {
+	return file.db.Update(func(tx *bolt.Tx) error {
+		docs, ids := tx.Bucket(_DOCS_BUCKET), tx.Bucket(_IDS_BUCKET)
+		for _, change := range changes {
+			var id []byte
+			if change.after != nil {
+				id = []byte(uniqueKey(change.after, []string{"_id"}))
+			}
+			if change.before != nil {
+				// deletes and the rare update of _id drop the old key
+				if before_id := []byte(uniqueKey(change.before, []string{"_id"})); string(before_id) != string(id) {
+					if err := deleteDocument(docs, ids, before_id); err != nil {
+						return err
+					}
+				}
+			}
+			if change.after == nil {
+				continue
+			}
+			data, err := bson.Marshal(change.after)
+			if err != nil {
+				return err
+			}
+			// the value of Get is only valid in the transaction and Put needs a key that stays put
+			seq := append([]byte(nil), ids.Get(id)...)
+			if len(seq) == 0 {
+				next, err := docs.NextSequence()
+				if err != nil {
+					return err
+				}
+				seq = binary.BigEndian.AppendUint64(nil, next)
+				if err = ids.Put(id, seq); err != nil {
+					return err
+				}
+			}
+			if err = docs.Put(seq, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func deleteDocument(docs, ids *bolt.Bucket, id []byte) error {
+	seq := append([]byte(nil), ids.Get(id)...)
+	if len(seq) == 0 {
+		return nil
+	}
+	if err := docs.Delete(seq); err != nil {
+		return err
+	}
+	return ids.Delete(id)
+}
+
+// the last store to close the collection saves the vector indexes and closes the file
+func closeFileCollection(file_path string) error {
+	file_collections.Lock()
+	defer file_collections.Unlock()
+	file, ok := file_collections.items[file_path]
+	if !ok {
+		return nil
+	}
+	if file.refs--; file.refs > 0 {
+		return nil
+	}
+	delete(file_collections.items, file_path)
+
+	file.backend.lock.Lock()
+	defer file.backend.lock.Unlock()
+	return errors.Join(file.backend.saveVectorIndexes(), file.db.Close())
+}
@@ -0,0 +1,61 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openFileStore(t *testing.T, dir string) *Store[testItem] {
+	t.Helper()
+	store := New("file://"+dir, "test", "items",
+		WithDataIDAndEqualsFunction(
+			func(item *testItem) JSON { return JSON{"_id": item.ID} },
+			func(a, b *testItem) bool { return a.ID == b.ID }),
+		WithWritePolicy[testItem](ReplaceExisting))
+	if store == nil {
+		t.Fatal("couldn't open the file store")
+	}
+	return store
+}
+
+func TestFileBackendPersists(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store := openFileStore(t, dir)
+	addItems(t, store,
+		testItem{ID: "c", Rank: 1, Vector: []float32{1, 0}},
+		testItem{ID: "a", Rank: 1, Vector: []float32{0, 1}},
+		testItem{ID: "b", Rank: 1, Vector: []float32{1, 1}})
+	if _, err := store.Update(ctx, []any{JSON{"rank": 2}}, []JSON{{"_id": "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Delete(ctx, JSON{"_id": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	// a second store on the same collection shares the writes and keeps the file open
+	other := openFileStore(t, dir)
+	if items, _ := other.Get(ctx, JSON{}, nil, nil, -1); len(items) != 2 {
+		t.Fatalf("expected the second store to see the writes, got %s", ids(items))
+	}
+	if found, err := store.VectorSearch(ctx, [][]float32{{1, 0}}, "vector", WithVectorTopN(1)); err != nil || ids(found) != "[c]" {
+		t.Fatalf("expected c, got %s %v", ids(found), err)
+	}
+	store.Close(ctx)
+	other.Close(ctx)
+	if _, err := os.Stat(filepath.Join(dir, "test", "items"+_FILE_EXTENSION)); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openFileStore(t, dir)
+	defer reopened.Close(ctx)
+	// the documents load in the order they were added
+	items, err := reopened.Get(ctx, JSON{}, nil, nil, -1)
+	if err != nil || ids(items) != "[c a]" || items[1].Rank != 2 {
+		t.Fatalf("expected the writes after reopening, got %+v %v", items, err)
+	}
+	if found, err := reopened.VectorSearch(ctx, [][]float32{{0, 1}}, "vector", WithVectorTopN(1)); err != nil || ids(found) != "[a]" {
+		t.Fatalf("expected a after reopening, got %s %v", ids(found), err)
+	}
+}
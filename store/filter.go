@@ -0,0 +1,339 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Filter is a composable scalar filter. It compiles to a mongo style query through ToJSON which is what every backend takes.
+// The zero value is an empty filter that matches everything
+type Filter struct {
+	op       string // one of the _FILTER_* values. empty string for the empty filter
+	field    string
+	cond     JSON // operator document for the field such as {"$in": [...]}
+	children []Filter
+}
+
+const (
+	_FILTER_FIELD = "field"
+	_FILTER_AND   = "$and"
+	_FILTER_OR    = "$or"
+	_FILTER_NOT   = "$nor"
+)
+
+func Eq(field string, value any) Filter {
+	return fieldFilter(field, JSON{"$eq": value})
+}
+
+func Ne(field string, value any) Filter {
+	return fieldFilter(field, JSON{"$ne": value})
+}
+
+// matches if the field is equal to any of the values. For array fields it matches if any of the items is one of the values
+func In[V any](field string, values ...V) Filter {
+	return fieldFilter(field, JSON{"$in": values})
+}
+
+// inclusive range. A nil bound leaves that side open
+func Range(field string, min, max any) Filter {
+	cond := JSON{}
+	if min != nil {
+		cond["$gte"] = min
+	}
+	if max != nil {
+		cond["$lte"] = max
+	}
+	return fieldFilter(field, cond)
+}
+
+func Exists(field string, exists bool) Filter {
+	return fieldFilter(field, JSON{"$exists": exists})
+}
+
+func Not(filter Filter) Filter {
+	if filter.IsEmpty() {
+		return filter
+	}
+	return Filter{op: _FILTER_NOT, children: []Filter{filter}}
+}
+
+func And(filters ...Filter) Filter {
+	return Filter{op: _FILTER_AND, children: filters}
+}
+
+// Or without any filter is the same as an empty filter and matches everything
+func Or(filters ...Filter) Filter {
+	return Filter{op: _FILTER_OR, children: filters}
+}
+
+func fieldFilter(field string, cond JSON) Filter {
+	return Filter{op: _FILTER_FIELD, field: field, cond: cond}
+}
+
+// same as And(filter, others...)
+func (filter Filter) And(others ...Filter) Filter {
+	return And(append([]Filter{filter}, others...)...)
+}
+
+func (filter Filter) IsEmpty() bool {
+	switch filter.op {
+	case _FILTER_FIELD:
+		return len(filter.cond) == 0
+	case _FILTER_AND, _FILTER_OR, _FILTER_NOT:
+		for _, child := range filter.children {
+			if !child.IsEmpty() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// names of the fields that the filter refers to, sorted and without duplicates
+func (filter Filter) Fields() []string {
+	unique := make(map[string]bool)
+	filter.collectFields(unique)
+	fields := make([]string, 0, len(unique))
+	for field := range unique {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func (filter Filter) collectFields(fields map[string]bool) {
+	if filter.op == _FILTER_FIELD {
+		if len(filter.cond) > 0 {
+			fields[filter.field] = true
+		}
+		return
+	}
+	for _, child := range filter.children {
+		child.collectFields(fields)
+	}
+}
+
+// Keeps the top level conditions that only refer to the given fields and drops the rest.
+// Dropping conditions from an And only widens the match so the result matches everything the original filter matches
+func (filter Filter) Only(fields ...string) Filter {
+	if filter.op == _FILTER_AND {
+		kept := make([]Filter, 0, len(filter.children))
+		for _, child := range filter.children {
+			if child = child.Only(fields...); !child.IsEmpty() {
+				kept = append(kept, child)
+			}
+		}
+		return And(kept...)
+	}
+	for _, field := range filter.Fields() {
+		if !contains(fields, field) {
+			return Filter{}
+		}
+	}
+	return filter
+}
+
+// Drops the top level conditions that refer to any of the given fields and keeps the rest. The opposite of Only
+func (filter Filter) Without(fields ...string) Filter {
+	if filter.op == _FILTER_AND {
+		kept := make([]Filter, 0, len(filter.children))
+		for _, child := range filter.children {
+			if child = child.Without(fields...); !child.IsEmpty() {
+				kept = append(kept, child)
+			}
+		}
+		return And(kept...)
+	}
+	for _, field := range filter.Fields() {
+		if contains(fields, field) {
+			return Filter{}
+		}
+	}
+	return filter
+}
+
+// returns an error listing the fields that are not in the schema
+func (filter Filter) Validate(schema Schema) error {
+	unknown := make([]string, 0)
+	for _, field := range filter.Fields() {
+		if !schema.Has(field) {
+			unknown = append(unknown, field)
+		}
+	}
+	if len(unknown) > 0 {
+		return StoreError("unknown field(s) in filter for " + schema.name + ": " + strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// compiles the filter into a mongo style query.
+// Conditions in an And are merged into one document when they don't clash so that the query stays flat
+func (filter Filter) ToJSON() JSON {
+	if filter.IsEmpty() {
+		return JSON{}
+	}
+	switch filter.op {
+	case _FILTER_FIELD:
+		return JSON{filter.field: copyJSON(filter.cond)}
+	case _FILTER_AND:
+		return compileAnd(filter.children)
+	default:
+		children := make([]JSON, 0, len(filter.children))
+		for _, child := range filter.children {
+			if !child.IsEmpty() {
+				children = append(children, child.ToJSON())
+			}
+		}
+		return JSON{filter.op: children}
+	}
+}
+
+func compileAnd(filters []Filter) JSON {
+	merged := JSON{}
+	rest := make([]JSON, 0)
+	for _, filter := range filters {
+		if filter.IsEmpty() {
+			continue
+		}
+		// nested Ands get flattened into this one
+		if filter.op == _FILTER_AND {
+			nested := compileAnd(filter.children)
+			if conjuncts, ok := nested[_FILTER_AND].([]JSON); ok && len(nested) == 1 {
+				rest = append(rest, conjuncts...)
+			} else {
+				for key, val := range nested {
+					rest = mergeCondition(merged, rest, key, val)
+				}
+			}
+			continue
+		}
+		for key, val := range filter.ToJSON() {
+			rest = mergeCondition(merged, rest, key, val)
+		}
+	}
+	if len(rest) == 0 {
+		return merged
+	}
+	if len(merged) > 0 {
+		rest = append([]JSON{merged}, rest...)
+	}
+	return JSON{_FILTER_AND: rest}
+}
+
+// adds key: val to merged if it doesn't clash with what is already there. Otherwise it goes to the rest
+func mergeCondition(merged JSON, rest []JSON, key string, val any) []JSON {
+	existing, found := merged[key]
+	if !found {
+		merged[key] = val
+		return rest
+	}
+	existing_cond, ok1 := existing.(JSON)
+	new_cond, ok2 := val.(JSON)
+	if ok1 && ok2 && !strings.HasPrefix(key, "$") {
+		clash := false
+		for op := range new_cond {
+			if _, ok := existing_cond[op]; ok {
+				clash = true
+				break
+			}
+		}
+		if !clash {
+			for op, op_val := range new_cond {
+				existing_cond[op] = op_val
+			}
+			return rest
+		}
+	}
+	return append(rest, JSON{key: val})
+}
+
+func copyJSON(doc JSON) JSON {
+	res := make(JSON, len(doc))
+	for key, val := range doc {
+		res[key] = val
+	}
+	return res
+}
+
+func contains(items []string, item string) bool {
+	for _, val := range items {
+		if val == item {
+			return true
+		}
+	}
+	return false
+}
+
+// Schema is the set of field paths of a stored data type, as they are named in bson
+type Schema struct {
+	name   string
+	fields map[string]bool // true if the field can have arbitrary sub fields such as maps
+}
+
+// creates the schema of T from its bson tags. Nested structs add dotted paths such as "a.b"
+func SchemaOf[T any]() Schema {
+	data_type := reflect.TypeOf((*T)(nil)).Elem()
+	schema := Schema{
+		name:   data_type.Name(),
+		fields: map[string]bool{"_id": false},
+	}
+	schema.addFields(data_type, "", make(map[reflect.Type]bool))
+	return schema
+}
+
+func (schema Schema) Has(path string) bool {
+	if _, ok := schema.fields[path]; ok {
+		return true
+	}
+	// sub fields of open fields such as maps
+	for prefix, open := range schema.fields {
+		if open && strings.HasPrefix(path, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (schema Schema) addFields(data_type reflect.Type, prefix string, visited map[reflect.Type]bool) {
+	data_type = elemType(data_type)
+	if data_type.Kind() != reflect.Struct || visited[data_type] {
+		return
+	}
+	visited[data_type] = true
+	defer delete(visited, data_type)
+
+	for i := 0; i < data_type.NumField(); i++ {
+		field := data_type.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, flags, _ := strings.Cut(field.Tag.Get("bson"), ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(flags, "inline") {
+			schema.addFields(field.Type, prefix, visited)
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		path := prefix + name
+		field_type := elemType(field.Type)
+		schema.fields[path] = field_type.Kind() == reflect.Map || field_type.Kind() == reflect.Interface
+		schema.addFields(field_type, path+".", visited)
+	}
+}
+
+// pointer, slice and array element type
+func elemType(data_type reflect.Type) reflect.Type {
+	for {
+		switch data_type.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Array:
+			data_type = data_type.Elem()
+		default:
+			return data_type
+		}
+	}
+}
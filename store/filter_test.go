@@ -0,0 +1,104 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterToJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   Filter
+		expected JSON
+	}{
+		{"empty", Filter{}, JSON{}},
+		{"eq", Eq("kind", "news"), JSON{"kind": JSON{"$eq": "news"}}},
+		{"in", In("url", "a", "b"), JSON{"url": JSON{"$in": []string{"a", "b"}}}},
+		{"range", Range("updated", 1, 2), JSON{"updated": JSON{"$gte": 1, "$lte": 2}}},
+		{"open range", Range("updated", 1, nil), JSON{"updated": JSON{"$gte": 1}}},
+		{"empty range", Range("updated", nil, nil), JSON{}},
+		{
+			"and merges the fields",
+			And(Eq("kind", "news"), Range("updated", 1, nil)),
+			JSON{"kind": JSON{"$eq": "news"}, "updated": JSON{"$gte": 1}},
+		},
+		{
+			"and merges the operators of a field",
+			And(Range("updated", 1, nil), Range("updated", nil, 2)),
+			JSON{"updated": JSON{"$gte": 1, "$lte": 2}},
+		},
+		{
+			"and keeps the clashing operators apart",
+			And(Eq("kind", "news"), Eq("kind", "post")),
+			JSON{"$and": []JSON{{"kind": JSON{"$eq": "news"}}, {"kind": JSON{"$eq": "post"}}}},
+		},
+		{
+			"nested ands get flattened",
+			Eq("kind", "news").And(And(Eq("url", "a")), Filter{}),
+			JSON{"kind": JSON{"$eq": "news"}, "url": JSON{"$eq": "a"}},
+		},
+		{
+			"or",
+			Or(Eq("kind", "news"), Exists("url", true)),
+			JSON{"$or": []JSON{{"kind": JSON{"$eq": "news"}}, {"url": JSON{"$exists": true}}}},
+		},
+		{"not", Not(Eq("kind", "news")), JSON{"$nor": []JSON{{"kind": JSON{"$eq": "news"}}}}},
+		{"not of empty", Not(Filter{}), JSON{}},
+		{"or of nothing", Or(), JSON{}},
+	}
+	for _, test := range tests {
+		if actual := test.filter.ToJSON(); !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestFilterToJSONDoesNotShareState(t *testing.T) {
+	base := Range("updated", 1, nil)
+	And(base, Range("updated", nil, 2)).ToJSON()
+	if actual := base.ToJSON(); !reflect.DeepEqual(actual, JSON{"updated": JSON{"$gte": 1}}) {
+		t.Fatalf("compiling an And changed its child: %v", actual)
+	}
+}
+
+func TestFilterFieldsAndOnly(t *testing.T) {
+	filter := And(Eq("kind", "news"), Or(Eq("url", "a"), Eq("kind", "post")), Range("updated", 1, nil))
+	if fields := filter.Fields(); !reflect.DeepEqual(fields, []string{"kind", "updated", "url"}) {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+	only := filter.Only("kind", "updated")
+	expected := JSON{"kind": JSON{"$eq": "news"}, "updated": JSON{"$gte": 1}}
+	if actual := only.ToJSON(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %v, got %v", expected, actual)
+	}
+	if !Or(Eq("url", "a")).Only("kind").IsEmpty() {
+		t.Fatal("expected an empty filter when a condition refers to other fields")
+	}
+}
+
+func TestFilterWithout(t *testing.T) {
+	filter := And(Eq("kind", "news"), Or(Eq("url", "a"), Eq("kind", "post")), Range("updated", 1, nil))
+	expected := JSON{"updated": JSON{"$gte": 1}}
+	if actual := filter.Without("kind").ToJSON(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %v, got %v", expected, actual)
+	}
+	if !Eq("kind", "news").Without("kind").IsEmpty() {
+		t.Fatal("expected an empty filter")
+	}
+	if actual := Eq("kind", "news").Without("url").ToJSON(); !reflect.DeepEqual(actual, JSON{"kind": JSON{"$eq": "news"}}) {
+		t.Fatalf("expected the filter as it is, got %v", actual)
+	}
+}
+
+func TestFilterValidate(t *testing.T) {
+	type item struct {
+		Kind string `bson:"kind"`
+	}
+	schema := SchemaOf[item]()
+	if err := Eq("kind", "news").Validate(schema); err != nil {
+		t.Fatal(err)
+	}
+	if err := Eq("unknown", 1).Validate(schema); err == nil {
+		t.Fatal("expected an error for an unknown field")
+	}
+}
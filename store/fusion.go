@@ -0,0 +1,118 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	_DEFAULT_RANK_CONSTANT = 60 // k of reciprocal rank fusion as in the original paper
+)
+
+type FusionMethod int
+
+const (
+	// each result list adds weight / (k + rank) to the score of an item. Only the ranks matter so the scales of the scores don't
+	ReciprocalRankFusion FusionMethod = iota
+	// the scores of each result list are scaled to [0, 1] and each list adds weight * scaled score
+	WeightedScoreFusion
+)
+
+// Fusion is how HybridSearchPage combines the rankings of the text and the vector search
+type Fusion struct {
+	Method       FusionMethod
+	TextWeight   float64 // 0 leaves the text search out. Negative weights are an error
+	VectorWeight float64 // 0 leaves the vector search out. Negative weights are an error
+	RankConstant int     // k of reciprocal rank fusion. 0 or less counts as 60
+}
+
+// Runs both the text and the vector search and ranks the items by the fusion of the two rankings.
+// The search score of the results is the fused score. The min search score of the options only applies to the vector search
+// since text scores are on a different scale. Everything else applies to both.
+// An item's fused score can change as later pages look deeper in the two rankings so the pages are approximate.
+// At least one of the weights has to be positive
+func (store *Store[T]) HybridSearchPage(ctx context.Context, query_texts []string, query_embeddings [][]float32, vec_path string, page_token string, fusion Fusion, options ...SearchOption) ([]T, string, error) {
+	if fusion.TextWeight < 0 || fusion.VectorWeight < 0 || fusion.TextWeight+fusion.VectorWeight == 0 {
+		return nil, "", StoreError(fmt.Sprintf("invalid fusion weights %v and %v for %s. They can't be negative and one has to be positive", fusion.TextWeight, fusion.VectorWeight, store.name))
+	}
+	// the fused scores only exist after both searches so the cursor can't go in either of them
+	return store.searchPage(page_token, options, false, func(params *SearchParams, _ JSON) ([]bson.M, error) {
+		var text_docs, vector_docs []bson.M
+		if fusion.TextWeight > 0 {
+			text_params := *params
+			text_params.MinScore = nil
+			text_raws, err := store.backend.TextSearch(ctx, query_texts, &text_params)
+			if err != nil {
+				return nil, err
+			}
+			if text_docs, err = mergeByBestScore([][]bson.Raw{text_raws}, store.unique_field); err != nil {
+				return nil, err
+			}
+		}
+		if fusion.VectorWeight > 0 {
+			var err error
+			if vector_docs, err = store.vectorSearchMerged(ctx, query_embeddings, vec_path, params); err != nil {
+				return nil, err
+			}
+		}
+		return fuseResults([][]bson.M{text_docs, vector_docs}, []float64{fusion.TextWeight, fusion.VectorWeight}, fusion, store.unique_field), nil
+	})
+}
+
+// one document per unique field value with the fused score as its search score. Each list has one document per item.
+// The lists with a weight of 0 or less are left out
+func fuseResults(lists [][]bson.M, weights []float64, fusion Fusion, unique_field string) []bson.M {
+	k := fusion.RankConstant
+	if k <= 0 {
+		k = _DEFAULT_RANK_CONSTANT
+	}
+	fused := make([]bson.M, 0)
+	scores := make([]float64, 0)
+	index := make(map[string]int)
+	for i, docs := range lists {
+		weight := weights[i]
+		if weight <= 0 {
+			continue
+		}
+		docs = sortDocuments(docs, bson.D{{Key: _SEARCH_SCORE, Value: -1}})
+		low, high := scoreRange(docs)
+		for rank, doc := range docs {
+			var score float64
+			switch fusion.Method {
+			case WeightedScoreFusion:
+				score = 1
+				if high > low {
+					val, _ := asNumber(doc[_SEARCH_SCORE])
+					score = (val - low) / (high - low)
+				}
+			default:
+				score = 1 / float64(k+rank+1)
+			}
+			key := uniqueKey(doc, []string{unique_field})
+			pos, found := index[key]
+			if !found {
+				pos = len(fused)
+				index[key] = pos
+				fused = append(fused, doc)
+				scores = append(scores, 0)
+			}
+			scores[pos] += weight * score
+		}
+	}
+	for i, doc := range fused {
+		doc[_SEARCH_SCORE] = scores[i]
+	}
+	return fused
+}
+
+func scoreRange(docs []bson.M) (float64, float64) {
+	if len(docs) == 0 {
+		return 0, 0
+	}
+	// the docs are sorted by score from the highest
+	high, _ := asNumber(docs[0][_SEARCH_SCORE])
+	low, _ := asNumber(docs[len(docs)-1][_SEARCH_SCORE])
+	return low, high
+}
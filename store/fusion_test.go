@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func rawResults(t *testing.T, docs ...bson.M) []bson.Raw {
+	t.Helper()
+	raws := make([]bson.Raw, len(docs))
+	for i, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raws[i] = data
+	}
+	return raws
+}
+
+// search scores by _id
+func scoresOf(docs []bson.M) map[string]float64 {
+	scores := make(map[string]float64, len(docs))
+	for _, doc := range docs {
+		scores[doc["_id"].(string)], _ = asNumber(doc[_SEARCH_SCORE])
+	}
+	return scores
+}
+
+func assertScores(t *testing.T, actual, expected map[string]float64) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, actual)
+	}
+	for id, score := range expected {
+		if math.Abs(actual[id]-score) > 1e-9 {
+			t.Fatalf("expected %v, got %v", expected, actual)
+		}
+	}
+}
+
+func TestMergeScores(t *testing.T) {
+	results := [][]bson.Raw{
+		rawResults(t, bson.M{"_id": "a", _SEARCH_SCORE: 0.9}, bson.M{"_id": "b", _SEARCH_SCORE: 0.4}),
+		rawResults(t, bson.M{"_id": "b", _SEARCH_SCORE: 0.8}, bson.M{"_id": "c", _SEARCH_SCORE: 0.2}),
+	}
+	tests := []struct {
+		aggregation ScoreAggregation
+		expected    map[string]float64
+	}{
+		{MaxScore, map[string]float64{"a": 0.9, "b": 0.8, "c": 0.2}},
+		{SumScore, map[string]float64{"a": 0.9, "b": 1.2, "c": 0.2}},
+		// missing from a list counts as 0
+		{MeanScore, map[string]float64{"a": 0.45, "b": 0.6, "c": 0.1}},
+	}
+	for _, test := range tests {
+		merged, err := mergeScores(results, "_id", test.aggregation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertScores(t, scoresOf(merged), test.expected)
+	}
+}
+
+func TestFuseResults(t *testing.T) {
+	text := []bson.M{{"_id": "a", _SEARCH_SCORE: 3.0}, {"_id": "b", _SEARCH_SCORE: 1.0}}
+	vector := []bson.M{{"_id": "b", _SEARCH_SCORE: 0.9}, {"_id": "c", _SEARCH_SCORE: 0.5}}
+	copies := func() [][]bson.M {
+		return [][]bson.M{
+			{copyDocument(text[0]), copyDocument(text[1])},
+			{copyDocument(vector[0]), copyDocument(vector[1])},
+		}
+	}
+
+	rrf := fuseResults(copies(), []float64{1, 1}, Fusion{RankConstant: 1}, "_id")
+	assertScores(t, scoresOf(rrf), map[string]float64{"a": 1.0 / 2, "b": 1.0/3 + 1.0/2, "c": 1.0 / 3})
+
+	weighted := fuseResults(copies(), []float64{1, 2}, Fusion{Method: WeightedScoreFusion}, "_id")
+	assertScores(t, scoresOf(weighted), map[string]float64{"a": 1, "b": 0 + 2*1, "c": 0})
+
+	// a weight of 0 leaves the list out
+	text_only := fuseResults(copies(), []float64{1, 0}, Fusion{}, "_id")
+	assertScores(t, scoresOf(text_only), map[string]float64{"a": 1.0 / 61, "b": 1.0 / 62})
+}
+
+func TestHybridSearchPageWeights(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t, WithTextSearchFields[testItem]("title"))
+	addItems(t, store,
+		testItem{ID: "a", Title: "go go", Vector: []float32{0, 1}},
+		testItem{ID: "b", Title: "go", Vector: []float32{1, 0}},
+	)
+	query := [][]float32{{1, 0}}
+	for _, fusion := range []Fusion{{}, {TextWeight: -1, VectorWeight: 1}} {
+		if _, _, err := store.HybridSearchPage(ctx, []string{"go"}, query, "vector", "", fusion); err == nil {
+			t.Errorf("expected an error for the weights of %+v", fusion)
+		}
+	}
+
+	items, _, err := store.HybridSearchPage(ctx, []string{"go"}, query, "vector", "", Fusion{TextWeight: 1, VectorWeight: 2})
+	if err != nil || ids(items) != "[b a]" {
+		t.Fatalf("expected the vector ranking to win, got %s %v", ids(items), err)
+	}
+	items, _, err = store.HybridSearchPage(ctx, []string{"go"}, query, "vector", "", Fusion{TextWeight: 1})
+	if err != nil || ids(items) != "[a b]" {
+		t.Fatalf("expected the text ranking only, got %s %v", ids(items), err)
+	}
+}
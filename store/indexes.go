@@ -0,0 +1,180 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+)
+
+type IndexKind int
+
+const (
+	ScalarIndex IndexKind = iota
+	TextIndex
+	VectorIndex
+)
+
+// IndexSpec is the backend agnostic definition of an index.
+// Backends create it in their own form. The vector index form depends on the vector search dialect
+type IndexSpec struct {
+	Name string
+	Kind IndexKind
+	// fields of the index in order. For text indexes the direction doesn't matter.
+	// For vector indexes the first one is the vector field and the rest are the fields that the search can filter on
+	Keys       []SortKey
+	Unique     bool
+	Dimensions int // size of the vectors. Vector indexes only
+	// how the vectors are stored. See WithQuantizedVectors. Vector indexes only
+	Quantization Quantization
+}
+
+func ScalarIndexSpec(name string, keys ...SortKey) IndexSpec {
+	return IndexSpec{Name: name, Kind: ScalarIndex, Keys: keys}
+}
+
+// unique index on the fields. The name is derived from the fields
+func UniqueIndexSpec(fields ...string) IndexSpec {
+	keys := make([]SortKey, len(fields))
+	for i, field := range fields {
+		keys[i] = Asc(field)
+	}
+	return IndexSpec{Name: "unique_" + strings.Join(fields, "_"), Kind: ScalarIndex, Keys: keys, Unique: true}
+}
+
+func TextIndexSpec(name string, fields ...string) IndexSpec {
+	keys := make([]SortKey, len(fields))
+	for i, field := range fields {
+		keys[i] = Asc(field)
+	}
+	return IndexSpec{Name: name, Kind: TextIndex, Keys: keys}
+}
+
+// filter_fields are the scalar fields that the vector search filters on. Atlas needs them in the vector index
+func VectorIndexSpec(name, vec_path string, dimensions int, filter_fields ...string) IndexSpec {
+	keys := []SortKey{Asc(vec_path)}
+	for _, field := range filter_fields {
+		keys = append(keys, Asc(field))
+	}
+	return IndexSpec{Name: name, Kind: VectorIndex, Keys: keys, Dimensions: dimensions}
+}
+
+func (spec IndexSpec) fields() []string {
+	fields := make([]string, len(spec.Keys))
+	for i, key := range spec.Keys {
+		fields[i] = key.Field
+	}
+	return fields
+}
+
+// an index that exists with the same name but a different definition
+type IndexDrift struct {
+	Name     string
+	Expected string
+	Actual   string
+}
+
+func (drift IndexDrift) String() string {
+	return fmt.Sprintf("%s: expected %s, found %s", drift.Name, drift.Expected, drift.Actual)
+}
+
+// what EnsureIndexes found and did. Indexes that drifted are left as is since rebuilding them can take long on a big collection
+type IndexReport struct {
+	Created []string
+	Drifted []IndexDrift
+	Extra   []string // indexes in the database that are not in the specs
+}
+
+func (report IndexReport) HasDrift() bool {
+	return len(report.Drifted) > 0 || len(report.Extra) > 0
+}
+
+// Backends that can create the indexes from the specs. Creating an index that already exists is a no-op
+type IndexManager interface {
+	EnsureIndexes(ctx context.Context, specs []IndexSpec) (IndexReport, error)
+}
+
+// Creates the indexes that don't exist yet and reports the ones that differ from the specs.
+// The unique index of WithUniqueIndex is added to the specs if they don't have it. Add relies on it once it is in place.
+// The fields of the specs have to be in the schema of T. Backends that don't manage indexes return an empty report
+func (store *Store[T]) EnsureIndexes(ctx context.Context, specs ...IndexSpec) (IndexReport, error) {
+	unique := -1
+	if len(store.unique_fields) > 0 {
+		unique = slices.IndexFunc(specs, func(spec IndexSpec) bool {
+			return spec.Unique && slices.Equal(spec.fields(), store.unique_fields)
+		})
+		if unique < 0 {
+			unique = len(specs)
+			specs = append(slices.Clip(specs), UniqueIndexSpec(store.unique_fields...))
+		}
+	}
+	schema := SchemaOf[T]()
+	for _, spec := range specs {
+		for _, field := range spec.fields() {
+			if !schema.Has(field) {
+				return IndexReport{}, StoreError(fmt.Sprintf("unknown field %s in index %s for %s", field, spec.Name, schema.name))
+			}
+		}
+		// vector search looks up the index name by the vector field
+		if indexer, ok := store.backend.(VectorIndexer); ok && spec.Kind == VectorIndex {
+			indexer.SetVectorIndex(spec.Keys[0].Field, spec.Name)
+		}
+	}
+	manager, ok := store.backend.(IndexManager)
+	if !ok {
+		return IndexReport{}, nil
+	}
+	report, err := manager.EnsureIndexes(ctx, specs)
+	if len(report.Created) > 0 {
+		log.Printf("[%s]: Created indexes %s.\n", store.name, strings.Join(report.Created, ", "))
+	}
+	for _, drift := range report.Drifted {
+		log.Printf("[%s]: Index drifted. %s\n", store.name, drift)
+	}
+	if len(report.Extra) > 0 {
+		log.Printf("[%s]: Indexes that are not in the specs: %s.\n", store.name, strings.Join(report.Extra, ", "))
+	}
+	if err != nil {
+		log.Printf("[%s]: Couldn't ensure indexes. %v\n", store.name, err)
+	}
+	if unique >= 0 {
+		drifted := slices.ContainsFunc(report.Drifted, func(drift IndexDrift) bool { return drift.Name == specs[unique].Name })
+		store.unique_index.Store(err == nil && !drifted)
+	}
+	return report, err
+}
+
+// readable form of an index definition that is the same for the spec and the index found in the database
+func describeScalarIndex(keys []SortKey, unique bool) string {
+	fields := make([]string, len(keys))
+	for i, key := range keys {
+		direction := 1
+		if key.Descending {
+			direction = -1
+		}
+		fields[i] = fmt.Sprintf("%s: %d", key.Field, direction)
+	}
+	kind := "scalar"
+	if unique {
+		kind = "unique"
+	}
+	return fmt.Sprintf("%s(%s)", kind, strings.Join(fields, ", "))
+}
+
+func describeTextIndex(fields []string) string {
+	fields = append([]string(nil), fields...)
+	sort.Strings(fields)
+	return fmt.Sprintf("text(%s)", strings.Join(fields, ", "))
+}
+
+func describeVectorIndex(kind, vec_path string, dimensions int, filter_fields []string) string {
+	desc := fmt.Sprintf("%s(%s, dimensions: %d", kind, vec_path, dimensions)
+	if len(filter_fields) > 0 {
+		filter_fields = append([]string(nil), filter_fields...)
+		sort.Strings(filter_fields)
+		desc += ", filters: " + strings.Join(filter_fields, ", ")
+	}
+	return desc + ")"
+}
@@ -0,0 +1,187 @@
+package store
+
+import (
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	_CURSOR_BATCH_SIZE = 100 // number of documents the mongo cursor fetches per round trip
+)
+
+// RawIterator walks through the results of a query one raw document at a time.
+// Call Next before each Current and Close when done. Err returns the error that stopped Next, if any
+type RawIterator interface {
+	Next(ctx context.Context) bool
+	Current() bson.Raw
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// Backends that can stream results without loading all of them in memory.
+// Store falls back to Get and Aggregate for backends that don't implement it
+type Streamer interface {
+	StreamGet(ctx context.Context, filter JSON, fields JSON, sort_by JSON, top_n int) (RawIterator, error)
+	StreamAggregate(ctx context.Context, pipeline any) (RawIterator, error)
+}
+
+// Iterator decodes the documents of a RawIterator as they are read
+type Iterator[T any] struct {
+	name      string
+	raws      RawIterator
+	unmarshal func(raw bson.Raw, item *T) error
+	current   T
+	err       error
+}
+
+// Same as Get but the items are read from the backend as the iterator advances.
+// The iterator needs to be closed
+func (store *Store[T]) Iterate(ctx context.Context, filter JSON, fields JSON, sort_by JSON, top_n int) (*Iterator[T], error) {
+	return store.iterator(store.iterateRaw(ctx, filter, store.withRescoreFields(fields), sort_by, top_n))
+}
+
+// Same as Aggregate but the items are read from the backend as the iterator advances.
+// The iterator needs to be closed
+func (store *Store[T]) IterateAggregate(ctx context.Context, pipeline any) (*Iterator[T], error) {
+	if streamer, ok := store.backend.(Streamer); ok {
+		return store.iterator(streamer.StreamAggregate(ctx, pipeline))
+	}
+	return store.iterator(sliceIterator(store.backend.Aggregate(ctx, pipeline)))
+}
+
+func (store *Store[T]) iterateRaw(ctx context.Context, filter JSON, fields JSON, sort_by JSON, top_n int) (RawIterator, error) {
+	if streamer, ok := store.backend.(Streamer); ok {
+		return streamer.StreamGet(ctx, filter, fields, sort_by, top_n)
+	}
+	return sliceIterator(store.backend.Get(ctx, filter, fields, sort_by, top_n))
+}
+
+// Calls process with chunks of up to chunk_size items from the iterator until the iterator runs out or process returns an error.
+// Only one chunk is in memory at a time. The iterator is closed at the end
+func ForEachChunk[T any](ctx context.Context, iter *Iterator[T], chunk_size int, process func(ctx context.Context, chunk []T) error) error {
+	defer iter.Close(ctx)
+	if chunk_size <= 0 {
+		chunk_size = _CURSOR_BATCH_SIZE
+	}
+	for {
+		chunk, err := iter.NextChunk(ctx, chunk_size)
+		if len(chunk) > 0 {
+			if proc_err := process(ctx, chunk); proc_err != nil {
+				return proc_err
+			}
+		}
+		if err != nil || len(chunk) < chunk_size {
+			return err
+		}
+	}
+}
+
+func (store *Store[T]) iterator(raws RawIterator, err error) (*Iterator[T], error) {
+	if err != nil {
+		log.Printf("[%s]: Couldn't retrieve items. %v\n", store.name, err)
+		return nil, err
+	}
+	return &Iterator[T]{name: store.name, raws: raws, unmarshal: store.unmarshal}, nil
+}
+
+// advances to the next item. Returns false when there are no more items or reading/decoding failed
+func (iter *Iterator[T]) Next(ctx context.Context) bool {
+	if iter.err != nil || !iter.raws.Next(ctx) {
+		return false
+	}
+	var item T
+	if err := iter.unmarshal(iter.raws.Current(), &item); err != nil {
+		log.Printf("[%s]: Couldn't unmarshall item. %v\n", iter.name, err)
+		iter.err = err
+		return false
+	}
+	iter.current = item
+	return true
+}
+
+// the item that the last successful Next read
+func (iter *Iterator[T]) Item() T {
+	return iter.current
+}
+
+// reads up to size items. A chunk shorter than size means there are no more items or an error occurred
+func (iter *Iterator[T]) NextChunk(ctx context.Context, size int) ([]T, error) {
+	chunk := make([]T, 0, size)
+	for len(chunk) < size && iter.Next(ctx) {
+		chunk = append(chunk, iter.current)
+	}
+	return chunk, iter.Err()
+}
+
+func (iter *Iterator[T]) Err() error {
+	if iter.err != nil {
+		return iter.err
+	}
+	return iter.raws.Err()
+}
+
+func (iter *Iterator[T]) Close(ctx context.Context) error {
+	return iter.raws.Close(ctx)
+}
+
+// iterator over results that are already in memory
+type rawSliceIterator struct {
+	raws []bson.Raw
+	pos  int
+	err  error
+}
+
+func sliceIterator(raws []bson.Raw, err error) (RawIterator, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &rawSliceIterator{raws: raws, pos: -1}, nil
+}
+
+func (iter *rawSliceIterator) Next(ctx context.Context) bool {
+	if iter.err != nil || iter.pos+1 >= len(iter.raws) {
+		return false
+	}
+	if iter.err = ctx.Err(); iter.err != nil {
+		return false
+	}
+	iter.pos++
+	return true
+}
+
+func (iter *rawSliceIterator) Current() bson.Raw {
+	return iter.raws[iter.pos]
+}
+
+func (iter *rawSliceIterator) Err() error {
+	return iter.err
+}
+
+func (iter *rawSliceIterator) Close(ctx context.Context) error {
+	iter.raws = nil
+	return nil
+}
+
+// mongo cursors fetch the documents in batches as Next goes through them
+type cursorIterator struct {
+	cursor *mongo.Cursor
+}
+
+func (iter cursorIterator) Next(ctx context.Context) bool {
+	return iter.cursor.Next(ctx)
+}
+
+func (iter cursorIterator) Current() bson.Raw {
+	return iter.cursor.Current
+}
+
+func (iter cursorIterator) Err() error {
+	return iter.cursor.Err()
+}
+
+func (iter cursorIterator) Close(ctx context.Context) error {
+	return iter.cursor.Close(ctx)
+}
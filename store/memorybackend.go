@@ -0,0 +1,442 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memory://<name> keeps the collections in process. Stores opened with the same connection string,
+// database and collection share the same data for the lifetime of the process.
+// Vector search uses an in-process index of each vector field with a vector index spec. The index is exact by default.
+// memory://<name>?vector_index=hnsw switches to an approximate HNSW graph which is faster on big collections. The same goes for file://
+func init() {
+	RegisterBackend("memory", newMemoryBackend)
+}
+
+var memory_collections = struct {
+	sync.Mutex
+	items map[string]*memoryBackend
+}{items: make(map[string]*memoryBackend)}
+
+type memoryBackend struct {
+	name        string
+	lock        sync.RWMutex
+	docs        []bson.M
+	text_fields []string
+	// sets of fields that have unique values. Add skips the docs that would break them
+	unique_indexes [][]string
+	// called with the lock held before a write takes effect. This is how the file backend persists the data.
+	// If it fails the documents and the vector indexes stay as they were
+	persist func(changes []docChange) error
+	// releases what the file backend holds on to. nil for the memory backend
+	on_close func() error
+	// in-process indexes of the vector fields that have a vector index spec. VectorSearch falls back to brute force without one
+	vector_indexes    map[string]*vectorIndex
+	vector_index_kind string
+	// where the file backend saves the vector index of a field. nil for the memory backend
+	index_path func(vec_path string) string
+}
+
+// one document written by a write. before is nil for inserts and after is nil for deletes
+type docChange struct {
+	before, after bson.M
+}
+
+func newMemoryBackend(connection_string, database, collection string) (Backend, error) {
+	key := fmt.Sprintf("%s/%s/%s", connection_string, database, collection)
+	memory_collections.Lock()
+	defer memory_collections.Unlock()
+	if backend, ok := memory_collections.items[key]; ok {
+		return backend, nil
+	}
+	backend := &memoryBackend{name: fmt.Sprintf("%s/%s", database, collection), vector_index_kind: vectorIndexKind(connection_string)}
+	memory_collections.items[key] = backend
+	return backend, nil
+}
+
+// fields that make up the text index for TextSearch. If not set all string fields are searched
+func (backend *memoryBackend) SetTextFields(fields []string) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	backend.text_fields = fields
+}
+
+func (backend *memoryBackend) Add(ctx context.Context, docs []any) (InsertResult, error) {
+	if err := ctx.Err(); err != nil {
+		return InsertResult{Failed: positions(len(docs))}, err
+	}
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	// like mongo _id is always unique
+	indexes := append([][]string{{"_id"}}, backend.unique_indexes...)
+	existing := make([]map[string]bool, len(indexes))
+	for i, fields := range indexes {
+		existing[i] = make(map[string]bool, len(backend.docs))
+		for _, doc := range backend.docs {
+			existing[i][uniqueKey(doc, fields)] = true
+		}
+	}
+
+	var res InsertResult
+	var errs []error
+	// the new documents go on a copy that only gets swapped in once they are persisted
+	next := slices.Clip(backend.docs)
+	var changes []docChange
+	for i, doc := range docs {
+		item, err := toDocument(doc)
+		if err != nil {
+			res.Failed = append(res.Failed, i)
+			errs = append(errs, err)
+			continue
+		}
+		if _, ok := item["_id"]; !ok {
+			item["_id"] = primitive.NewObjectID()
+		}
+		keys := make([]string, len(indexes))
+		duplicate := false
+		for j, fields := range indexes {
+			keys[j] = uniqueKey(item, fields)
+			duplicate = duplicate || existing[j][keys[j]]
+		}
+		if duplicate {
+			res.Duplicates = append(res.Duplicates, i)
+			continue
+		}
+		for j := range indexes {
+			existing[j][keys[j]] = true
+		}
+		next = append(next, item)
+		changes = append(changes, docChange{after: item})
+		res.Inserted = append(res.Inserted, i)
+	}
+	if err := backend.commit(next, changes); err != nil {
+		return InsertResult{Failed: positions(len(docs))}, err
+	}
+	return res, errors.Join(errs...)
+}
+
+// the docs that have the same values for the fields have the same key. Missing fields count as null like in mongo
+func uniqueKey(doc bson.M, fields []string) string {
+	values := make(bson.A, len(fields))
+	for i, field := range fields {
+		values[i], _ = lookupPath(doc, field)
+	}
+	key, err := bson.MarshalExtJSON(bson.M{"v": values}, true, false)
+	if err != nil {
+		// this should not happen for documents that came from bson
+		return fmt.Sprint(values)
+	}
+	return string(key)
+}
+
+func (backend *memoryBackend) setUniqueIndex(fields []string) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	// stores on the same collection share the backend
+	for _, index := range backend.unique_indexes {
+		if slices.Equal(index, fields) {
+			return
+		}
+	}
+	backend.unique_indexes = append(backend.unique_indexes, fields)
+}
+
+// both the vector indexes and the brute force search read quantized vectors
+func (backend *memoryBackend) SearchesQuantizedVectors() bool {
+	return true
+}
+
+// text indexes set the text search fields, unique indexes get enforced on Add and vector indexes get built in process.
+// The rest don't matter in memory
+func (backend *memoryBackend) EnsureIndexes(ctx context.Context, specs []IndexSpec) (IndexReport, error) {
+	for _, spec := range specs {
+		switch {
+		case spec.Kind == TextIndex:
+			backend.SetTextFields(spec.fields())
+		case spec.Kind == VectorIndex:
+			backend.lock.Lock()
+			backend.setVectorIndex(spec.fields()[0], spec.Dimensions)
+			backend.lock.Unlock()
+		case spec.Unique:
+			backend.setUniqueIndex(spec.fields())
+		}
+	}
+	return IndexReport{}, ctx.Err()
+}
+
+func (backend *memoryBackend) Update(ctx context.Context, docs []any, filters []JSON) (UpdateResult, error) {
+	return backend.write(ctx, docs, filters, func(existing, doc bson.M) bson.M {
+		// stored documents are replaced instead of being modified so that whatever got read earlier stays intact
+		updated := copyDocument(existing)
+		for key, val := range doc {
+			setPath(updated, key, val)
+		}
+		return updated
+	})
+}
+
+func (backend *memoryBackend) Replace(ctx context.Context, docs []any, filters []JSON) (UpdateResult, error) {
+	return backend.write(ctx, docs, filters, func(existing, doc bson.M) bson.M {
+		doc["_id"] = existing["_id"]
+		return doc
+	})
+}
+
+// writes docs[i] on the first document that matches filters[i]. apply creates the new version of the document
+func (backend *memoryBackend) write(ctx context.Context, docs []any, filters []JSON, apply func(existing, doc bson.M) bson.M) (UpdateResult, error) {
+	var res UpdateResult
+	if err := ctx.Err(); err != nil {
+		for i := range docs {
+			res.fail(i, err)
+		}
+		return res, res.Err()
+	}
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	// the writes go on a copy so that later docs see the earlier ones. It only gets swapped in once they are persisted
+	next := slices.Clone(backend.docs)
+	var changes []docChange
+	for i := range docs {
+		doc, err := toDocument(docs[i])
+		if err == nil {
+			var filter bson.D
+			if filter, err = toQuery(filters[i]); err == nil {
+				err = writeOne(next, doc, filter, apply, &res, &changes)
+			}
+		}
+		if err != nil {
+			log.Printf("[%s]: Write failed for docs[%d]. %v\n", backend.name, i, err)
+			res.fail(i, err)
+		}
+	}
+	if err := backend.commit(next, changes); err != nil {
+		// nothing got persisted
+		res.Matched, res.Modified = 0, 0
+		for i := range docs {
+			res.fail(i, err)
+		}
+	}
+	return res, res.Err()
+}
+
+func writeOne(docs []bson.M, doc bson.M, filter bson.D, apply func(existing, doc bson.M) bson.M, res *UpdateResult, changes *[]docChange) error {
+	for i := range docs {
+		matched, err := matchDocument(docs[i], filter)
+		if err != nil {
+			return err
+		}
+		if matched {
+			updated := apply(docs[i], doc)
+			res.Matched++
+			if !reflect.DeepEqual(updated, docs[i]) {
+				res.Modified++
+				*changes = append(*changes, docChange{before: docs[i], after: updated})
+				docs[i] = updated
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func (backend *memoryBackend) Get(ctx context.Context, filter JSON, fields JSON, sort_by JSON, top_n int) ([]bson.Raw, error) {
+	pipeline := []JSON{{"$match": filter}}
+	if len(sort_by) > 0 {
+		pipeline = append(pipeline, JSON{"$sort": sort_by})
+	}
+	if top_n > 0 {
+		pipeline = append(pipeline, JSON{"$limit": top_n})
+	}
+	if len(fields) > 0 {
+		pipeline = append(pipeline, JSON{"$project": fields})
+	}
+	return backend.Aggregate(ctx, pipeline)
+}
+
+func (backend *memoryBackend) Aggregate(ctx context.Context, pipeline any) ([]bson.Raw, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stages, err := toPipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := runPipeline(backend.snapshot(), stages)
+	if err != nil {
+		return nil, err
+	}
+	return toRaw(docs), nil
+}
+
+func (backend *memoryBackend) TextSearch(ctx context.Context, query_texts []string, params *SearchParams) ([]bson.Raw, error) {
+	backend.lock.RLock()
+	text_fields := backend.text_fields
+	backend.lock.RUnlock()
+
+	terms := queryTerms(query_texts)
+	return backend.search(ctx, params, false, func(doc bson.M) (float64, bool) {
+		score := textScore(doc, text_fields, terms)
+		return score, score > 0
+	})
+}
+
+func (backend *memoryBackend) VectorSearch(ctx context.Context, query_embedding []float32, vec_path string, params *SearchParams) ([]bson.Raw, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	docs, indexed, err := backend.searchVectorIndex(query_embedding, vec_path, params.Filter, searchTopN(params))
+	if err != nil {
+		return nil, err
+	} else if indexed {
+		return postSearch(docs, params, true)
+	}
+	return backend.search(ctx, params, true, func(doc bson.M) (float64, bool) {
+		val, found := lookupPath(doc, vec_path)
+		if !found {
+			return 0, false
+		}
+		vec, ok := asVector(val)
+		if !ok || len(vec) != len(query_embedding) {
+			return 0, false
+		}
+		return CosineSimilarity(query_embedding, vec), true
+	})
+}
+
+// scores the documents that pass the filter and then follows the same post search stages as the mongo pipelines
+func (backend *memoryBackend) search(ctx context.Context, params *SearchParams, is_vector bool, score func(doc bson.M) (float64, bool)) ([]bson.Raw, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	docs, err := backend.scoreDocuments(params.Filter, score)
+	if err != nil {
+		return nil, err
+	}
+	// like cosmosSearch the vector search picks the top k nearest before the rest of the stages
+	if is_vector && len(docs) > searchTopN(params) {
+		docs = docs[:searchTopN(params)]
+	}
+	return postSearch(docs, params, is_vector)
+}
+
+func searchTopN(params *SearchParams) int {
+	if params.TopN <= 0 {
+		return _DEFAULT_SEARCH_TOP_N
+	}
+	return params.TopN
+}
+
+// the same post search stages as the mongo pipelines on the scored documents
+func postSearch(docs []bson.M, params *SearchParams, is_vector bool) ([]bson.Raw, error) {
+	stages, err := toPipeline(appendPostSearchStages(nil, params, !is_vector))
+	if err == nil {
+		docs, err = runPipeline(docs, stages)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return toRaw(docs), nil
+}
+
+// returns the documents that pass the filter and have a score, sorted by score
+func (backend *memoryBackend) scoreDocuments(filter JSON, score func(doc bson.M) (float64, bool)) ([]bson.M, error) {
+	query, err := toQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := filterDocuments(backend.snapshot(), query)
+	if err != nil {
+		return nil, err
+	}
+	scored := make([]bson.M, 0, len(docs))
+	for _, doc := range docs {
+		if val, ok := score(doc); ok {
+			doc = copyDocument(doc)
+			doc[_SEARCH_SCORE] = val
+			scored = append(scored, doc)
+		}
+	}
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i][_SEARCH_SCORE].(float64) > scored[j][_SEARCH_SCORE].(float64)
+	})
+	return scored, nil
+}
+
+func (backend *memoryBackend) Delete(ctx context.Context, filter JSON) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	query, err := toQuery(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	// all the matches come first so that an error leaves the documents as they were
+	remaining := make([]bson.M, 0, len(backend.docs))
+	var deleted []bson.M
+	for _, doc := range backend.docs {
+		matched, err := matchDocument(doc, query)
+		if err != nil {
+			return 0, err
+		}
+		if matched {
+			deleted = append(deleted, doc)
+		} else {
+			remaining = append(remaining, doc)
+		}
+	}
+	changes := make([]docChange, len(deleted))
+	for i, doc := range deleted {
+		changes[i] = docChange{before: doc}
+	}
+	if err := backend.commit(remaining, changes); err != nil {
+		return 0, err
+	}
+	return len(deleted), nil
+}
+
+// stored documents never get modified in place so a copy of the slice is a consistent snapshot
+func (backend *memoryBackend) snapshot() []bson.M {
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
+	return append([]bson.M(nil), backend.docs...)
+}
+
+// persists the changes first and then swaps in the documents and updates the vector indexes.
+// A failure to persist leaves everything as it was. Call it with the lock held
+func (backend *memoryBackend) commit(docs []bson.M, changes []docChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	if backend.persist != nil {
+		if err := backend.persist(changes); err != nil {
+			return err
+		}
+	}
+	backend.docs = docs
+	for _, change := range changes {
+		backend.reindex(change.before, change.after)
+	}
+	return nil
+}
+
+// the file backend saves its vector indexes and closes its database file once the last store on the collection is closed
+func (backend *memoryBackend) Close(ctx context.Context) error {
+	if backend.on_close == nil {
+		return nil
+	}
+	return backend.on_close()
+}
@@ -0,0 +1,1057 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// In-process evaluation of the subset of mongo query language and aggregation pipeline stages that the sdk uses.
+// This lets the non-mongo backends take the same filters and pipelines as the mongo backend.
+// Documents are kept as bson.M and queries are kept as bson.D so that the order of sort keys is preserved
+
+const (
+	_SEARCH_SCORE = "search_score"
+)
+
+type queryError string
+
+func (err queryError) Error() string {
+	return string(err)
+}
+
+// converts any bson serializable struct or map into a bson.M through a round trip
+func toDocument(doc any) (bson.M, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var res bson.M
+	err = bson.Unmarshal(data, &res)
+	return res, err
+}
+
+// converts a filter/sort/projection into a bson.D through a round trip. nil turns into an empty query
+func toQuery(query any) (bson.D, error) {
+	if query == nil {
+		return bson.D{}, nil
+	}
+	if val := reflect.ValueOf(query); val.Kind() == reflect.Map && val.IsNil() {
+		return bson.D{}, nil
+	}
+	data, err := bson.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	var res bson.D
+	err = bson.Unmarshal(data, &res)
+	return res, err
+}
+
+// converts a pipeline into an array of stages through a round trip
+func toPipeline(pipeline any) ([]bson.D, error) {
+	wrapper, err := toQuery(bson.M{"pipeline": pipeline})
+	if err != nil {
+		return nil, err
+	}
+	stages, ok := wrapper[0].Value.(bson.A)
+	// nil slices get marshalled as null. that is an empty pipeline
+	if wrapper[0].Value == nil {
+		stages, ok = nil, true
+	}
+	if !ok {
+		return nil, queryError("pipeline has to be an array of stages")
+	}
+	res := make([]bson.D, 0, len(stages))
+	for _, stage := range stages {
+		stage_doc, ok := stage.(bson.D)
+		if !ok || len(stage_doc) != 1 {
+			return nil, queryError("each pipeline stage has to be a document with one operator")
+		}
+		res = append(res, stage_doc)
+	}
+	return res, nil
+}
+
+func toRaw(docs []bson.M) []bson.Raw {
+	res := make([]bson.Raw, 0, len(docs))
+	for _, doc := range docs {
+		if data, err := bson.Marshal(doc); err == nil {
+			res = append(res, data)
+		}
+	}
+	return res
+}
+
+// shallow copy of the document so that stages don't modify the stored documents
+func copyDocument(doc bson.M) bson.M {
+	res := make(bson.M, len(doc))
+	for k, v := range doc {
+		res[k] = v
+	}
+	return res
+}
+
+func asMap(val any) (bson.M, bool) {
+	switch v := val.(type) {
+	case bson.M:
+		return v, true
+	case map[string]any:
+		return v, true
+	case JSON:
+		return bson.M(v), true
+	case bson.D:
+		return v.Map(), true
+	}
+	return nil, false
+}
+
+func asArray(val any) (bson.A, bool) {
+	switch v := val.(type) {
+	case bson.A:
+		return v, true
+	case []any:
+		return v, true
+	}
+	return nil, false
+}
+
+func asNumber(val any) (float64, bool) {
+	switch v := val.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func asBool(val any) bool {
+	switch v := val.(type) {
+	case bool:
+		return v
+	case nil:
+		return false
+	}
+	if num, ok := asNumber(val); ok {
+		return num != 0
+	}
+	return true
+}
+
+func asVector(val any) ([]float32, bool) {
+	if vec, ok := DequantizeVector(val); ok {
+		return vec, true
+	}
+	arr, ok := asArray(val)
+	if !ok {
+		return nil, false
+	}
+	vec := make([]float32, len(arr))
+	for i := range arr {
+		num, ok := asNumber(arr[i])
+		if !ok {
+			return nil, false
+		}
+		vec[i] = float32(num)
+	}
+	return vec, true
+}
+
+// returns the number in the most compact form. integral values are kept as int64 like mongo does
+func toNumber(val float64, integral bool) any {
+	if integral && val == math.Trunc(val) && math.Abs(val) < math.MaxInt64 {
+		return int64(val)
+	}
+	return val
+}
+
+func isIntegral(val any) bool {
+	switch val.(type) {
+	case int, int32, int64:
+		return true
+	}
+	return false
+}
+
+// looks up a dotted path. If the path goes through an array of documents the values are collected into an array
+func lookupPath(doc any, path string) (any, bool) {
+	head, tail, nested := strings.Cut(path, ".")
+	if m, ok := asMap(doc); ok {
+		val, found := m[head]
+		if !found || !nested {
+			return val, found
+		}
+		return lookupPath(val, tail)
+	}
+	if arr, ok := asArray(doc); ok {
+		values := make(bson.A, 0, len(arr))
+		for _, item := range arr {
+			if val, found := lookupPath(item, path); found {
+				values = append(values, val)
+			}
+		}
+		return values, len(values) > 0
+	}
+	return nil, false
+}
+
+func setPath(doc bson.M, path string, val any) {
+	head, tail, nested := strings.Cut(path, ".")
+	if !nested {
+		doc[head] = val
+		return
+	}
+	child, ok := asMap(doc[head])
+	if !ok {
+		child = bson.M{}
+	} else {
+		child = copyDocument(child)
+	}
+	setPath(child, tail, val)
+	doc[head] = child
+}
+
+func unsetPath(doc bson.M, path string) {
+	head, tail, nested := strings.Cut(path, ".")
+	if !nested {
+		delete(doc, head)
+		return
+	}
+	if child, ok := asMap(doc[head]); ok {
+		child = copyDocument(child)
+		unsetPath(child, tail)
+		doc[head] = child
+	}
+}
+
+// sort order of bson types as defined by mongo
+func typeOrder(val any) int {
+	switch val.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return 1
+	case int, int32, int64, float32, float64:
+		return 2
+	case string:
+		return 3
+	case bson.M, bson.D, map[string]any, JSON:
+		return 4
+	case bson.A, []any:
+		return 5
+	case primitive.Binary, []byte:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime, primitive.Timestamp:
+		return 9
+	}
+	return 10
+}
+
+// compares two values. The second return value is false if the values are not of comparable types
+func compareValues(a, b any) (int, bool) {
+	if typeOrder(a) != typeOrder(b) {
+		return 0, false
+	}
+	switch av := a.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return 0, true
+	case string:
+		return strings.Compare(av, b.(string)), true
+	case bool:
+		bv := b.(bool)
+		switch {
+		case av == bv:
+			return 0, true
+		case bv:
+			return -1, true
+		default:
+			return 1, true
+		}
+	case primitive.ObjectID:
+		bv := b.(primitive.ObjectID)
+		return bytes.Compare(av[:], bv[:]), true
+	case primitive.DateTime:
+		bv, ok := b.(primitive.DateTime)
+		if !ok {
+			return 0, false
+		}
+		return compareFloats(float64(av), float64(bv)), true
+	}
+	if an, ok := asNumber(a); ok {
+		bn, _ := asNumber(b)
+		return compareFloats(an, bn), true
+	}
+	if aa, ok := asArray(a); ok {
+		ba, _ := asArray(b)
+		for i := 0; i < len(aa) && i < len(ba); i++ {
+			if res := sortOrder(aa[i], ba[i]); res != 0 {
+				return res, true
+			}
+		}
+		return compareFloats(float64(len(aa)), float64(len(ba))), true
+	}
+	if reflect.DeepEqual(a, b) {
+		return 0, true
+	}
+	// documents and binaries are compared by their printed representation
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b)), true
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// total order used for sorting. Values of different types are ordered by their type
+func sortOrder(a, b any) int {
+	if res, ok := compareValues(a, b); ok {
+		return res
+	}
+	return compareFloats(float64(typeOrder(a)), float64(typeOrder(b)))
+}
+
+func equalValues(a, b any) bool {
+	res, ok := compareValues(a, b)
+	return ok && res == 0
+}
+
+// values a condition is matched against. Arrays match if the array or any of its items match
+func candidateValues(val any) []any {
+	if arr, ok := asArray(val); ok {
+		return append([]any{val}, arr...)
+	}
+	return []any{val}
+}
+
+func matchDocument(doc bson.M, filter bson.D) (bool, error) {
+	for _, elem := range filter {
+		var matched bool
+		var err error
+		switch elem.Key {
+		case "$or", "$and", "$nor":
+			matched, err = matchLogical(doc, elem.Key, elem.Value)
+		default:
+			val, found := lookupPath(doc, elem.Key)
+			matched, err = matchCondition(val, found, elem.Value)
+		}
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchLogical(doc bson.M, op string, clauses any) (bool, error) {
+	items, ok := asArray(clauses)
+	if !ok {
+		return false, queryError(op + " needs an array")
+	}
+	for _, item := range items {
+		clause, ok := item.(bson.D)
+		if !ok {
+			return false, queryError(op + " needs an array of documents")
+		}
+		matched, err := matchDocument(doc, clause)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case op == "$or" && matched:
+			return true, nil
+		case op == "$and" && !matched:
+			return false, nil
+		case op == "$nor" && matched:
+			return false, nil
+		}
+	}
+	return op != "$or", nil
+}
+
+func isOperatorDocument(cond any) (bson.D, bool) {
+	ops, ok := cond.(bson.D)
+	if !ok || len(ops) == 0 {
+		return nil, false
+	}
+	for _, op := range ops {
+		if !strings.HasPrefix(op.Key, "$") {
+			return nil, false
+		}
+	}
+	return ops, true
+}
+
+func matchCondition(val any, found bool, cond any) (bool, error) {
+	ops, ok := isOperatorDocument(cond)
+	if !ok {
+		return found && matchAny(val, func(item any) bool { return equalValues(item, cond) }) || (!found && cond == nil), nil
+	}
+	for _, op := range ops {
+		matched, err := matchOperator(val, found, op.Key, op.Value)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchAny(val any, condition func(item any) bool) bool {
+	for _, item := range candidateValues(val) {
+		if condition(item) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOperator(val any, found bool, op string, arg any) (bool, error) {
+	switch op {
+	case "$eq":
+		return matchCondition(val, found, bson.D{{Key: "$in", Value: bson.A{arg}}})
+	case "$ne":
+		matched, err := matchOperator(val, found, "$eq", arg)
+		return !matched, err
+	case "$gt", "$gte", "$lt", "$lte":
+		if !found {
+			return false, nil
+		}
+		return matchAny(val, func(item any) bool {
+			res, ok := compareValues(item, arg)
+			if !ok {
+				return false
+			}
+			switch op {
+			case "$gt":
+				return res > 0
+			case "$gte":
+				return res >= 0
+			case "$lt":
+				return res < 0
+			default:
+				return res <= 0
+			}
+		}), nil
+	case "$in", "$nin":
+		options, ok := asArray(arg)
+		if !ok {
+			return false, queryError(op + " needs an array")
+		}
+		matched := false
+		for _, option := range options {
+			if (!found && option == nil) || (found && matchAny(val, func(item any) bool { return equalValues(item, option) })) {
+				matched = true
+				break
+			}
+		}
+		return matched == (op == "$in"), nil
+	case "$exists":
+		return found == asBool(arg), nil
+	case "$not":
+		matched, err := matchCondition(val, found, arg)
+		return !matched, err
+	case "$size":
+		arr, ok := asArray(val)
+		size, _ := asNumber(arg)
+		return ok && float64(len(arr)) == size, nil
+	}
+	return false, queryError(fmt.Sprintf("unsupported query operator %s", op))
+}
+
+func filterDocuments(docs []bson.M, filter bson.D) ([]bson.M, error) {
+	if len(filter) == 0 {
+		return docs, nil
+	}
+	res := make([]bson.M, 0, len(docs))
+	for _, doc := range docs {
+		matched, err := matchDocument(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			res = append(res, doc)
+		}
+	}
+	return res, nil
+}
+
+func sortDocuments(docs []bson.M, sort_by bson.D) []bson.M {
+	if len(sort_by) == 0 {
+		return docs
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, key := range sort_by {
+			a, _ := lookupPath(docs[i], key.Key)
+			b, _ := lookupPath(docs[j], key.Key)
+			res := sortOrder(a, b)
+			if direction, _ := asNumber(key.Value); direction < 0 {
+				res = -res
+			}
+			if res != 0 {
+				return res < 0
+			}
+		}
+		return false
+	})
+	return docs
+}
+
+func projectDocuments(docs []bson.M, projection bson.D) ([]bson.M, error) {
+	if len(projection) == 0 {
+		return docs, nil
+	}
+	res := make([]bson.M, len(docs))
+	for i := range docs {
+		projected, err := projectDocument(docs[i], projection)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = projected
+	}
+	return res, nil
+}
+
+func projectDocument(doc bson.M, projection bson.D) (bson.M, error) {
+	exclusion := true
+	include_id := true
+	only_id := true
+	for _, field := range projection {
+		_, is_flag := field.Value.(bool)
+		_, is_num := asNumber(field.Value)
+		if field.Key == "_id" && (is_flag || is_num) {
+			include_id = asBool(field.Value)
+			continue
+		}
+		only_id = false
+		if !(is_flag || is_num) || asBool(field.Value) {
+			exclusion = false
+		}
+	}
+	// like mongo {_id: 1} on its own keeps only the _id
+	if only_id && include_id {
+		exclusion = false
+	}
+
+	if exclusion {
+		res := copyDocument(doc)
+		for _, field := range projection {
+			if field.Key != "_id" || !include_id {
+				unsetPath(res, field.Key)
+			}
+		}
+		return res, nil
+	}
+
+	res := bson.M{}
+	if id, found := doc["_id"]; found && include_id {
+		res["_id"] = id
+	}
+	for _, field := range projection {
+		if field.Key == "_id" && !asBool(field.Value) {
+			continue
+		}
+		_, is_flag := field.Value.(bool)
+		_, is_num := asNumber(field.Value)
+		if is_flag || is_num {
+			if val, found := lookupPath(doc, field.Key); found {
+				setPath(res, field.Key, val)
+			}
+			continue
+		}
+		val, err := evalExpression(doc, field.Value)
+		if err != nil {
+			return nil, err
+		}
+		setPath(res, field.Key, val)
+	}
+	return res, nil
+}
+
+func evalExpression(doc bson.M, expr any) (any, error) {
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$") && !strings.HasPrefix(e, "$$") {
+			val, _ := lookupPath(doc, e[1:])
+			return val, nil
+		}
+		return e, nil
+	case bson.A:
+		res := make(bson.A, len(e))
+		for i := range e {
+			val, err := evalExpression(doc, e[i])
+			if err != nil {
+				return nil, err
+			}
+			res[i] = val
+		}
+		return res, nil
+	case bson.D:
+		if len(e) == 1 && strings.HasPrefix(e[0].Key, "$") {
+			return evalOperator(doc, e[0].Key, e[0].Value)
+		}
+		// keeping the field order so that documents used as $group keys compare the same
+		res := make(bson.D, 0, len(e))
+		for _, field := range e {
+			val, err := evalExpression(doc, field.Value)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, bson.E{Key: field.Key, Value: val})
+		}
+		return res, nil
+	}
+	return expr, nil
+}
+
+func evalArguments(doc bson.M, args any) ([]any, error) {
+	val, err := evalExpression(doc, args)
+	if err != nil {
+		return nil, err
+	}
+	if arr, ok := asArray(val); ok {
+		return arr, nil
+	}
+	return []any{val}, nil
+}
+
+func evalOperator(doc bson.M, op string, args any) (any, error) {
+	if op == "$literal" {
+		return args, nil
+	}
+	values, err := evalArguments(doc, args)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "$add", "$multiply", "$subtract", "$divide":
+		return evalArithmetic(op, values), nil
+	case "$sum", "$max", "$min", "$avg":
+		// the array form of accumulators sums up the items of the array
+		if len(values) == 1 {
+			if arr, ok := asArray(values[0]); ok {
+				values = arr
+			}
+		}
+		acc := newAccumulator(op)
+		for _, val := range values {
+			acc.add(val)
+		}
+		return acc.result(), nil
+	case "$ifNull":
+		for _, val := range values {
+			if val != nil {
+				return val, nil
+			}
+		}
+		return nil, nil
+	case "$size":
+		if arr, ok := asArray(values[0]); ok && len(values) == 1 {
+			return int32(len(arr)), nil
+		}
+		return nil, queryError("$size needs an array")
+	case "$concat":
+		var builder strings.Builder
+		for _, val := range values {
+			str, ok := val.(string)
+			if !ok {
+				return nil, nil
+			}
+			builder.WriteString(str)
+		}
+		return builder.String(), nil
+	}
+	return nil, queryError(fmt.Sprintf("unsupported expression operator %s", op))
+}
+
+// arithmetic on null or missing values results in null like mongo
+func evalArithmetic(op string, values []any) any {
+	if len(values) == 0 {
+		return nil
+	}
+	integral := true
+	var res float64
+	for i, val := range values {
+		num, ok := asNumber(val)
+		if !ok {
+			return nil
+		}
+		integral = integral && isIntegral(val)
+		switch {
+		case i == 0:
+			res = num
+		case op == "$add":
+			res += num
+		case op == "$multiply":
+			res *= num
+		case op == "$subtract":
+			res -= num
+		case op == "$divide":
+			if num == 0 {
+				return nil
+			}
+			res /= num
+			integral = false
+		}
+	}
+	return toNumber(res, integral)
+}
+
+type accumulator struct {
+	op       string
+	values   bson.A
+	sum      float64
+	count    int
+	integral bool
+	best     any
+	has_best bool
+}
+
+func newAccumulator(op string) *accumulator {
+	return &accumulator{op: op, integral: true}
+}
+
+func (acc *accumulator) add(val any) {
+	switch acc.op {
+	case "$first":
+		if acc.count == 0 {
+			acc.best = val
+		}
+	case "$last":
+		acc.best = val
+	case "$sum", "$avg":
+		// non-numeric values are ignored
+		if num, ok := asNumber(val); ok {
+			acc.sum += num
+			acc.integral = acc.integral && isIntegral(val)
+		} else {
+			return
+		}
+	case "$max", "$min":
+		if val == nil {
+			return
+		}
+		if !acc.has_best {
+			acc.best, acc.has_best = val, true
+		} else if res := sortOrder(val, acc.best); (acc.op == "$max" && res > 0) || (acc.op == "$min" && res < 0) {
+			acc.best = val
+		}
+	case "$push":
+		acc.values = append(acc.values, val)
+	case "$addToSet":
+		for _, item := range acc.values {
+			if equalValues(item, val) {
+				return
+			}
+		}
+		acc.values = append(acc.values, val)
+	}
+	acc.count++
+}
+
+func (acc *accumulator) result() any {
+	switch acc.op {
+	case "$sum":
+		return toNumber(acc.sum, acc.integral)
+	case "$avg":
+		if acc.count == 0 {
+			return nil
+		}
+		return acc.sum / float64(acc.count)
+	case "$push", "$addToSet":
+		if acc.values == nil {
+			return bson.A{}
+		}
+		return acc.values
+	}
+	return acc.best
+}
+
+func groupDocuments(docs []bson.M, spec bson.D) ([]bson.M, error) {
+	type group struct {
+		id           any
+		accumulators map[string]*accumulator
+	}
+	groups := make([]*group, 0)
+	index := make(map[string]*group)
+
+	id_expr, found := spec.Map()["_id"]
+	if !found {
+		return nil, queryError("$group needs an _id")
+	}
+	for _, doc := range docs {
+		id, err := evalExpression(doc, id_expr)
+		if err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("%#v", id)
+		if data, err := bson.MarshalExtJSON(bson.M{"id": id}, true, false); err == nil {
+			key = string(data)
+		}
+		grp, ok := index[key]
+		if !ok {
+			grp = &group{id: id, accumulators: make(map[string]*accumulator)}
+			index[key] = grp
+			groups = append(groups, grp)
+		}
+		for _, field := range spec {
+			if field.Key == "_id" {
+				continue
+			}
+			acc_spec, ok := field.Value.(bson.D)
+			if !ok || len(acc_spec) != 1 {
+				return nil, queryError(fmt.Sprintf("%s in $group needs an accumulator", field.Key))
+			}
+			acc, ok := grp.accumulators[field.Key]
+			if !ok {
+				acc = newAccumulator(acc_spec[0].Key)
+				grp.accumulators[field.Key] = acc
+			}
+			val, err := evalExpression(doc, acc_spec[0].Value)
+			if err != nil {
+				return nil, err
+			}
+			acc.add(val)
+		}
+	}
+
+	res := make([]bson.M, len(groups))
+	for i, grp := range groups {
+		res[i] = bson.M{"_id": grp.id}
+		for name, acc := range grp.accumulators {
+			res[i][name] = acc.result()
+		}
+	}
+	return res, nil
+}
+
+func unwindDocuments(docs []bson.M, spec any) ([]bson.M, error) {
+	path, preserve := "", false
+	switch s := spec.(type) {
+	case string:
+		path = s
+	case bson.D:
+		m := s.Map()
+		path, _ = m["path"].(string)
+		preserve = asBool(m["preserveNullAndEmptyArrays"])
+	}
+	if !strings.HasPrefix(path, "$") {
+		return nil, queryError("$unwind needs a field path")
+	}
+	path = path[1:]
+	res := make([]bson.M, 0, len(docs))
+	for _, doc := range docs {
+		val, found := lookupPath(doc, path)
+		arr, is_array := asArray(val)
+		switch {
+		case is_array && len(arr) > 0:
+			for _, item := range arr {
+				unwound := copyDocument(doc)
+				setPath(unwound, path, item)
+				res = append(res, unwound)
+			}
+		case found && val != nil && !is_array:
+			res = append(res, doc)
+		case preserve:
+			res = append(res, doc)
+		}
+	}
+	return res, nil
+}
+
+func addFields(docs []bson.M, spec bson.D) ([]bson.M, error) {
+	res := make([]bson.M, len(docs))
+	for i, doc := range docs {
+		res[i] = copyDocument(doc)
+		for _, field := range spec {
+			val, err := evalExpression(doc, field.Value)
+			if err != nil {
+				return nil, err
+			}
+			setPath(res[i], field.Key, val)
+		}
+	}
+	return res, nil
+}
+
+func runPipeline(docs []bson.M, pipeline []bson.D) ([]bson.M, error) {
+	var err error
+	for _, stage := range pipeline {
+		op, spec := stage[0].Key, stage[0].Value
+		switch op {
+		case "$match":
+			filter, _ := spec.(bson.D)
+			docs, err = filterDocuments(docs, filter)
+		case "$sort":
+			sort_by, _ := spec.(bson.D)
+			docs = sortDocuments(append([]bson.M(nil), docs...), sort_by)
+		case "$limit":
+			limit, _ := asNumber(spec)
+			if int(limit) < len(docs) {
+				docs = docs[:int(limit)]
+			}
+		case "$skip":
+			skip, _ := asNumber(spec)
+			docs = docs[min(int(skip), len(docs)):]
+		case "$project":
+			projection, _ := spec.(bson.D)
+			docs, err = projectDocuments(docs, projection)
+		case "$addFields", "$set":
+			fields, _ := spec.(bson.D)
+			docs, err = addFields(docs, fields)
+		case "$unset":
+			fields, ok := asArray(spec)
+			if !ok {
+				fields = bson.A{spec}
+			}
+			projection := make(bson.D, 0, len(fields))
+			for _, field := range fields {
+				projection = append(projection, bson.E{Key: fmt.Sprint(field), Value: 0})
+			}
+			docs, err = projectDocuments(docs, projection)
+		case "$unwind":
+			docs, err = unwindDocuments(docs, spec)
+		case "$group":
+			group_spec, _ := spec.(bson.D)
+			docs, err = groupDocuments(docs, group_spec)
+		case "$count":
+			docs = []bson.M{{fmt.Sprint(spec): int32(len(docs))}}
+		default:
+			err = queryError(fmt.Sprintf("unsupported pipeline stage %s", op))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// 0 for vectors of different sizes or zero vectors
+func CosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, norm_a, norm_b float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		norm_a += float64(a[i]) * float64(a[i])
+		norm_b += float64(b[i]) * float64(b[i])
+	}
+	if norm_a == 0 || norm_b == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(norm_a) * math.Sqrt(norm_b))
+}
+
+var _STOP_WORDS = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true,
+	"for": true, "from": true, "has": true, "in": true, "is": true, "it": true, "its": true, "of": true,
+	"on": true, "or": true, "that": true, "the": true, "to": true, "was": true, "were": true, "will": true, "with": true,
+}
+
+// lower cases, drops stop words and does a light suffix stemming
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	tokens := make([]string, 0, len(words))
+	for _, word := range words {
+		if _STOP_WORDS[word] {
+			continue
+		}
+		tokens = append(tokens, stem(word))
+	}
+	return tokens
+}
+
+func stem(word string) string {
+	for _, suffix := range []string{"ies", "ing", "es", "ed", "s"} {
+		if len(word) > len(suffix)+2 && strings.HasSuffix(word, suffix) {
+			if suffix == "ies" {
+				return word[:len(word)-3] + "y"
+			}
+			return word[:len(word)-len(suffix)]
+		}
+	}
+	return word
+}
+
+func textValues(val any) []string {
+	switch v := val.(type) {
+	case string:
+		return []string{v}
+	}
+	if arr, ok := asArray(val); ok {
+		res := make([]string, 0, len(arr))
+		for _, item := range arr {
+			res = append(res, textValues(item)...)
+		}
+		return res
+	}
+	return nil
+}
+
+// approximates mongo's textScore: each occurrence of a term adds a decaying frequency
+// scaled by how much of the field that term covers. Fields are scored independently and added up
+func textScore(doc bson.M, fields []string, query_terms map[string]bool) float64 {
+	if len(fields) == 0 {
+		// without a text index definition all string fields are searchable
+		for key, val := range doc {
+			if len(textValues(val)) > 0 {
+				fields = append(fields, key)
+			}
+		}
+	}
+	score := 0.0
+	for _, field := range fields {
+		val, found := lookupPath(doc, field)
+		if !found {
+			continue
+		}
+		for _, text := range textValues(val) {
+			tokens := tokenize(text)
+			counts := make(map[string]int)
+			freqs := make(map[string]float64)
+			for _, token := range tokens {
+				freqs[token] += 1 / math.Pow(2, float64(counts[token]))
+				counts[token]++
+			}
+			for term := range query_terms {
+				if count, ok := counts[term]; ok {
+					coeff := (0.5 * float64(count) / float64(len(tokens))) + 0.5
+					score += freqs[term] * coeff
+				}
+			}
+		}
+	}
+	return score
+}
+
+func queryTerms(query_texts []string) map[string]bool {
+	terms := make(map[string]bool)
+	for _, text := range query_texts {
+		for _, token := range tokenize(text) {
+			terms[token] = true
+		}
+	}
+	return terms
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMatchOperators(t *testing.T) {
+	doc := bson.M{
+		"name":  "bean",
+		"count": int32(5),
+		"score": 0.5,
+		"tags":  bson.A{"ai", "go"},
+		"nested": bson.M{
+			"kind": "news",
+		},
+		"empty": nil,
+	}
+	tests := []struct {
+		filter JSON
+		match  bool
+	}{
+		{JSON{}, true},
+		{JSON{"name": "bean"}, true},
+		{JSON{"name": "sack"}, false},
+		{JSON{"nested.kind": "news"}, true},
+		{JSON{"tags": "go"}, true},
+		{JSON{"tags": bson.A{"ai", "go"}}, true},
+		{JSON{"missing": nil}, true},
+		{JSON{"empty": nil}, true},
+		{JSON{"count": JSON{"$eq": 5}}, true},
+		{JSON{"count": JSON{"$ne": 5}}, false},
+		{JSON{"count": JSON{"$gt": 4}}, true},
+		{JSON{"count": JSON{"$gte": 5, "$lt": 6}}, true},
+		{JSON{"count": JSON{"$lte": 4}}, false},
+		{JSON{"score": JSON{"$lt": 1}}, true},
+		{JSON{"missing": JSON{"$gt": 0}}, false},
+		{JSON{"tags": JSON{"$in": bson.A{"rust", "go"}}}, true},
+		{JSON{"tags": JSON{"$nin": bson.A{"rust", "go"}}}, false},
+		{JSON{"missing": JSON{"$in": bson.A{nil}}}, true},
+		{JSON{"name": JSON{"$exists": true}}, true},
+		{JSON{"missing": JSON{"$exists": true}}, false},
+		{JSON{"count": JSON{"$not": JSON{"$gt": 10}}}, true},
+		{JSON{"tags": JSON{"$size": 2}}, true},
+		{JSON{"$or": []JSON{{"name": "sack"}, {"count": 5}}}, true},
+		{JSON{"$and": []JSON{{"name": "bean"}, {"count": 6}}}, false},
+		{JSON{"$nor": []JSON{{"name": "sack"}, {"count": 6}}}, true},
+	}
+	for _, test := range tests {
+		query, err := toQuery(test.filter)
+		if err != nil {
+			t.Fatalf("%v: %v", test.filter, err)
+		}
+		matched, err := matchDocument(doc, query)
+		if err != nil {
+			t.Fatalf("%v: %v", test.filter, err)
+		}
+		if matched != test.match {
+			t.Errorf("%v: expected %v, got %v", test.filter, test.match, matched)
+		}
+	}
+}
+
+func TestMatchUnsupportedOperator(t *testing.T) {
+	query, err := toQuery(JSON{"name": JSON{"$regex": "be"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = matchDocument(bson.M{"name": "bean"}, query); err == nil {
+		t.Fatal("expected an error for an unsupported operator")
+	}
+}
+
+func TestRunPipeline(t *testing.T) {
+	docs := []bson.M{
+		{"_id": int32(1), "kind": "news", "tags": bson.A{"ai", "go"}, "count": int32(3)},
+		{"_id": int32(2), "kind": "post", "tags": bson.A{"go"}, "count": int32(1)},
+		{"_id": int32(3), "kind": "news", "tags": bson.A{"rust"}, "count": int32(2)},
+	}
+	stages, err := toPipeline([]JSON{
+		{"$match": JSON{"kind": "news"}},
+		{"$unwind": "$tags"},
+		{"$group": JSON{"_id": "$tags", "total": JSON{"$sum": "$count"}}},
+		{"$sort": bson.D{{Key: "total", Value: -1}, {Key: "_id", Value: 1}}},
+		{"$project": JSON{"tag": "$_id", "total": 1, "_id": 0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := runPipeline(docs, stages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[map[tag:ai total:3] map[tag:go total:3] map[tag:rust total:2]]"
+	if actual := fmt.Sprint(res); actual != expected {
+		t.Fatalf("expected %s, got %s", expected, actual)
+	}
+	// the stored documents stay as they were
+	if tags, _ := docs[0]["tags"].(bson.A); len(tags) != 2 {
+		t.Fatalf("pipeline modified the input: %v", docs[0])
+	}
+}
+
+func TestProjectDocument(t *testing.T) {
+	doc := bson.M{"_id": 1, "a": 2, "b": 3}
+	tests := []struct {
+		projection bson.D
+		expected   string
+	}{
+		{bson.D{{Key: "_id", Value: 1}}, "map[_id:1]"},
+		{bson.D{{Key: "_id", Value: 0}}, "map[a:2 b:3]"},
+		{bson.D{{Key: "a", Value: 1}}, "map[_id:1 a:2]"},
+		{bson.D{{Key: "a", Value: 1}, {Key: "_id", Value: 0}}, "map[a:2]"},
+		{bson.D{{Key: "a", Value: 0}}, "map[_id:1 b:3]"},
+		{bson.D{{Key: "_id", Value: 1}, {Key: "a", Value: 0}}, "map[_id:1 b:3]"},
+	}
+	for _, test := range tests {
+		projected, err := projectDocument(doc, test.projection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := fmt.Sprint(projected); actual != test.expected {
+			t.Errorf("%v: expected %s, got %s", test.projection, test.expected, actual)
+		}
+	}
+}
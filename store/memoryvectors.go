@@ -0,0 +1,187 @@
+package store
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/soumitsalman/beansack/ann"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// the memory and file backends pick the kind of their vector indexes with ?vector_index=flat|hnsw in the connection string.
+// Default is flat which is exact like the brute force search
+const (
+	_FLAT_VECTOR_INDEX = "flat"
+	_HNSW_VECTOR_INDEX = "hnsw"
+)
+
+// vectorIndex is an in-process index of one vector field and the documents that it has vectors for
+type vectorIndex struct {
+	vec_path string
+	index    ann.Index
+	docs     map[string]bson.M // by uniqueKey of _id
+}
+
+func vectorIndexKind(connection_string string) string {
+	_, query, _ := strings.Cut(connection_string, "?")
+	values, _ := url.ParseQuery(query)
+	if values.Get("vector_index") == _HNSW_VECTOR_INDEX {
+		return _HNSW_VECTOR_INDEX
+	}
+	return _FLAT_VECTOR_INDEX
+}
+
+func newANNIndex(kind string, dimensions int) ann.Index {
+	if kind == _HNSW_VECTOR_INDEX {
+		return ann.NewHNSW(dimensions, ann.HNSWConfig{})
+	}
+	return ann.NewFlat(dimensions)
+}
+
+// creates the index of the vector field from the stored documents unless it exists with the same dimensions.
+// The file backend loads the saved index if it is still in line with the documents.
+// Without the dimensions there is no index and the search stays brute force. Call it with the lock held
+func (backend *memoryBackend) setVectorIndex(vec_path string, dimensions int) {
+	if dimensions <= 0 {
+		return
+	}
+	if existing, ok := backend.vector_indexes[vec_path]; ok && existing.index.Dimensions() == dimensions {
+		return
+	}
+	index := &vectorIndex{vec_path: vec_path, docs: make(map[string]bson.M)}
+	for _, doc := range backend.docs {
+		if vec, ok := docVector(doc, vec_path); ok && len(vec) == dimensions {
+			index.docs[uniqueKey(doc, []string{"_id"})] = doc
+		}
+	}
+	index.index = backend.loadVectorIndex(vec_path, dimensions, index.docs)
+	if index.index == nil {
+		index.index = newANNIndex(backend.vector_index_kind, dimensions)
+		for key, doc := range index.docs {
+			vec, _ := docVector(doc, vec_path)
+			index.index.Add(key, vec)
+		}
+		if backend.index_path != nil {
+			if err := ann.SaveFile(index.index, backend.index_path(vec_path)); err != nil {
+				log.Printf("[%s]: Couldn't save the vector index of %s. %v\n", backend.name, vec_path, err)
+			}
+		}
+	}
+	if backend.vector_indexes == nil {
+		backend.vector_indexes = make(map[string]*vectorIndex)
+	}
+	backend.vector_indexes[vec_path] = index
+}
+
+// nil if there is no saved index or it doesn't have the same ids as the documents
+func (backend *memoryBackend) loadVectorIndex(vec_path string, dimensions int, docs map[string]bson.M) ann.Index {
+	if backend.index_path == nil {
+		return nil
+	}
+	index, err := ann.LoadFile(backend.index_path(vec_path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		log.Printf("[%s]: Couldn't load the vector index of %s. Rebuilding it. %v\n", backend.name, vec_path, err)
+		return nil
+	}
+	_, is_hnsw := index.(*ann.HNSW)
+	if index.Dimensions() != dimensions || index.Len() != len(docs) || is_hnsw != (backend.vector_index_kind == _HNSW_VECTOR_INDEX) {
+		return nil
+	}
+	for key := range docs {
+		if !index.Contains(key) {
+			return nil
+		}
+	}
+	return index
+}
+
+// keeps the vector indexes in line with a write. before is nil for inserts and after is nil for deletes. Call it with the lock held
+func (backend *memoryBackend) reindex(before, after bson.M) {
+	for _, index := range backend.vector_indexes {
+		if before != nil && after != nil && sameVector(before, after, index.vec_path) {
+			// most updates don't touch the vector. HNSW would leave a removed node behind for each of them
+			key := uniqueKey(before, []string{"_id"})
+			if _, ok := index.docs[key]; ok {
+				index.docs[key] = after
+			}
+			continue
+		}
+		if before != nil {
+			key := uniqueKey(before, []string{"_id"})
+			delete(index.docs, key)
+			index.index.Remove(key)
+		}
+		if after != nil {
+			vec, ok := docVector(after, index.vec_path)
+			if ok && len(vec) == index.index.Dimensions() {
+				key := uniqueKey(after, []string{"_id"})
+				index.docs[key] = after
+				index.index.Add(key, vec)
+			}
+		}
+	}
+}
+
+// saves the vector indexes of the file backend. They are only saved on close and get rebuilt if they are out of date. Call it with the lock held
+func (backend *memoryBackend) saveVectorIndexes() error {
+	if backend.index_path == nil {
+		return nil
+	}
+	var errs []error
+	for vec_path, index := range backend.vector_indexes {
+		errs = append(errs, ann.SaveFile(index.index, backend.index_path(vec_path)))
+	}
+	return errors.Join(errs...)
+}
+
+// the nearest documents that pass the filter with their search score. false if there is no index for the query
+func (backend *memoryBackend) searchVectorIndex(query_embedding []float32, vec_path string, filter JSON, top_n int) ([]bson.M, bool, error) {
+	query, err := toQuery(filter)
+	if err != nil {
+		return nil, false, err
+	}
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
+	index, ok := backend.vector_indexes[vec_path]
+	if !ok || index.index.Dimensions() != len(query_embedding) {
+		return nil, false, nil
+	}
+	var accept func(id string) bool
+	if len(query) > 0 {
+		accept = func(id string) bool {
+			matched, err := matchDocument(index.docs[id], query)
+			return err == nil && matched
+		}
+	}
+	results := index.index.Search(query_embedding, top_n, accept)
+	docs := make([]bson.M, 0, len(results))
+	for _, result := range results {
+		doc := copyDocument(index.docs[result.ID])
+		doc[_SEARCH_SCORE] = result.Score
+		docs = append(docs, doc)
+	}
+	return docs, true, nil
+}
+
+func sameVector(before, after bson.M, vec_path string) bool {
+	if uniqueKey(before, []string{"_id"}) != uniqueKey(after, []string{"_id"}) {
+		return false
+	}
+	before_vec, before_ok := docVector(before, vec_path)
+	after_vec, after_ok := docVector(after, vec_path)
+	return before_ok == after_ok && slices.Equal(before_vec, after_vec)
+}
+
+func docVector(doc bson.M, vec_path string) ([]float32, bool) {
+	val, found := lookupPath(doc, vec_path)
+	if !found {
+		return nil, false
+	}
+	return asVector(val)
+}
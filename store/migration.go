@@ -0,0 +1,193 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	_SCHEMA_VERSIONS      = "schema_versions"
+	_MIGRATION_BATCH_SIZE = 100
+)
+
+// Migration changes the stored documents of a collection from the previous version to Version.
+// The documents are migrated in the order of their _id and the progress is recorded after each batch
+// so that a migration that got interrupted resumes after the last migrated document
+type Migration struct {
+	Version     int
+	Description string
+	Filter      JSON // documents that the migration applies to. nil for all of them
+	// returns the new version of the document or nil if it doesn't need to change.
+	// The new version replaces the stored document as a whole so removing a field from doc removes it from the store
+	Migrate func(doc bson.M) (bson.M, error)
+}
+
+// SchemaVersion is the record of the migrations applied to a collection
+type SchemaVersion struct {
+	Collection string `bson:"_id"`
+	Version    int    `bson:"version"`
+	// migration that got interrupted and the _id of the last document it migrated
+	Pending int   `bson:"pending,omitempty"`
+	LastID  any   `bson:"last_id,omitempty"`
+	Updated int64 `bson:"updated"`
+}
+
+type MigrationResult struct {
+	Version     int
+	Description string
+	Resumed     bool // continued after the last document of an interrupted run
+	Scanned     int  // documents that matched the filter
+	Changed     int  // documents that the migration changed. In a dry run these are the ones that would change
+}
+
+type MigrationReport struct {
+	Collection string
+	From       int // schema version before the run
+	To         int // schema version after the run. Dry runs don't change the version
+	DryRun     bool
+	Applied    []MigrationResult
+}
+
+// Creates the store for the schema versions of the collections in the database
+func NewSchemaVersionStore(connection_string, database string) *Store[SchemaVersion] {
+	return NewSchemaVersionStoreForTenant(connection_string, database, Tenant{})
+}
+
+// Same as NewSchemaVersionStore but the versions are the tenant's so that migrating one tenant leaves the others as they are
+func NewSchemaVersionStoreForTenant(connection_string, database string, tenant Tenant) *Store[SchemaVersion] {
+	return NewForTenant(connection_string, database, _SCHEMA_VERSIONS, tenant,
+		WithDataIDAndEqualsFunction(
+			func(data *SchemaVersion) JSON { return JSON{"_id": data.Collection} },
+			func(a, b *SchemaVersion) bool { return a.Collection == b.Collection }),
+		// saving a version writes over the existing record
+		WithWritePolicy[SchemaVersion](ReplaceExisting))
+}
+
+// Applies the migrations newer than the schema version recorded in versions, in the order of their versions.
+// The version gets recorded after each migration so a failure stops the run at the last migration that finished.
+// A dry run goes through the documents without changing them or the version. Since nothing gets written,
+// a migration in a dry run sees the documents as they were before the earlier migrations
+func (store *Store[T]) Migrate(ctx context.Context, versions *Store[SchemaVersion], migrations []Migration, dry_run bool) (MigrationReport, error) {
+	report := MigrationReport{Collection: store.name, DryRun: dry_run}
+	migrations = append([]Migration(nil), migrations...)
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, migration := range migrations {
+		if migration.Version <= 0 || (i > 0 && migration.Version == migrations[i-1].Version) || migration.Migrate == nil {
+			return report, StoreError(fmt.Sprintf("invalid migration %d for %s", migration.Version, store.name))
+		}
+	}
+
+	record, err := store.schemaVersion(ctx, versions)
+	if err != nil {
+		return report, err
+	}
+	report.From, report.To = record.Version, record.Version
+	for _, migration := range migrations {
+		if migration.Version <= record.Version {
+			continue
+		}
+		result, err := store.runMigration(ctx, versions, &record, migration, dry_run)
+		report.Applied = append(report.Applied, result)
+		if err != nil {
+			log.Printf("[%s]: Migration %d failed. %v\n", store.name, migration.Version, err)
+			return report, err
+		}
+		log.Printf("[%s]: Migration %d (%s) changed %d of %d documents. Dry run: %t\n", store.name, migration.Version, migration.Description, result.Changed, result.Scanned, dry_run)
+		if !dry_run {
+			record = SchemaVersion{Collection: store.name, Version: migration.Version}
+			if err = store.saveSchemaVersion(ctx, versions, record); err != nil {
+				return report, err
+			}
+			report.To = migration.Version
+		}
+	}
+	return report, nil
+}
+
+func (store *Store[T]) runMigration(ctx context.Context, versions *Store[SchemaVersion], record *SchemaVersion, migration Migration, dry_run bool) (MigrationResult, error) {
+	result := MigrationResult{Version: migration.Version, Description: migration.Description}
+	filter := migration.Filter
+	if record.Pending == migration.Version && record.LastID != nil {
+		result.Resumed = true
+		filter = JSON{"$and": []JSON{filterOrAll(filter), {"_id": JSON{"$gt": record.LastID}}}}
+	}
+	raws, err := store.iterateRaw(ctx, filter, nil, JSON{"_id": 1}, -1)
+	if err != nil {
+		return result, err
+	}
+	defer raws.Close(ctx)
+
+	batch := make([]any, 0, _MIGRATION_BATCH_SIZE)
+	ids := make([]JSON, 0, _MIGRATION_BATCH_SIZE)
+	var last_id any
+	// writes the batch and records the progress
+	flush := func() error {
+		if !dry_run && len(batch) > 0 {
+			if _, err := store.backend.Replace(ctx, batch, ids); err != nil {
+				return err
+			}
+		}
+		result.Changed += len(batch)
+		if !dry_run && last_id != nil {
+			*record = SchemaVersion{Collection: store.name, Version: record.Version, Pending: migration.Version, LastID: last_id}
+			if err := store.saveSchemaVersion(ctx, versions, *record); err != nil {
+				return err
+			}
+		}
+		batch, ids = batch[:0], ids[:0]
+		return nil
+	}
+	for raws.Next(ctx) {
+		var doc bson.M
+		if err = bson.Unmarshal(raws.Current(), &doc); err != nil {
+			return result, err
+		}
+		result.Scanned++
+		migrated, err := migration.Migrate(copyDocument(doc))
+		if err != nil {
+			return result, fmt.Errorf("document %v: %w", doc["_id"], err)
+		}
+		if migrated != nil {
+			migrated["_id"] = doc["_id"]
+			batch = append(batch, migrated)
+			ids = append(ids, JSON{"_id": doc["_id"]})
+		}
+		last_id = doc["_id"]
+		if result.Scanned%_MIGRATION_BATCH_SIZE == 0 {
+			if err = flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err = raws.Err(); err != nil {
+		return result, err
+	}
+	return result, flush()
+}
+
+// version 0 if there is no record
+func (store *Store[T]) schemaVersion(ctx context.Context, versions *Store[SchemaVersion]) (SchemaVersion, error) {
+	records, err := versions.Get(ctx, JSON{"_id": store.name}, nil, nil, 1)
+	if err != nil || len(records) == 0 {
+		return SchemaVersion{Collection: store.name}, err
+	}
+	return records[0], nil
+}
+
+func (store *Store[T]) saveSchemaVersion(ctx context.Context, versions *Store[SchemaVersion], record SchemaVersion) error {
+	record.Updated = time.Now().Unix()
+	_, err := versions.Add(ctx, []SchemaVersion{record})
+	return err
+}
+
+func filterOrAll(filter JSON) JSON {
+	if filter == nil {
+		return JSON{}
+	}
+	return filter
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	versions := NewSchemaVersionStore("memory://"+t.Name(), "test")
+	addItems(t, store, testItem{ID: "a", Rank: 1}, testItem{ID: "b", Rank: 2})
+	migrations := []Migration{
+		{Version: 2, Description: "double", Migrate: func(doc bson.M) (bson.M, error) {
+			rank, _ := asNumber(doc["rank"])
+			doc["rank"] = int(rank) * 2
+			return doc, nil
+		}},
+		{Version: 1, Description: "title", Filter: JSON{"rank": 1}, Migrate: func(doc bson.M) (bson.M, error) {
+			doc["title"] = "first"
+			return doc, nil
+		}},
+	}
+
+	dry, err := store.Migrate(ctx, versions, migrations, true)
+	if err != nil || dry.To != 0 || len(dry.Applied) != 2 || dry.Applied[0].Changed != 1 {
+		t.Fatalf("unexpected dry run %+v %v", dry, err)
+	}
+	if items, _ := store.Get(ctx, JSON{"title": "first"}, nil, nil, -1); len(items) != 0 {
+		t.Fatal("the dry run changed the items")
+	}
+
+	report, err := store.Migrate(ctx, versions, migrations, false)
+	if err != nil || report.From != 0 || report.To != 2 {
+		t.Fatalf("unexpected report %+v %v", report, err)
+	}
+	items, _ := store.Get(ctx, JSON{}, nil, JSON{"_id": 1}, -1)
+	if len(items) != 2 || items[0].Title != "first" || items[0].Rank != 2 || items[1].Rank != 4 {
+		t.Fatalf("unexpected items after the migrations %v", items)
+	}
+
+	// the applied migrations don't run again
+	report, err = store.Migrate(ctx, versions, migrations, false)
+	if err != nil || report.From != 2 || len(report.Applied) != 0 {
+		t.Fatalf("unexpected second run %+v %v", report, err)
+	}
+}
+
+func TestMigrateResumes(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	versions := NewSchemaVersionStore("memory://"+t.Name(), "test")
+	count := _MIGRATION_BATCH_SIZE*2 + 10
+	items := make([]testItem, count)
+	for i := range items {
+		items[i] = testItem{ID: fmt.Sprintf("%04d", i), Rank: 1}
+	}
+	addItems(t, store, items...)
+
+	migrated := make(map[any]int)
+	fail_at := _MIGRATION_BATCH_SIZE + 5
+	migration := Migration{Version: 1, Migrate: func(doc bson.M) (bson.M, error) {
+		if len(migrated) == fail_at {
+			return nil, StoreError("interrupted")
+		}
+		migrated[doc["_id"]]++
+		doc["rank"] = 2
+		return doc, nil
+	}}
+	if _, err := store.Migrate(ctx, versions, []Migration{migration}, false); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+	record, err := store.schemaVersion(ctx, versions)
+	if err != nil || record.Version != 0 || record.Pending != 1 || record.LastID != items[_MIGRATION_BATCH_SIZE-1].ID {
+		t.Fatalf("expected the progress of the first batch, got %+v %v", record, err)
+	}
+
+	// the second run picks up after the last batch that got written
+	fail_at = -1
+	report, err := store.Migrate(ctx, versions, []Migration{migration}, false)
+	if err != nil || report.To != 1 || !report.Applied[0].Resumed || report.Applied[0].Scanned != count-_MIGRATION_BATCH_SIZE {
+		t.Fatalf("unexpected resumed run %+v %v", report, err)
+	}
+	for i, item := range items {
+		// the items of the batch that didn't get written run again
+		expected := 1
+		if i >= _MIGRATION_BATCH_SIZE && i < _MIGRATION_BATCH_SIZE+5 {
+			expected = 2
+		}
+		if runs := migrated[item.ID]; runs != expected {
+			t.Fatalf("%s got migrated %d times instead of %d", item.ID, runs, expected)
+		}
+	}
+	if stale, _ := store.Get(ctx, JSON{"rank": 1}, nil, nil, -1); len(stale) != 0 {
+		t.Fatalf("%d items didn't get migrated", len(stale))
+	}
+}
+
+func TestMigrateInvalid(t *testing.T) {
+	store := newTestStore(t)
+	versions := NewSchemaVersionStore("memory://"+t.Name(), "test")
+	noop := func(doc bson.M) (bson.M, error) { return nil, nil }
+	for _, migrations := range [][]Migration{
+		{{Version: 0, Migrate: noop}},
+		{{Version: 1, Migrate: noop}, {Version: 1, Migrate: noop}},
+		{{Version: 1}},
+	} {
+		if _, err := store.Migrate(context.Background(), versions, migrations, false); err == nil {
+			t.Errorf("expected an error for %+v", migrations)
+		}
+	}
+}
+
+func TestMigrateTenants(t *testing.T) {
+	ctx := context.Background()
+	connection_string := "memory://" + t.Name()
+	stores := make(map[string]*Store[testItem])
+	versions := make(map[string]*Store[SchemaVersion])
+	for _, name := range []string{"first", "second"} {
+		tenant := Tenant{Name: name, Field: "tenant"}
+		stores[name] = NewForTenant(connection_string, "test", "items", tenant,
+			WithDataIDAndEqualsFunction(
+				func(item *testItem) JSON { return JSON{"_id": item.ID} },
+				func(a, b *testItem) bool { return a.ID == b.ID }))
+		versions[name] = NewSchemaVersionStoreForTenant(connection_string, "test", tenant)
+		addItems(t, stores[name], testItem{ID: name, Rank: 1})
+	}
+	migration := Migration{Version: 1, Migrate: func(doc bson.M) (bson.M, error) {
+		doc["rank"] = 2
+		return doc, nil
+	}}
+	if _, err := stores["first"].Migrate(ctx, versions["first"], []Migration{migration}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if records, _ := versions["second"].Get(ctx, JSON{}, nil, nil, -1); len(records) != 0 {
+		t.Fatalf("the other tenant sees the versions of the first one %v", records)
+	}
+	record, err := stores["second"].schemaVersion(ctx, versions["second"])
+	if err != nil || record.Version != 0 {
+		t.Fatalf("expected the other tenant to stay at version 0, got %+v %v", record, err)
+	}
+	report, err := stores["second"].Migrate(ctx, versions["second"], []Migration{migration}, false)
+	if err != nil || report.From != 0 || report.To != 1 {
+		t.Fatalf("expected the other tenant to get migrated, got %+v %v", report, err)
+	}
+	if items, _ := stores["second"].Get(ctx, JSON{}, nil, nil, -1); len(items) != 1 || items[0].Rank != 2 {
+		t.Fatalf("unexpected items of the other tenant %v", items)
+	}
+}
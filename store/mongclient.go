@@ -1,119 +1,344 @@
 package store
 
 import (
-	ctx "context"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/sync/errgroup"
 
 	datautils "github.com/soumitsalman/data-utils"
 )
 
 const (
 	_UPDATE_BATCH_SIZE = 95 // batch size of 90 seems to be working. It occationally fails for 99
+	// query embeddings per aggregation of a batched vector search. Each one is a sub-pipeline with the whole vector in it
+	_VECTOR_SEARCH_BATCH_SIZE = 50
+	_QUERY_INDEX              = "_query" // tags the results of a batched vector search with the position of their query
+	// vector search aggregations that a batched vector search runs at once when it can't put them in one aggregation
+	_MAX_CONCURRENT_SEARCHES = 8
 )
 
-type JSON map[string]any
+func init() {
+	RegisterBackend("mongodb", newMongoBackend)
+	RegisterBackend("mongodb+srv", newMongoBackend)
+}
 
-type Store[T any] struct {
-	name       string
-	collection *mongo.Collection
-	get_id     func(data *T) JSON
-	equals     func(a, b *T) bool
+// connection pool settings of the mongo client. Zero values leave the driver defaults in place
+type PoolConfig struct {
+	MaxPoolSize     uint64        // max number of connections per server. Driver default is 100
+	MinPoolSize     uint64        // number of idle connections kept open per server
+	MaxConnecting   uint64        // max number of connections being established at the same time per server
+	MaxConnIdleTime time.Duration // idle connections are closed after this
 }
 
-func New[T any](connection_string, database, collection string, opts ...StoreOption[T]) *Store[T] {
-	store := newStore[T](connection_string, database, collection)
-	if store == nil {
-		return nil
-	}
-	// // assign defaults
-	// store.search_min_score = _DEFAULT_SEARCH_MIN_SCORE
-	// store.search_top_n = _DEFAULT_SEARCH_TOP_N
+// stores on the same connection string share one mongo client and its connection pool.
+// The client gets disconnected when the last backend using it is closed
+type sharedClient struct {
+	client *mongo.Client
+	refs   int
+}
+
+var mongo_clients = struct {
+	sync.Mutex
+	pool_configs map[string]PoolConfig
+	items        map[string]*sharedClient
+}{pool_configs: make(map[string]PoolConfig), items: make(map[string]*sharedClient)}
+
+// Sets the pool config for the client of the connection string. It applies to clients created afterwards
+// so it needs to be called before the first store on that connection string is opened
+func ConfigurePool(connection_string string, config PoolConfig) {
+	mongo_clients.Lock()
+	defer mongo_clients.Unlock()
+	mongo_clients.pool_configs[connection_string] = config
+}
+
+type mongoBackend struct {
+	name              string
+	connection_string string
+	collection        *mongo.Collection
+	dialect           VectorSearchDialect
+	vector_indexes    map[string]string // vector field -> name of the vector index
+	close_once        sync.Once
+	// whether the deployment runs transactions. nil until the first transaction finds out
+	transactions      *bool
+	transactions_lock sync.Mutex
+	// the server failed the $unionWith of a batched vector search in the current dialect
+	union_rejected atomic.Bool
+}
 
-	// apply options
-	for _, opt := range opts {
-		opt(store)
+func newMongoBackend(connection_string, database, collection string) (Backend, error) {
+	client, err := acquireMongoClient(connection_string)
+	if err != nil {
+		return nil, err
 	}
-	return store
+	return &mongoBackend{
+		name:              fmt.Sprintf("%s/%s", database, collection),
+		connection_string: connection_string,
+		collection:        client.Database(database).Collection(collection),
+		dialect:           detectVectorSearchDialect(connection_string),
+		vector_indexes:    make(map[string]string),
+	}, nil
 }
 
-func newStore[T any](connection_string, database, collection string) *Store[T] {
-	client := createMongoClient(connection_string)
-	if client == nil {
-		return nil
+// releases the backend's hold on the shared client. Closing more than once is a no-op
+func (backend *mongoBackend) Close(ctx context.Context) error {
+	var err error
+	backend.close_once.Do(func() {
+		err = releaseMongoClient(ctx, backend.connection_string)
+	})
+	return err
+}
+
+func (backend *mongoBackend) SetVectorSearchDialect(dialect VectorSearchDialect) {
+	backend.dialect = dialect
+	backend.union_rejected.Store(false)
+}
+
+// only atlas indexes the bson binary vectors. Cosmos and the exact search skip them
+func (backend *mongoBackend) SearchesQuantizedVectors() bool {
+	_, ok := backend.dialect.(atlasVectorSearch)
+	return ok
+}
+
+func (backend *mongoBackend) SetVectorIndex(vec_path, index_name string) {
+	backend.vector_indexes[vec_path] = index_name
+}
+
+// the insertion is unordered so one failed doc doesn't stop the rest
+func (backend *mongoBackend) Add(ctx context.Context, docs []any) (InsertResult, error) {
+	_, err := backend.collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return InsertResult{Inserted: positions(len(docs))}, nil
 	}
-	db := client.Database(database)
-	if db == nil {
-		return nil
+	var write_err mongo.BulkWriteException
+	if !errors.As(err, &write_err) {
+		// nothing is known about which docs made it
+		return InsertResult{Failed: positions(len(docs))}, err
 	}
-	col_client := db.Collection(collection)
-	if col_client == nil {
-		return nil
+	// classify the docs by their write errors. The rest got inserted
+	var res InsertResult
+	var errs []error
+	failed := make(map[int]bool, len(write_err.WriteErrors))
+	for _, doc_err := range write_err.WriteErrors {
+		failed[doc_err.Index] = true
+		if mongo.IsDuplicateKeyError(doc_err.WriteError) {
+			res.Duplicates = append(res.Duplicates, doc_err.Index)
+		} else {
+			res.Failed = append(res.Failed, doc_err.Index)
+			errs = append(errs, doc_err.WriteError)
+		}
+	}
+	for i := range docs {
+		if !failed[i] {
+			res.Inserted = append(res.Inserted, i)
+		}
 	}
-	return &Store[T]{
-		name:       fmt.Sprintf("%s/%s", database, collection),
-		collection: col_client,
+	if write_err.WriteConcernError != nil {
+		errs = append(errs, write_err.WriteConcernError)
+	}
+	return res, errors.Join(errs...)
+}
+
+func (backend *mongoBackend) Update(ctx context.Context, docs []any, filters []JSON) (UpdateResult, error) {
+	// create batch
+	updates := make([]mongo.WriteModel, len(docs))
+	for i := range docs {
+		updates[i] = mongo.NewUpdateOneModel().
+			SetFilter(filters[i]).
+			SetUpdate(JSON{"$set": docs[i]})
 	}
+	return backend.bulkWrite(ctx, updates, filters)
 }
 
-func (store *Store[T]) Add(docs []T) ([]T, error) {
-	// this is done for error handling for mongo db
-	if len(docs) == 0 {
-		log.Printf("[%s]: Empty list of docs, nothing to insert.\n", store.name)
-		return nil, nil
+func (backend *mongoBackend) Replace(ctx context.Context, docs []any, filters []JSON) (UpdateResult, error) {
+	replacements := make([]mongo.WriteModel, len(docs))
+	for i := range docs {
+		replacements[i] = mongo.NewReplaceOneModel().
+			SetFilter(filters[i]).
+			SetReplacement(docs[i])
 	}
+	return backend.bulkWrite(ctx, replacements, filters)
+}
 
-	// don't insert if it already exists
-	// if there is no id function then treat each item as unique
-	if store.get_id != nil && store.equals != nil {
-		existing_items := store.Get(JSON{"$or": store.getIDs(docs)}, nil, nil, -1)
-		docs = datautils.Filter(docs, func(item *T) bool {
-			return !datautils.In(*item, existing_items, store.equals)
-		})
-		// if these  docs already exist just return without error
-		if len(docs) == 0 {
-			log.Printf("[%s]: Docs already exists, nothing new to insert.\n", store.name)
-			return nil, nil
+// runs the writes in batches because bulk write cannot handle a big batch.
+// The writes are unordered so a failed doc doesn't stop the rest of its batch
+func (backend *mongoBackend) bulkWrite(ctx context.Context, writes []mongo.WriteModel, filters []JSON) (UpdateResult, error) {
+	var res UpdateResult
+	bulk_options := options.BulkWrite().SetOrdered(false)
+	for i := 0; i < len(writes); i += _UPDATE_BATCH_SIZE {
+		batch := datautils.SafeSlice(writes, i, i+_UPDATE_BATCH_SIZE)
+		// stop sending the rest of the batches if the caller is gone
+		if err := ctx.Err(); err != nil {
+			for j := i; j < len(writes); j++ {
+				res.fail(j, err)
+			}
+			break
+		}
+		batch_res, err := backend.collection.BulkWrite(ctx, batch, bulk_options)
+		if batch_res != nil {
+			res.Matched += int(batch_res.MatchedCount)
+			res.Modified += int(batch_res.ModifiedCount)
+		}
+		if err == nil {
+			continue
+		}
+		log.Printf("[%s]: Write failed for docs[%d] - docs[%d]. %v\n", backend.name, i, i+len(batch), err)
+		log.Println(datautils.ToJsonString(filters[i : i+len(batch)]))
+		var write_err mongo.BulkWriteException
+		if !errors.As(err, &write_err) || len(write_err.WriteErrors) == 0 {
+			// nothing is known about which docs made it
+			for j := range batch {
+				res.fail(i+j, err)
+			}
+			continue
+		}
+		// the indexes of the write errors are positions in the batch
+		for _, doc_err := range write_err.WriteErrors {
+			res.fail(i+doc_err.Index, doc_err.WriteError)
 		}
 	}
+	return res, res.Err()
+}
+
+// wrapper over mongodb get
+func (backend *mongoBackend) Get(ctx context.Context, filter JSON, fields JSON, sort_by JSON, top_n int) ([]bson.Raw, error) {
+	cursor, err := backend.collection.Find(ctx, filter, createFindOptions(fields, sort_by, top_n))
+	return extractFromCursor(ctx, cursor, err)
+}
 
-	res, err := store.collection.InsertMany(ctx.Background(), datautils.Transform(docs, func(item *T) any { return *item }))
+func (backend *mongoBackend) Aggregate(ctx context.Context, pipeline any) ([]bson.Raw, error) {
+	cursor, err := backend.collection.Aggregate(ctx, pipeline)
+	return extractFromCursor(ctx, cursor, err)
+}
+
+func (backend *mongoBackend) StreamGet(ctx context.Context, filter JSON, fields JSON, sort_by JSON, top_n int) (RawIterator, error) {
+	find_options := createFindOptions(fields, sort_by, top_n).SetBatchSize(_CURSOR_BATCH_SIZE)
+	cursor, err := backend.collection.Find(ctx, filter, find_options)
 	if err != nil {
-		log.Printf("[%s]: Insertion failed. %v\n", store.name, err)
 		return nil, err
 	}
-	log.Printf("[%s]: %d items inserted.\n", store.name, len(res.InsertedIDs))
-	return docs, nil
+	return cursorIterator{cursor: cursor}, nil
 }
 
-// docs is an array of any struct that is bson serializable
-func (store *Store[T]) Update(docs []any, filters []JSON) {
-	// create batch
-	updates := make([]mongo.WriteModel, len(docs))
-	for i := range docs {
-		updates[i] = mongo.NewUpdateOneModel().
-			SetFilter(filters[i]).
-			SetUpdate(JSON{"$set": docs[i]})
+func (backend *mongoBackend) StreamAggregate(ctx context.Context, pipeline any) (RawIterator, error) {
+	cursor, err := backend.collection.Aggregate(ctx, pipeline, options.Aggregate().SetBatchSize(_CURSOR_BATCH_SIZE))
+	if err != nil {
+		return nil, err
+	}
+	return cursorIterator{cursor: cursor}, nil
+}
+
+// regular keyword/text search
+func (backend *mongoBackend) TextSearch(ctx context.Context, query_texts []string, params *SearchParams) ([]bson.Raw, error) {
+	return backend.Aggregate(ctx, createTextSearchPipeline(query_texts, params))
+}
+
+func (backend *mongoBackend) VectorSearch(ctx context.Context, query_embedding []float32, vec_path string, params *SearchParams) ([]bson.Raw, error) {
+	return backend.Aggregate(ctx, createVectorSearchPipeline(backend.dialect, query_embedding, vec_path, backend.vector_indexes[vec_path], params))
+}
+
+// Runs the search of each query embedding as a $unionWith sub-pipeline of one aggregation and splits the results by their query.
+// Cosmos doesn't run $search in a sub-pipeline and atlas needs MongoDB 8.0 or later for $vectorSearch in one.
+// For cosmos and for the servers that reject the union the searches run as separate aggregations, a few at a time
+func (backend *mongoBackend) BatchVectorSearch(ctx context.Context, query_embeddings [][]float32, vec_path string, params *SearchParams) ([][]bson.Raw, error) {
+	results := make([][]bson.Raw, len(query_embeddings))
+	if isCosmos(backend.dialect) || backend.union_rejected.Load() {
+		return results, backend.searchEach(ctx, query_embeddings, 0, vec_path, params, results)
 	}
-	// run in batches because bulk write cannot handle a big batch
-	err_count := 0
-	for i := 0; i < len(updates); i += _UPDATE_BATCH_SIZE {
-		batch := datautils.SafeSlice(updates, i, i+_UPDATE_BATCH_SIZE)
-		_, err := store.collection.BulkWrite(ctx.Background(), batch)
+	for start := 0; start < len(query_embeddings); start += _VECTOR_SEARCH_BATCH_SIZE {
+		batch := datautils.SafeSlice(query_embeddings, start, start+_VECTOR_SEARCH_BATCH_SIZE)
+		err := backend.unionSearch(ctx, batch, start, vec_path, params, results)
+		var server_err mongo.ServerError
+		if len(batch) > 1 && errors.As(err, &server_err) {
+			// the server might not take the search in a sub-pipeline. If the searches work on their own it doesn't and the rest skip the union
+			if err = backend.searchEach(ctx, batch, start, vec_path, params, results); err == nil {
+				log.Printf("[%s]: Batched vector search is not supported. Running the searches separately. %v\n", backend.name, server_err)
+				backend.union_rejected.Store(true)
+				return results, backend.searchEach(ctx, query_embeddings[start+len(batch):], start+len(batch), vec_path, params, results)
+			}
+		}
 		if err != nil {
-			log.Printf("[%s]: Update failed for docs[%d] - docs[%d]. %v\n", store.name, i, i+len(updates), err)
-			log.Println(datautils.ToJsonString(filters[i : i+len(batch)]))
-			err_count += _UPDATE_BATCH_SIZE
+			return nil, err
 		}
 	}
-	log.Printf("[%s]: %d items updated.\n", store.name, len(updates)-err_count)
+	return results, nil
 }
 
-// wrapper over mongodb get
-func (store *Store[T]) Get(filter JSON, fields JSON, sort_by JSON, top_n int) []T {
+// runs the searches of the batch in one aggregation and puts the results of batch[i] in results[start+i]
+func (backend *mongoBackend) unionSearch(ctx context.Context, batch [][]float32, start int, vec_path string, params *SearchParams, results [][]bson.Raw) error {
+	var pipeline []JSON
+	for i, vec := range batch {
+		search := append(
+			createVectorSearchPipeline(backend.dialect, vec, vec_path, backend.vector_indexes[vec_path], params),
+			JSON{"$addFields": JSON{_QUERY_INDEX: start + i}})
+		if i == 0 {
+			pipeline = search
+			continue
+		}
+		pipeline = append(pipeline, JSON{"$unionWith": JSON{"coll": backend.collection.Name(), "pipeline": search}})
+	}
+	raws, err := backend.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	for _, raw := range raws {
+		var doc bson.D
+		if err = bson.Unmarshal(raw, &doc); err != nil {
+			return err
+		}
+		query := -1
+		for j, elem := range doc {
+			if elem.Key == _QUERY_INDEX {
+				num, _ := asNumber(elem.Value)
+				query = int(num)
+				doc = append(doc[:j], doc[j+1:]...)
+				break
+			}
+		}
+		if query < start || query >= start+len(batch) {
+			continue
+		}
+		if raw, err = bson.Marshal(doc); err != nil {
+			return err
+		}
+		results[query] = append(results[query], raw)
+	}
+	return nil
+}
+
+// runs the search of each query embedding as its own aggregation with at most _MAX_CONCURRENT_SEARCHES at a time.
+// The results of query_embeddings[i] go in results[start+i]
+func (backend *mongoBackend) searchEach(ctx context.Context, query_embeddings [][]float32, start int, vec_path string, params *SearchParams, results [][]bson.Raw) error {
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(_MAX_CONCURRENT_SEARCHES)
+	for i, vec := range query_embeddings {
+		group.Go(func() error {
+			raws, err := backend.VectorSearch(ctx, vec, vec_path, params)
+			results[start+i] = raws
+			return err
+		})
+	}
+	return group.Wait()
+}
+
+func (backend *mongoBackend) Delete(ctx context.Context, filter JSON) (int, error) {
+	res, err := backend.collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+func createFindOptions(fields JSON, sort_by JSON, top_n int) *options.FindOptions {
 	find_options := options.Find()
 	if len(fields) > 0 {
 		find_options = find_options.SetProjection(fields)
@@ -124,82 +349,132 @@ func (store *Store[T]) Get(filter JSON, fields JSON, sort_by JSON, top_n int) []
 	if top_n > 0 {
 		find_options = find_options.SetLimit(int64(top_n))
 	}
-	return store.extractFromCursor(store.collection.Find(ctx.Background(), filter, find_options))
+	return find_options
 }
 
-func (store *Store[T]) Aggregate(pipeline any) []T {
-	return store.extractFromCursor(store.collection.Aggregate(ctx.Background(), pipeline))
-}
+func extractFromCursor(ctx context.Context, cursor *mongo.Cursor, err error) ([]bson.Raw, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
 
-// regular keyword/text search
-func (store *Store[T]) TextSearch(query_texts []string, options ...SearchOption) []T {
-	search_pipeline := createTextSearchPipeline(query_texts, options)
-	return store.Aggregate(search_pipeline)
-}
-
-func (store *Store[T]) VectorSearch(query_embeddings [][]float32, vec_path string, options ...SearchOption) []T {
-	// this is just initial memory allocation. it will grow as needed
-	result := make([]T, 0, len(query_embeddings)*_DEFAULT_SEARCH_TOP_N)
-	// search for each query embedding and merge the results
-	// TODO: sort by search score later
-	datautils.ForEach(query_embeddings, func(vec *[]float32) {
-		search_pipeline := createVectorSearchPipeline(*vec, vec_path, options)
-		result = append(result, store.Aggregate(search_pipeline)...)
-	})
-	return store.deduplicate(result)
+	// unmarshall
+	var contents []bson.Raw
+	if err = cursor.All(ctx, &contents); err != nil {
+		return nil, err
+	}
+	return contents, nil
 }
 
-func (store *Store[T]) Delete(filter JSON) {
-	res, err := store.collection.DeleteMany(ctx.Background(), filter)
+func acquireMongoClient(connection_string string) (*mongo.Client, error) {
+	mongo_clients.Lock()
+	defer mongo_clients.Unlock()
+	if shared, ok := mongo_clients.items[connection_string]; ok {
+		shared.refs++
+		return shared.client, nil
+	}
+	client, err := createMongoClient(connection_string, mongo_clients.pool_configs[connection_string])
 	if err != nil {
-		log.Printf("[%s]: Deletion failed. %v\n", store.name, err)
-	} else {
-		log.Printf("[%s]: %d items deleted.\n", store.name, res.DeletedCount)
+		return nil, err
 	}
+	mongo_clients.items[connection_string] = &sharedClient{client: client, refs: 1}
+	return client, nil
 }
 
-func (store *Store[T]) deduplicate(items []T) []T {
-	// if there is no equality or Id function just return what there is
-	if store.equals != nil {
-		unique := make([]T, 0, len(items))
-		datautils.ForEach(items, func(item *T) {
-			if !datautils.In(*item, unique, store.equals) {
-				unique = append(unique, *item)
-			}
-		})
-		return unique
+func releaseMongoClient(ctx context.Context, connection_string string) error {
+	mongo_clients.Lock()
+	defer mongo_clients.Unlock()
+	shared, ok := mongo_clients.items[connection_string]
+	if !ok {
+		return nil
+	}
+	if shared.refs--; shared.refs > 0 {
+		return nil
 	}
-	return items
+	delete(mongo_clients.items, connection_string)
+	return shared.client.Disconnect(ctx)
 }
 
-func (store *Store[T]) getIDs(items []T) []JSON {
-	return datautils.Transform(items, func(item *T) JSON {
-		return store.get_id(item)
-	})
+func createMongoClient(connection_string string, pool PoolConfig) (*mongo.Client, error) {
+	client_options := options.Client().ApplyURI(connection_string)
+	if pool.MaxPoolSize > 0 {
+		client_options = client_options.SetMaxPoolSize(pool.MaxPoolSize)
+	}
+	if pool.MinPoolSize > 0 {
+		client_options = client_options.SetMinPoolSize(pool.MinPoolSize)
+	}
+	if pool.MaxConnecting > 0 {
+		client_options = client_options.SetMaxConnecting(pool.MaxConnecting)
+	}
+	if pool.MaxConnIdleTime > 0 {
+		client_options = client_options.SetMaxConnIdleTime(pool.MaxConnIdleTime)
+	}
+	client, err := mongo.Connect(context.Background(), client_options)
+	if err != nil {
+		log.Println("[mongoclient]", err)
+		return nil, err
+	}
+	return client, nil
 }
 
-func (store *Store[T]) extractFromCursor(cursor *mongo.Cursor, err error) []T {
-	background := ctx.Background()
-	if err != nil {
-		log.Printf("[%s]: Couldn't retrieve items. %v\n", store.name, err)
-		return nil
+func createVectorSearchPipeline(dialect VectorSearchDialect, query_embeddings []float32, vec_path, index_name string, params *SearchParams) []JSON {
+	top_n := params.TopN
+	if top_n <= 0 {
+		top_n = _DEFAULT_SEARCH_TOP_N
+	}
+	pipeline := dialect.CreateSearchStages(query_embeddings, vec_path, index_name, top_n, params.Filter)
+	if params.Quantization != NoQuantization && len(pipeline) > 0 {
+		// atlas wants the query in the same form as the indexed binary vectors
+		if search, ok := pipeline[0]["$vectorSearch"].(JSON); ok {
+			search["queryVector"] = QuantizeVector(query_embeddings, params.Quantization)
+		}
 	}
-	defer cursor.Close(background)
+	return appendPostSearchStages(pipeline, params, false)
+}
 
-	// unmarshall
-	var contents []T
-	if err = cursor.All(background, &contents); err != nil {
-		log.Println(err)
-		return nil
+func createTextSearchPipeline(query_texts []string, params *SearchParams) []JSON {
+	match := JSON{
+		"$text": JSON{"$search": strings.Join(query_texts, " ")},
+	}
+	// scalar filter is part of the first item in the pipeline
+	datautils.AppendMaps(match, params.Filter)
+	pipeline := []JSON{
+		{
+			"$match": match,
+		},
+		{
+			"$addFields": JSON{
+				"search_score": JSON{"$meta": "textScore"},
+			},
+		},
+		{
+			"$sort": JSON{"search_score": -1},
+		},
 	}
-	return contents
+	return appendPostSearchStages(pipeline, params, true)
 }
 
-func createMongoClient(connection_string string) *mongo.Client {
-	client, err := mongo.Connect(ctx.Background(), options.Client().ApplyURI(connection_string))
-	if err != nil {
-		log.Println("[mongoclient]", err)
-		return nil
+// min score, post filter, sort, limit and projection get applied after the search score has been assigned
+func appendPostSearchStages(pipeline []JSON, params *SearchParams, with_limit bool) []JSON {
+	if params.MinScore != nil {
+		pipeline = append(pipeline, JSON{
+			"$match": JSON{
+				"search_score": JSON{"$gte": *params.MinScore},
+			},
+		})
+	}
+	if len(params.PostFilter) > 0 {
+		pipeline = append(pipeline, JSON{"$match": params.PostFilter})
+	}
+	if len(params.SortBy) > 0 {
+		pipeline = append(pipeline, JSON{"$sort": sortDocument(params.SortBy)})
+	}
+	// for vector search the top_n is part of the search stage
+	if with_limit && params.TopN > 0 {
+		pipeline = append(pipeline, JSON{"$limit": params.TopN})
+	}
+	if len(params.Projection) > 0 {
+		pipeline = append(pipeline, JSON{"$project": params.Projection})
 	}
-	return client
+	return pipeline
 }
@@ -0,0 +1,262 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	_COSMOS_IVF_LISTS = 10 // number of clusters of the cosmos vector-ivf index
+)
+
+// index as listIndexes returns it
+type mongoIndex struct {
+	Name                string `bson:"name"`
+	Key                 bson.D `bson:"key"`
+	Unique              bool   `bson:"unique"`
+	Weights             bson.D `bson:"weights"` // fields of text indexes
+	CosmosSearchOptions *struct {
+		Dimensions int `bson:"dimensions"`
+	} `bson:"cosmosSearchOptions"`
+}
+
+// atlas vector search index as listSearchIndexes returns it
+type atlasSearchIndex struct {
+	Name             string `bson:"name"`
+	LatestDefinition struct {
+		Fields []struct {
+			Type          string `bson:"type"`
+			Path          string `bson:"path"`
+			NumDimensions int    `bson:"numDimensions"`
+		} `bson:"fields"`
+	} `bson:"latestDefinition"`
+}
+
+// Creates the indexes that don't exist. Vector indexes are created in the form of the vector search dialect.
+// The exact search dialect doesn't use a vector index so there is nothing to create for it.
+// Cosmos DB can only create unique indexes on empty collections so they fail on the existing ones
+func (backend *mongoBackend) EnsureIndexes(ctx context.Context, specs []IndexSpec) (IndexReport, error) {
+	existing, err := backend.listIndexes(ctx)
+	if err != nil {
+		return IndexReport{}, err
+	}
+	var report IndexReport
+	var errs []error
+	_, is_atlas := backend.dialect.(atlasVectorSearch)
+	expected := map[string]bool{"_id_": true}
+	for _, spec := range specs {
+		expected[spec.Name] = true
+		var actual string
+		var found bool
+		switch {
+		case spec.Kind == VectorIndex && is_atlas:
+			// atlas vector indexes are search indexes that are listed separately
+			if actual, found, err = backend.findSearchIndex(ctx, spec.Name); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", spec.Name, err))
+				continue
+			}
+		case spec.Kind == VectorIndex && !isCosmos(backend.dialect):
+			continue
+		default:
+			actual, found = existing[spec.Name]
+		}
+		if found {
+			if want := backend.describeSpec(spec); actual != want {
+				report.Drifted = append(report.Drifted, IndexDrift{Name: spec.Name, Expected: want, Actual: actual})
+			}
+			continue
+		}
+		if err := backend.createIndex(ctx, spec); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", spec.Name, err))
+			continue
+		}
+		report.Created = append(report.Created, spec.Name)
+	}
+	for name := range existing {
+		if !expected[name] {
+			report.Extra = append(report.Extra, name)
+		}
+	}
+	sort.Strings(report.Extra)
+	return report, errors.Join(errs...)
+}
+
+func isCosmos(dialect VectorSearchDialect) bool {
+	_, ok := dialect.(cosmosSearch)
+	return ok
+}
+
+// descriptions of the existing indexes by name
+func (backend *mongoBackend) listIndexes(ctx context.Context) (map[string]string, error) {
+	cursor, err := backend.collection.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var indexes []mongoIndex
+	if err = cursor.All(ctx, &indexes); err != nil {
+		return nil, err
+	}
+	res := make(map[string]string, len(indexes))
+	for _, index := range indexes {
+		res[index.Name] = index.describe()
+	}
+	return res, nil
+}
+
+func (backend *mongoBackend) findSearchIndex(ctx context.Context, name string) (string, bool, error) {
+	cursor, err := backend.collection.SearchIndexes().List(ctx, options.SearchIndexes().SetName(name))
+	if err != nil {
+		return "", false, err
+	}
+	defer cursor.Close(ctx)
+	var indexes []atlasSearchIndex
+	if err = cursor.All(ctx, &indexes); err != nil || len(indexes) == 0 {
+		return "", false, err
+	}
+	return indexes[0].describe(), true, nil
+}
+
+func (backend *mongoBackend) describeSpec(spec IndexSpec) string {
+	fields := spec.fields()
+	switch spec.Kind {
+	case TextIndex:
+		return describeTextIndex(fields)
+	case VectorIndex:
+		if isCosmos(backend.dialect) {
+			// cosmos filters with the regular scalar indexes
+			return describeVectorIndex("cosmosSearch", fields[0], spec.Dimensions, nil)
+		}
+		return describeVectorIndex("vectorSearch", fields[0], spec.Dimensions, fields[1:])
+	default:
+		return describeScalarIndex(spec.Keys, spec.Unique)
+	}
+}
+
+func (backend *mongoBackend) createIndex(ctx context.Context, spec IndexSpec) error {
+	fields := spec.fields()
+	switch spec.Kind {
+	case TextIndex:
+		keys := make(bson.D, len(fields))
+		for i, field := range fields {
+			keys[i] = bson.E{Key: field, Value: "text"}
+		}
+		_, err := backend.collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys, Options: options.Index().SetName(spec.Name)})
+		return err
+	case VectorIndex:
+		if isCosmos(backend.dialect) {
+			return backend.createCosmosVectorIndex(ctx, spec)
+		}
+		return backend.createAtlasVectorIndex(ctx, spec)
+	default:
+		keys := make(bson.D, len(spec.Keys))
+		for i, key := range spec.Keys {
+			direction := 1
+			if key.Descending {
+				direction = -1
+			}
+			keys[i] = bson.E{Key: key.Field, Value: direction}
+		}
+		index_options := options.Index().SetName(spec.Name)
+		if spec.Unique {
+			index_options = index_options.SetUnique(true)
+		}
+		_, err := backend.collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys, Options: index_options})
+		return err
+	}
+}
+
+// https://learn.microsoft.com/en-us/azure/cosmos-db/mongodb/vcore/vector-search
+func (backend *mongoBackend) createCosmosVectorIndex(ctx context.Context, spec IndexSpec) error {
+	command := bson.D{
+		{Key: "createIndexes", Value: backend.collection.Name()},
+		{Key: "indexes", Value: bson.A{
+			bson.D{
+				{Key: "name", Value: spec.Name},
+				{Key: "key", Value: bson.D{{Key: spec.Keys[0].Field, Value: "cosmosSearch"}}},
+				{Key: "cosmosSearchOptions", Value: bson.D{
+					{Key: "kind", Value: "vector-ivf"},
+					{Key: "numLists", Value: _COSMOS_IVF_LISTS},
+					{Key: "similarity", Value: "COS"},
+					{Key: "dimensions", Value: spec.Dimensions},
+				}},
+			},
+		}},
+	}
+	return backend.collection.Database().RunCommand(ctx, command).Err()
+}
+
+// https://www.mongodb.com/docs/atlas/atlas-vector-search/vector-search-type/
+func (backend *mongoBackend) createAtlasVectorIndex(ctx context.Context, spec IndexSpec) error {
+	// binary vectors can only be indexed for euclidean distance. It ranks the same as cosine for the sign bits
+	// and rescoring turns the scores into cosine similarity anyway
+	similarity := "cosine"
+	if spec.Quantization == BinaryQuantization {
+		similarity = "euclidean"
+	}
+	fields := bson.A{
+		bson.D{
+			{Key: "type", Value: "vector"},
+			{Key: "path", Value: spec.Keys[0].Field},
+			{Key: "numDimensions", Value: spec.Dimensions},
+			{Key: "similarity", Value: similarity},
+		},
+	}
+	for _, key := range spec.Keys[1:] {
+		fields = append(fields, bson.D{{Key: "type", Value: "filter"}, {Key: "path", Value: key.Field}})
+	}
+	command := bson.D{
+		{Key: "createSearchIndexes", Value: backend.collection.Name()},
+		{Key: "indexes", Value: bson.A{
+			bson.D{
+				{Key: "name", Value: spec.Name},
+				{Key: "type", Value: "vectorSearch"},
+				{Key: "definition", Value: bson.D{{Key: "fields", Value: fields}}},
+			},
+		}},
+	}
+	return backend.collection.Database().RunCommand(ctx, command).Err()
+}
+
+func (index mongoIndex) describe() string {
+	keys := make([]SortKey, 0, len(index.Key))
+	for _, key := range index.Key {
+		switch {
+		case key.Key == "_fts":
+			fields := make([]string, len(index.Weights))
+			for i, weight := range index.Weights {
+				fields[i] = weight.Key
+			}
+			return describeTextIndex(fields)
+		case key.Value == "cosmosSearch":
+			dimensions := 0
+			if index.CosmosSearchOptions != nil {
+				dimensions = index.CosmosSearchOptions.Dimensions
+			}
+			return describeVectorIndex("cosmosSearch", key.Key, dimensions, nil)
+		}
+		direction, _ := asNumber(key.Value)
+		keys = append(keys, SortKey{Field: key.Key, Descending: direction < 0})
+	}
+	return describeScalarIndex(keys, index.Unique)
+}
+
+func (index atlasSearchIndex) describe() string {
+	var vec_path string
+	var dimensions int
+	var filter_fields []string
+	for _, field := range index.LatestDefinition.Fields {
+		if field.Type == "vector" {
+			vec_path, dimensions = field.Path, field.NumDimensions
+		} else if field.Type == "filter" {
+			filter_fields = append(filter_fields, field.Path)
+		}
+	}
+	return describeVectorIndex("vectorSearch", vec_path, dimensions, filter_fields)
+}
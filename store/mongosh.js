@@ -1,3 +1,5 @@
+// sdk.NewBeanSack creates these indexes through store.EnsureIndexes (see sdk/indexes.go) with the configured embedding dimensions.
+// This script is for creating them by hand
 //  DB
 use("beansack");
 
@@ -34,27 +36,8 @@ db.runCommand(
   }
 );
 
-db.runCommand(
-  {
-    "createIndexes": "beans",
-    "indexes": [
-      {
-        "name": "beans_query_search",
-        "key": 
-        {
-          "search_embeddings": "cosmosSearch"
-        },
-        "cosmosSearchOptions": 
-        {
-          "kind": "vector-ivf",
-          "numLists": 10,
-          "similarity": "COS",
-          "dimensions": 768
-        }
-      }
-    ]
-  }
-);
+// beans_query_search on search_embeddings is deprecated along with search_embeddings
+// db.beans.dropIndex("beans_query_search");
 
 // scalar index - these need to exist if i want to use these as filters in vector search
 db.beans.createIndex(
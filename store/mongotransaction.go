@@ -0,0 +1,59 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	_ILLEGAL_OPERATION = 20 // server error code for transactions on a standalone server
+)
+
+// Runs fn in a transaction of a session of the shared client so the stores on the same connection string take part in it.
+// Transient errors retry fn. Needs a replica set or a sharded cluster and returns ErrTransactionsNotSupported otherwise
+func (backend *mongoBackend) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	supported, err := backend.supportsTransactions(ctx)
+	if err != nil {
+		return err
+	}
+	if !supported {
+		return ErrTransactionsNotSupported
+	}
+	session, err := backend.collection.Database().Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.WithoutCancel(ctx))
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (any, error) {
+		return nil, fn(ctx)
+	})
+	var server_err mongo.ServerError
+	if errors.As(err, &server_err) && server_err.HasErrorCode(_ILLEGAL_OPERATION) {
+		return fmt.Errorf("%w: %v", ErrTransactionsNotSupported, err)
+	}
+	return err
+}
+
+// replica set members and mongos routers run transactions, standalone servers don't
+func (backend *mongoBackend) supportsTransactions(ctx context.Context) (bool, error) {
+	backend.transactions_lock.Lock()
+	defer backend.transactions_lock.Unlock()
+	if backend.transactions != nil {
+		return *backend.transactions, nil
+	}
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	command := bson.D{{Key: "hello", Value: 1}}
+	if err := backend.collection.Database().Client().Database("admin").RunCommand(ctx, command).Decode(&hello); err != nil {
+		return false, err
+	}
+	supported := hello.SetName != "" || hello.Msg == "isdbgrid"
+	backend.transactions = &supported
+	return supported, nil
+}
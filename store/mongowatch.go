@@ -0,0 +1,180 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// server error codes of deployments without change streams.
+// 40573: standalone servers, 115: command not supported (cosmos), 40324: unrecognized $changeStream stage
+var _WATCH_NOT_SUPPORTED_CODES = []int{40573, 115, 40324}
+
+// change event as the change stream returns it
+type changeEvent struct {
+	ID            bson.Raw `bson:"_id"`
+	OperationType string   `bson:"operationType"`
+	DocumentKey   struct {
+		ID any `bson:"_id"`
+	} `bson:"documentKey"`
+	// null for deletes and for updates of documents that got deleted before the lookup
+	FullDocument bson.RawValue `bson:"fullDocument"`
+	// pre-image of the document. Only there when the collection has changeStreamPreAndPostImages enabled
+	FullDocumentBeforeChange bson.RawValue `bson:"fullDocumentBeforeChange"`
+	UpdateDescription        struct {
+		UpdatedFields bson.Raw `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// Watches the collection with a change stream. Updates come with the whole document as it is after the update.
+// The changes come with the document before the change when the collection has pre-images enabled (MongoDB 6.0+).
+// Needs a replica set or a sharded cluster and returns ErrWatchNotSupported otherwise
+func (backend *mongoBackend) Watch(ctx context.Context, filter JSON, resume_token bson.Raw) (ChangeStream, error) {
+	match := JSON{"operationType": JSON{"$in": bson.A{"insert", "update", "replace", "delete"}}}
+	if len(filter) > 0 {
+		// the filter applies to the document after the change. Deletes don't have one
+		match = JSON{"$or": []JSON{
+			{"operationType": "delete"},
+			{"$and": []JSON{match, prefixFields(filter, "fullDocument.")}},
+		}}
+	}
+	stream_options := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetFullDocumentBeforeChange(options.WhenAvailable).
+		SetBatchSize(_CURSOR_BATCH_SIZE)
+	if resume_token != nil {
+		stream_options = stream_options.SetResumeAfter(resume_token)
+	}
+	pipeline := []JSON{{"$match": match}}
+	stream, err := backend.collection.Watch(ctx, pipeline, stream_options)
+	var server_err mongo.ServerError
+	if errors.As(err, &server_err) {
+		for _, code := range _WATCH_NOT_SUPPORTED_CODES {
+			if server_err.HasErrorCode(code) {
+				return nil, fmt.Errorf("%w: %v", ErrWatchNotSupported, err)
+			}
+		}
+		// servers before 6.0 don't know about pre-images
+		stream_options.FullDocumentBeforeChange = nil
+		stream, err = backend.collection.Watch(ctx, pipeline, stream_options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mongoChangeStream{stream: stream}, nil
+}
+
+// the filter fields are relative to the change event instead of the document
+func prefixFields(filter JSON, prefix string) JSON {
+	res := make(JSON, len(filter))
+	for key, val := range filter {
+		if !strings.HasPrefix(key, "$") {
+			res[prefix+key] = val
+			continue
+		}
+		// $and, $or and $nor have a list of filters
+		switch clauses := val.(type) {
+		case []JSON:
+			prefixed := make([]JSON, len(clauses))
+			for i, clause := range clauses {
+				prefixed[i] = prefixFields(clause, prefix)
+			}
+			res[key] = prefixed
+		case []any:
+			prefixed := make([]any, len(clauses))
+			for i, clause := range clauses {
+				prefixed[i] = prefixClause(clause, prefix)
+			}
+			res[key] = prefixed
+		case bson.A:
+			prefixed := make(bson.A, len(clauses))
+			for i, clause := range clauses {
+				prefixed[i] = prefixClause(clause, prefix)
+			}
+			res[key] = prefixed
+		default:
+			res[key] = val
+		}
+	}
+	return res
+}
+
+func prefixClause(clause any, prefix string) any {
+	if m, ok := asMap(clause); ok {
+		return prefixFields(JSON(m), prefix)
+	}
+	return clause
+}
+
+type mongoChangeStream struct {
+	stream  *mongo.ChangeStream
+	current RawChange
+	err     error
+}
+
+func (stream *mongoChangeStream) Next(ctx context.Context) bool {
+	if stream.err != nil || !stream.stream.Next(ctx) {
+		return false
+	}
+	var event changeEvent
+	if stream.err = stream.stream.Decode(&event); stream.err != nil {
+		return false
+	}
+	change := RawChange{Kind: ChangeKind(event.OperationType), ID: event.DocumentKey.ID, ResumeToken: event.ID}
+	if event.FullDocument.Type == bsontype.EmbeddedDocument {
+		change.Document = event.FullDocument.Document()
+	}
+	if event.FullDocumentBeforeChange.Type == bsontype.EmbeddedDocument {
+		change.Before = event.FullDocumentBeforeChange.Document()
+	}
+	if change.Kind == ChangeUpdate {
+		change.Fields = updatedFields(event.UpdateDescription.UpdatedFields, event.UpdateDescription.RemovedFields)
+	}
+	stream.current = change
+	return true
+}
+
+// top level fields of the updated and removed paths
+func updatedFields(updated bson.Raw, removed []string) []string {
+	seen := make(map[string]bool)
+	var fields []string
+	add := func(path string) {
+		field, _, _ := strings.Cut(path, ".")
+		if !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+	elements, _ := updated.Elements()
+	for _, element := range elements {
+		add(element.Key())
+	}
+	for _, path := range removed {
+		add(path)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func (stream *mongoChangeStream) Current() RawChange {
+	return stream.current
+}
+
+func (stream *mongoChangeStream) Err() error {
+	if stream.err != nil {
+		return stream.err
+	}
+	return stream.stream.Err()
+}
+
+func (stream *mongoChangeStream) Close(ctx context.Context) error {
+	return stream.stream.Close(ctx)
+}
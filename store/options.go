@@ -1,7 +1,7 @@
 package store
 
 import (
-	"strings"
+	"time"
 
 	datautils "github.com/soumitsalman/data-utils"
 )
@@ -11,7 +11,38 @@ const (
 )
 
 type StoreOption[T any] func(store *Store[T])
-type SearchOption func(search_pipeline []JSON) []JSON
+type SearchOption func(params *SearchParams)
+
+// backend agnostic parameters for text and vector search
+type SearchParams struct {
+	Filter     JSON
+	TopN       int
+	MinScore   *float64
+	SortBy     []SortKey // in order of precedence
+	Projection JSON
+	// filter on the scored results such as the cursor of a search page. Unlike Filter it applies after the vector search picks its top n
+	PostFilter JSON
+	// how the scores of an item across multiple query embeddings get combined. Default is MaxScore
+	ScoreAggregation ScoreAggregation
+	// how the searched vectors are stored. The store sets it for the backends that need the query in the same form
+	Quantization Quantization
+}
+
+type ScoreAggregation int
+
+const (
+	MaxScore  ScoreAggregation = iota // the best score across the query embeddings
+	MeanScore                         // average over all the query embeddings. Missing from a result counts as 0
+	SumScore                          // items that match more of the query embeddings rank higher
+)
+
+func NewSearchParams(options ...SearchOption) *SearchParams {
+	params := &SearchParams{}
+	for _, opt := range options {
+		opt(params)
+	}
+	return params
+}
 
 func WithDataIDAndEqualsFunction[T any](id_func func(data *T) JSON, equals func(a, b *T) bool) StoreOption[T] {
 	return func(store *Store[T]) {
@@ -20,127 +51,192 @@ func WithDataIDAndEqualsFunction[T any](id_func func(data *T) JSON, equals func(
 	}
 }
 
-// scalar filter is part of the first item in the pipeline
-func WithVectorFilter(filter JSON) SearchOption {
-	return func(search_pipeline []JSON) []JSON {
-		if len(filter) > 0 {
-			search_pipeline[0]["$search"].(JSON)["cosmosSearch"].(JSON)["filter"] = filter
+// unique index on the id fields so that Add doesn't need to look up the existing docs before inserting.
+// EnsureIndexes creates it along with the other specs. Until it does, or if the backend can't create it, Add keeps looking them up.
+// This needs WithDataIDAndEqualsFunction
+func WithUniqueIndex[T any](fields ...string) StoreOption[T] {
+	return func(store *Store[T]) {
+		store.unique_fields = fields
+	}
+}
+
+// what Add does with the docs that already exist. Default is SkipExisting
+func WithWritePolicy[T any](policy WritePolicy) StoreOption[T] {
+	return func(store *Store[T]) {
+		store.write_policy = policy
+	}
+}
+
+// hash of the content that ReplaceIfChanged compares between the new and the existing docs
+func WithContentHash[T any](hash func(data *T) string) StoreOption[T] {
+	return func(store *Store[T]) {
+		store.content_hash = hash
+	}
+}
+
+// field that has a unique value for each item. Pagination uses it to order the items that tie on the other sort keys.
+// Default is _id
+func WithUniqueField[T any](field string) StoreOption[T] {
+	return func(store *Store[T]) {
+		store.unique_field = field
+	}
+}
+
+// fields that make up the text index. This only applies to the backends that do text search in process
+func WithTextSearchFields[T any](fields ...string) StoreOption[T] {
+	return func(store *Store[T]) {
+		if indexer, ok := store.backend.(TextIndexer); ok {
+			indexer.SetTextFields(fields)
+		}
+	}
+}
+
+// overrides the vector search dialect that the backend detected from the connection string
+func WithVectorSearchDialect[T any](dialect VectorSearchDialect) StoreOption[T] {
+	return func(store *Store[T]) {
+		if indexer, ok := store.backend.(VectorIndexer); ok {
+			indexer.SetVectorSearchDialect(dialect)
 		}
-		return search_pipeline
 	}
 }
 
-// scalar filter is part of the first item in the pipeline
+// name of the vector index on the vector field. Atlas $vectorSearch needs it
+func WithVectorIndex[T any](vec_path, index_name string) StoreOption[T] {
+	return func(store *Store[T]) {
+		if indexer, ok := store.backend.(VectorIndexer); ok {
+			indexer.SetVectorIndex(vec_path, index_name)
+		}
+	}
+}
+
+// stores the vectors at vec_paths quantized and turns them back into arrays when reading. Vector search on them is rescored
+// with the full precision query. Items that were written before keep their full precision vectors and still work.
+// The memory, file and atlas backends can search quantized vectors. Cosmos and the exact search can't so New fails for them
+func WithQuantizedVectors[T any](quantization Quantization, vec_paths ...string) StoreOption[T] {
+	return func(store *Store[T]) {
+		if store.quantized == nil {
+			store.quantized = make(map[string]Quantization)
+		}
+		for _, vec_path := range vec_paths {
+			if quantization == NoQuantization {
+				delete(store.quantized, vec_path)
+			} else {
+				store.quantized[vec_path] = quantization
+			}
+		}
+	}
+}
+
+// scalar filter for vector search
+func WithVectorFilter(filter JSON) SearchOption {
+	return withFilter(filter)
+}
+
+// scalar filter for text search
 func WithTextFilter(filter JSON) SearchOption {
-	return func(search_pipeline []JSON) []JSON {
+	return withFilter(filter)
+}
+
+func withFilter(filter JSON) SearchOption {
+	return func(params *SearchParams) {
 		if len(filter) > 0 {
-			datautils.AppendMaps(
-				search_pipeline[0]["$match"].(JSON),
-				filter)
+			if params.Filter == nil {
+				params.Filter = make(JSON, len(filter))
+			}
+			datautils.AppendMaps(params.Filter, filter)
 		}
-		return search_pipeline
 	}
 }
 
-func WithSortBy(sort_by JSON) SearchOption {
-	return func(search_pipeline []JSON) []JSON {
-		search_pipeline = append(search_pipeline, JSON{"$sort": sort_by})
-		return search_pipeline
+// how VectorSearch combines the scores of an item that matches more than one query embedding
+func WithScoreAggregation(aggregation ScoreAggregation) SearchOption {
+	return func(params *SearchParams) {
+		params.ScoreAggregation = aggregation
+	}
+}
+
+// sorts the search results by the keys in the order they are given instead of by search score
+func WithSortBy(keys ...SortKey) SearchOption {
+	return func(params *SearchParams) {
+		params.SortBy = keys
 	}
 }
 
-// topN is part of the first item in the pipeline
 func WithVectorTopN(top_n int) SearchOption {
-	return func(search_pipeline []JSON) []JSON {
+	return func(params *SearchParams) {
 		if top_n <= 0 {
 			top_n = _DEFAULT_SEARCH_TOP_N
 		}
-		search_pipeline[0]["$search"].(JSON)["cosmosSearch"].(JSON)["k"] = top_n
-		return search_pipeline
+		params.TopN = top_n
 	}
 }
 
-// for text searches appending is fine it doesn't impact the other additions of the pipeline
 func WithTextTopN(top_n int) SearchOption {
-	return func(search_pipeline []JSON) []JSON {
-		search_pipeline = append(search_pipeline, JSON{"$limit": top_n})
-		return search_pipeline
+	return func(params *SearchParams) {
+		params.TopN = top_n
 	}
 }
 
-// for both searches appending is fine it doesn't impact the other additions of the pipeline
 func WithProjection(fields JSON) SearchOption {
-	return func(search_pipeline []JSON) []JSON {
+	return func(params *SearchParams) {
 		if len(fields) > 0 {
-			search_pipeline = append(search_pipeline, JSON{"$project": fields})
+			params.Projection = fields
 		}
-		return search_pipeline
 	}
 }
 
-// for both searches appending is fine it doesn't impact the other additions of the pipeline
 func WithMinSearchScore(score float64) SearchOption {
-	return func(search_pipeline []JSON) []JSON {
-		search_pipeline = append(search_pipeline,
-			JSON{
-				"$match": JSON{
-					"search_score": JSON{"$gte": score},
-				},
-			})
-		return search_pipeline
+	return func(params *SearchParams) {
+		params.MinScore = &score
 	}
 }
 
-func createVectorSearchPipeline(query_embeddings []float32, vec_path string, options []SearchOption) []JSON {
-	pipeline := createDefaultVectorSearchPipeline(query_embeddings, vec_path)
+type WatchOption func(params *WatchParams)
+
+// parameters for Watch
+type WatchParams struct {
+	ResumeToken    string
+	PollInterval   time.Duration
+	WatermarkField string
+	Incremental    bool
+}
+
+func NewWatchParams(options ...WatchOption) *WatchParams {
+	params := &WatchParams{PollInterval: _DEFAULT_POLL_INTERVAL}
 	for _, opt := range options {
-		pipeline = opt(pipeline)
+		opt(params)
 	}
-	return pipeline
+	return params
 }
 
-func createTextSearchPipeline(query_texts []string, options []SearchOption) []JSON {
-	search_pipeline := createDefaultTextSearchPipeline(query_texts)
-	for _, opt := range options {
-		search_pipeline = opt(search_pipeline)
-	}
-	return search_pipeline
-}
-
-func createDefaultVectorSearchPipeline(query_embeddings []float32, vector_field string) []JSON {
-	return []JSON{
-		{
-			"$search": JSON{
-				"cosmosSearch": JSON{
-					"vector": query_embeddings,
-					"path":   vector_field,
-					"k":      _DEFAULT_SEARCH_TOP_N,
-				},
-				"returnStoredSource": true,
-			},
-		},
-		{
-			"$addFields": JSON{
-				"search_score": JSON{"$meta": "searchScore"},
-			},
-		},
-	}
-}
-
-func createDefaultTextSearchPipeline(query_texts []string) []JSON {
-	return []JSON{
-		{
-			"$match": JSON{
-				"$text": JSON{"$search": strings.Join(query_texts, " ")},
-			},
-		},
-		{
-			"$addFields": JSON{
-				"search_score": JSON{"$meta": "textScore"},
-			},
-		},
-		{
-			"$sort": JSON{"search_score": -1},
-		},
+// continues after the change that the token came with
+func WithResumeToken(token string) WatchOption {
+	return func(params *WatchParams) {
+		params.ResumeToken = token
+	}
+}
+
+// how often the backends without change streams get polled. Default is a minute
+func WithPollInterval(interval time.Duration) WatchOption {
+	return func(params *WatchParams) {
+		if interval > 0 {
+			params.PollInterval = interval
+		}
+	}
+}
+
+// a field that grows for new items such as an update time. It goes in the resume tokens so that
+// polling can tell the items that got added while nobody was watching
+func WithWatermarkField(field string) WatchOption {
+	return func(params *WatchParams) {
+		params.WatermarkField = field
+	}
+}
+
+// after the first poll only the items that reached the highest watermark so far get read instead of all the items of the filter.
+// It needs WithWatermarkField and it misses the deletes and the changes that don't move the watermark
+func WithIncrementalPolling() WatchOption {
+	return func(params *WatchParams) {
+		params.Incremental = true
 	}
 }
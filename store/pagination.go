@@ -0,0 +1,342 @@
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Pages are keyset based. A page token holds the sort key values of the last item of the previous page
+// and the next page starts right after it. Items that get added in the mean time land either before or after the
+// cursor depending on their keys so they don't shift the pages like skip/limit would.
+// The last sort key has to be unique so that items with the same values for the other keys don't get skipped.
+
+const (
+	_DEFAULT_UNIQUE_FIELD = "_id"
+	// vector search can't start at a cursor so each page searches past all the previous ones. Search pages stop after this many results
+	_MAX_SEARCH_PAGE_DEPTH = 1000
+)
+
+type SortKey struct {
+	Field      string
+	Descending bool
+}
+
+func Asc(field string) SortKey {
+	return SortKey{Field: field}
+}
+
+func Desc(field string) SortKey {
+	return SortKey{Field: field, Descending: true}
+}
+
+type pageCursor struct {
+	Count  int    `bson:"c"` // number of items returned in the previous pages
+	Values bson.A `bson:"v"` // sort key values of the last item of the previous page
+}
+
+// Returns a page of items sorted by sort_by and the token for the next page. The token is empty when there are no more items.
+// The unique field of the store is added as the last sort key if sort_by doesn't end with it
+func (store *Store[T]) GetPage(ctx context.Context, filter JSON, fields JSON, sort_by []SortKey, page_size int, page_token string) ([]T, string, error) {
+	keys := pageKeys(sort_by, Desc(store.unique_field))
+	cursor, err := decodePageToken(page_token, len(keys))
+	if err != nil {
+		return nil, "", err
+	}
+	if page_size <= 0 {
+		page_size = _DEFAULT_SEARCH_TOP_N
+	}
+
+	match := filter
+	if cursor != nil {
+		match = afterCursor(filter, keys, cursor.Values)
+	}
+	if match == nil {
+		match = JSON{}
+	}
+	pipeline := []JSON{
+		{"$match": match},
+		{"$sort": sortDocument(keys)},
+		// one extra to find out if there is a next page
+		{"$limit": page_size + 1},
+	}
+	if len(fields) > 0 {
+		pipeline = append(pipeline, JSON{"$project": withKeyFields(store.withRescoreFields(fields), keys)})
+	}
+	raws, err := store.backend.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Printf("[%s]: Couldn't retrieve items. %v\n", store.name, err)
+		return nil, "", err
+	}
+	count := 0
+	if cursor != nil {
+		count = cursor.Count
+	}
+	return store.page(raws, keys, page_size, count)
+}
+
+// Same as TextSearch but returns a page of results ordered by search score and the token for the next page.
+// The cursor is part of the text search so the pages are exact keyset pages.
+// The page size is the top_n of the search options. Sort by in the search options is ignored
+func (store *Store[T]) TextSearchPage(ctx context.Context, query_texts []string, page_token string, options ...SearchOption) ([]T, string, error) {
+	return store.searchPage(page_token, options, true, func(params *SearchParams, after JSON) ([]bson.M, error) {
+		params.PostFilter = after
+		raws, err := store.backend.TextSearch(ctx, query_texts, params)
+		if err != nil {
+			return nil, err
+		}
+		return mergeByBestScore([][]bson.Raw{raws}, store.unique_field)
+	})
+}
+
+// Same as VectorSearch but returns a page of results ordered by search score and the token for the next page.
+// An item that matches more than one of the query embeddings is ranked by the score aggregation of the options. Default is its best score.
+// The page size is the top_n of the search options. Sort by in the search options is ignored.
+// Vector search picks its top n before anything else so each page searches past the previous pages and filters on the cursor.
+// The pages are best effort: they absorb up to a page of new items that rank above the cursor, and they stop after 1000 results
+func (store *Store[T]) VectorSearchPage(ctx context.Context, query_embeddings [][]float32, vec_path string, page_token string, options ...SearchOption) ([]T, string, error) {
+	return store.searchPage(page_token, options, false, func(params *SearchParams, after JSON) ([]bson.M, error) {
+		// the scores of several query embeddings get combined after the search so the cursor can only go in the search of one
+		if len(query_embeddings) == 1 {
+			params.PostFilter = after
+		}
+		return store.vectorSearchMerged(ctx, query_embeddings, vec_path, params)
+	})
+}
+
+// one result per item with its scores across the query embeddings combined by the score aggregation of params
+func (store *Store[T]) vectorSearchMerged(ctx context.Context, query_embeddings [][]float32, vec_path string, params *SearchParams) ([]bson.M, error) {
+	results, err := store.batchVectorSearch(ctx, query_embeddings, vec_path, params)
+	if err != nil {
+		return nil, err
+	}
+	return mergeScores(results, store.unique_field, params.ScoreAggregation)
+}
+
+// search returns one document per item with its search score. after is the filter for the items past the cursor, nil on the first page.
+// The search can put it in params. Exact searches apply it before their top n so the top n only needs to cover the page
+func (store *Store[T]) searchPage(page_token string, options []SearchOption, exact bool, search func(params *SearchParams, after JSON) ([]bson.M, error)) ([]T, string, error) {
+	keys := []SortKey{Desc(_SEARCH_SCORE), Desc(store.unique_field)}
+	cursor, err := decodePageToken(page_token, len(keys))
+	if err != nil {
+		return nil, "", err
+	}
+	params := NewSearchParams(options...)
+	page_size := params.TopN
+	if page_size <= 0 {
+		page_size = _DEFAULT_SEARCH_TOP_N
+	}
+	count := 0
+	var after JSON
+	if cursor != nil {
+		count = cursor.Count
+		after = afterCursor(nil, keys, cursor.Values)
+	}
+	if exact {
+		params.TopN = page_size + 1
+	} else {
+		// the top n has to reach past the previous pages. The extra page leaves room for the items
+		// that rank above the cursor since the previous page was fetched
+		params.TopN = min(count, _MAX_SEARCH_PAGE_DEPTH) + 2*page_size + 1
+	}
+	params.SortBy = keys
+	if len(params.Projection) > 0 {
+		params.Projection = withKeyFields(params.Projection, keys)
+	}
+
+	docs, err := search(params, after)
+	if err != nil {
+		log.Printf("[%s]: Search failed. %v\n", store.name, err)
+		return nil, "", err
+	}
+	docs = sortDocuments(docs, sortDocument(keys))
+	if cursor != nil {
+		// the searches that couldn't filter on the cursor
+		docs = dropUntilCursor(docs, keys, cursor.Values)
+	}
+	items, token, err := store.page(toRaw(docs), keys, page_size, count)
+	if !exact && count+len(items) >= _MAX_SEARCH_PAGE_DEPTH {
+		token = ""
+	}
+	return items, token, err
+}
+
+// takes the page out of raws that has one item more than the page size if there is a next page
+func (store *Store[T]) page(raws []bson.Raw, keys []SortKey, page_size, count int) ([]T, string, error) {
+	has_more := len(raws) > page_size
+	if has_more {
+		raws = raws[:page_size]
+	}
+	items, err := store.decode(raws, nil)
+	if err != nil || !has_more {
+		return items, "", err
+	}
+	var last bson.M
+	if err = bson.Unmarshal(raws[len(raws)-1], &last); err != nil {
+		return nil, "", err
+	}
+	values := make(bson.A, len(keys))
+	for i, key := range keys {
+		values[i], _ = lookupPath(last, key.Field)
+	}
+	token, err := encodePageToken(pageCursor{Count: count + len(raws), Values: values})
+	return items, token, err
+}
+
+func pageKeys(sort_by []SortKey, unique SortKey) []SortKey {
+	keys := make([]SortKey, 0, len(sort_by)+1)
+	for _, key := range sort_by {
+		if key.Field == unique.Field {
+			return append(keys, key)
+		}
+		keys = append(keys, key)
+	}
+	return append(keys, unique)
+}
+
+// items that come after the cursor: (k1 after v1) or (k1 = v1 and k2 after v2) or ...
+func afterCursor(filter JSON, keys []SortKey, values bson.A) JSON {
+	clauses := make([]JSON, 0, len(keys))
+	for i, key := range keys {
+		clause := JSON{}
+		for j := 0; j < i; j++ {
+			clause[keys[j].Field] = JSON{"$eq": values[j]}
+		}
+		op := "$gt"
+		if key.Descending {
+			op = "$lt"
+		}
+		clause[key.Field] = JSON{op: values[i]}
+		clauses = append(clauses, clause)
+	}
+	after := JSON{"$or": clauses}
+	if len(filter) == 0 {
+		return after
+	}
+	return JSON{"$and": []JSON{filter, after}}
+}
+
+func dropUntilCursor(docs []bson.M, keys []SortKey, values bson.A) []bson.M {
+	for i, doc := range docs {
+		for j, key := range keys {
+			val, _ := lookupPath(doc, key.Field)
+			res := sortOrder(val, values[j])
+			if key.Descending {
+				res = -res
+			}
+			if res > 0 {
+				return docs[i:]
+			} else if res < 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// keeps one document per unique field value with the best search score
+func mergeByBestScore(results [][]bson.Raw, unique_field string) ([]bson.M, error) {
+	return mergeScores(results, unique_field, MaxScore)
+}
+
+// keeps one document per unique field value with the scores of the result lists combined by aggregation.
+// For the mean an item that is missing from a list counts as 0 for it
+func mergeScores(results [][]bson.Raw, unique_field string, aggregation ScoreAggregation) ([]bson.M, error) {
+	merged := make([]bson.M, 0)
+	scores := make([]float64, 0)
+	index := make(map[string]int)
+	for _, raws := range results {
+		for _, raw := range raws {
+			var doc bson.M
+			if err := bson.Unmarshal(raw, &doc); err != nil {
+				return nil, err
+			}
+			score, _ := asNumber(doc[_SEARCH_SCORE])
+			key := uniqueKey(doc, []string{unique_field})
+			i, found := index[key]
+			if !found {
+				index[key] = len(merged)
+				merged = append(merged, doc)
+				scores = append(scores, score)
+				continue
+			}
+			switch aggregation {
+			case MeanScore, SumScore:
+				scores[i] += score
+			default:
+				if score > scores[i] {
+					merged[i], scores[i] = doc, score
+				}
+			}
+		}
+	}
+	if aggregation == MaxScore {
+		// the documents keep their own score
+		return merged, nil
+	}
+	for i, doc := range merged {
+		if aggregation == MeanScore && len(results) > 0 {
+			scores[i] /= float64(len(results))
+		}
+		doc[_SEARCH_SCORE] = scores[i]
+	}
+	return merged, nil
+}
+
+func sortDocument(keys []SortKey) bson.D {
+	sort_by := make(bson.D, 0, len(keys))
+	for _, key := range keys {
+		direction := 1
+		if key.Descending {
+			direction = -1
+		}
+		sort_by = append(sort_by, bson.E{Key: key.Field, Value: direction})
+	}
+	return sort_by
+}
+
+// the sort keys need to be in the results to create the next page token
+func withKeyFields(fields JSON, keys []SortKey) JSON {
+	inclusion := false
+	for field, val := range fields {
+		if num, ok := asNumber(val); field != "_id" && (!ok || num != 0) && val != false {
+			inclusion = true
+			break
+		}
+	}
+	res := copyJSON(fields)
+	for _, key := range keys {
+		if inclusion {
+			res[key.Field] = 1
+		} else {
+			delete(res, key.Field)
+		}
+	}
+	return res
+}
+
+func encodePageToken(cursor pageCursor) (string, error) {
+	data, err := bson.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// empty token is the first page and returns a nil cursor
+func decodePageToken(token string, num_keys int) (*pageCursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, StoreError("invalid page token")
+	}
+	var cursor pageCursor
+	if err = bson.Unmarshal(data, &cursor); err != nil || len(cursor.Values) != num_keys || cursor.Count < 0 {
+		return nil, StoreError("invalid page token")
+	}
+	return &cursor, nil
+}
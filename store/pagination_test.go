@@ -0,0 +1,148 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPageToken(t *testing.T) {
+	token, err := encodePageToken(pageCursor{Count: 4, Values: bson.A{0.5, "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := decodePageToken(token, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor.Count != 4 || fmt.Sprint(cursor.Values) != "[0.5 b]" {
+		t.Fatalf("unexpected cursor %+v", cursor)
+	}
+	if cursor, err = decodePageToken("", 2); cursor != nil || err != nil {
+		t.Fatalf("expected no cursor for the first page, got %v %v", cursor, err)
+	}
+	for _, invalid := range []string{"not a token", token[:len(token)-2]} {
+		if _, err = decodePageToken(invalid, 2); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+	// a token of a page with different sort keys
+	if _, err = decodePageToken(token, 3); err == nil {
+		t.Error("expected an error for the wrong number of sort keys")
+	}
+}
+
+// reads all the pages and returns the items in order
+func readPages(t *testing.T, next func(token string) ([]testItem, string, error)) []testItem {
+	t.Helper()
+	var all []testItem
+	token := ""
+	for i := 0; i < 100; i++ {
+		items, next_token, err := next(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, items...)
+		if next_token == "" {
+			return all
+		}
+		token = next_token
+	}
+	t.Fatal("the pages don't end")
+	return nil
+}
+
+func TestGetPage(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	// b and c tie on the rank so the _id breaks the tie
+	addItems(t, store, testItem{ID: "a", Rank: 3}, testItem{ID: "b", Rank: 2}, testItem{ID: "c", Rank: 2}, testItem{ID: "d", Rank: 1})
+
+	items := readPages(t, func(token string) ([]testItem, string, error) {
+		return store.GetPage(ctx, JSON{}, nil, []SortKey{Desc("rank")}, 3, token)
+	})
+	if ids(items) != "[a c b d]" {
+		t.Fatalf("unexpected order %s", ids(items))
+	}
+
+	first, token, err := store.GetPage(ctx, JSON{}, JSON{"title": 1}, []SortKey{Desc("rank")}, 2, "")
+	if err != nil || ids(first) != "[a c]" || token == "" {
+		t.Fatalf("unexpected first page %s %q %v", ids(first), token, err)
+	}
+	// items that sort before the cursor don't shift the next page
+	addItems(t, store, testItem{ID: "e", Rank: 4}, testItem{ID: "f", Rank: 0})
+	second, token, err := store.GetPage(ctx, JSON{}, JSON{"title": 1}, []SortKey{Desc("rank")}, 2, token)
+	if err != nil || ids(second) != "[b d]" || token == "" {
+		t.Fatalf("unexpected second page %s %q %v", ids(second), token, err)
+	}
+	last, token, err := store.GetPage(ctx, JSON{}, nil, []SortKey{Desc("rank")}, 2, token)
+	if err != nil || ids(last) != "[f]" || token != "" {
+		t.Fatalf("unexpected last page %s %q %v", ids(last), token, err)
+	}
+}
+
+func TestTextSearchPage(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t, WithTextSearchFields[testItem]("title"))
+	addItems(t, store,
+		testItem{ID: "a", Title: "go go go"},
+		testItem{ID: "b", Title: "go go"},
+		testItem{ID: "c", Title: "go"},
+		testItem{ID: "d", Title: "go"},
+		testItem{ID: "e", Title: "rust"},
+	)
+	items := readPages(t, func(token string) ([]testItem, string, error) {
+		return store.TextSearchPage(ctx, []string{"go"}, token, WithTextTopN(2))
+	})
+	if ids(items) != "[a b d c]" {
+		t.Fatalf("unexpected order %s", ids(items))
+	}
+	for i := 1; i < len(items); i++ {
+		if items[i].SearchScore > items[i-1].SearchScore {
+			t.Fatalf("pages are not sorted by score %v", items)
+		}
+	}
+}
+
+func TestVectorSearchPage(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	query := []float32{1, 0}
+	for i := 0; i < 10; i++ {
+		addItems(t, store, testItem{ID: fmt.Sprint(i), Vector: []float32{1, float32(i) / 10}})
+	}
+	first, token, err := store.VectorSearchPage(ctx, [][]float32{query}, "vector", "", WithVectorTopN(4))
+	if err != nil || ids(first) != "[0 1 2 3]" || token == "" {
+		t.Fatalf("unexpected first page %s %q %v", ids(first), token, err)
+	}
+	// a new best match doesn't push the items of the first page into the next one
+	addItems(t, store, testItem{ID: "new", Vector: []float32{1, 0}})
+	rest := readPages(t, func(next string) ([]testItem, string, error) {
+		if next == "" {
+			next = token
+		}
+		return store.VectorSearchPage(ctx, [][]float32{query}, "vector", next, WithVectorTopN(4))
+	})
+	if ids(rest) != "[4 5 6 7 8 9]" {
+		t.Fatalf("unexpected rest of the pages %s", ids(rest))
+	}
+}
+
+func TestDropUntilCursor(t *testing.T) {
+	keys := []SortKey{Desc(_SEARCH_SCORE), Desc("_id")}
+	docs := []bson.M{
+		{_SEARCH_SCORE: 0.9, "_id": "a"},
+		{_SEARCH_SCORE: 0.5, "_id": "c"},
+		{_SEARCH_SCORE: 0.5, "_id": "b"},
+		{_SEARCH_SCORE: 0.1, "_id": "d"},
+	}
+	rest := dropUntilCursor(docs, keys, bson.A{0.5, "c"})
+	if len(rest) != 2 || rest[0]["_id"] != "b" {
+		t.Fatalf("expected the docs after c, got %v", rest)
+	}
+	if rest = dropUntilCursor(docs, keys, bson.A{0.1, "d"}); len(rest) != 0 {
+		t.Fatalf("expected nothing after the last doc, got %v", rest)
+	}
+}
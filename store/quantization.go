@@ -0,0 +1,265 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Quantized vectors are stored as bson binary vectors (subtype 9) which atlas vector search indexes natively.
+// The first byte is the element type and the second the number of unused bits in the last byte of packed bits.
+// Only the direction of a vector is kept. That is all cosine similarity needs
+const (
+	_BINARY_VECTOR_SUBTYPE = 0x09
+	_INT8_VECTOR           = 0x03
+	_PACKED_BIT_VECTOR     = 0x10
+
+	// the quantized search finds this many times the top n and rescoring picks the top n out of them
+	_INT8_OVERSAMPLING   = 3
+	_BINARY_OVERSAMPLING = 10
+
+	// binary quantized vectors keep an int8 copy in <vec_path>_rescore for rescoring and reading
+	_RESCORE_SUFFIX = "_rescore"
+)
+
+type Quantization int
+
+const (
+	NoQuantization Quantization = iota
+	// 1 byte per dimension scaled by the largest absolute value. 4x smaller and rescoring brings back close to full precision ranking
+	Int8Quantization
+	// 1 bit per dimension for its sign plus an int8 copy for rescoring and reading.
+	// The vector index is 32x smaller and the documents about 3.5x. The search on the bits is rough and relies on rescoring
+	BinaryQuantization
+)
+
+func (quantization Quantization) String() string {
+	switch quantization {
+	case Int8Quantization:
+		return "int8"
+	case BinaryQuantization:
+		return "binary"
+	default:
+		return "none"
+	}
+}
+
+func (quantization Quantization) oversampling() int {
+	if quantization == BinaryQuantization {
+		return _BINARY_OVERSAMPLING
+	}
+	return _INT8_OVERSAMPLING
+}
+
+// encodes the vector as a bson binary vector. NoQuantization and empty vectors are returned as they are
+func QuantizeVector(vec []float32, quantization Quantization) any {
+	if len(vec) == 0 {
+		return vec
+	}
+	switch quantization {
+	case Int8Quantization:
+		var max_abs float64
+		for _, val := range vec {
+			max_abs = math.Max(max_abs, math.Abs(float64(val)))
+		}
+		data := make([]byte, 2+len(vec))
+		data[0] = _INT8_VECTOR
+		if max_abs > 0 {
+			for i, val := range vec {
+				data[2+i] = byte(int8(math.Round(float64(val) / max_abs * math.MaxInt8)))
+			}
+		}
+		return primitive.Binary{Subtype: _BINARY_VECTOR_SUBTYPE, Data: data}
+	case BinaryQuantization:
+		data := make([]byte, 2+(len(vec)+7)/8)
+		data[0], data[1] = _PACKED_BIT_VECTOR, byte((8-len(vec)%8)%8)
+		for i, val := range vec {
+			if val > 0 {
+				// the first dimension is the most significant bit
+				data[2+i/8] |= 0x80 >> (i % 8)
+			}
+		}
+		return primitive.Binary{Subtype: _BINARY_VECTOR_SUBTYPE, Data: data}
+	default:
+		return vec
+	}
+}
+
+// decodes a bson binary vector. Int8 values come back scaled to [-1, 1] and bits as -1 or 1.
+// false if val is not a binary vector
+func DequantizeVector(val any) ([]float32, bool) {
+	bin, ok := val.(primitive.Binary)
+	if !ok || bin.Subtype != _BINARY_VECTOR_SUBTYPE || len(bin.Data) < 2 {
+		return nil, false
+	}
+	data := bin.Data[2:]
+	switch bin.Data[0] {
+	case _INT8_VECTOR:
+		vec := make([]float32, len(data))
+		for i, b := range data {
+			vec[i] = float32(int8(b)) / math.MaxInt8
+		}
+		return vec, true
+	case _PACKED_BIT_VECTOR:
+		size := len(data)*8 - int(bin.Data[1])
+		if size < 0 {
+			return nil, false
+		}
+		vec := make([]float32, size)
+		for i := range vec {
+			vec[i] = -1
+			if data[i/8]&(0x80>>(i%8)) != 0 {
+				vec[i] = 1
+			}
+		}
+		return vec, true
+	default:
+		return nil, false
+	}
+}
+
+// replaces the vectors at the quantized paths of the store with their quantized form. Other docs are returned as they are
+func (store *Store[T]) quantize(docs []any) ([]any, error) {
+	if len(store.quantized) == 0 {
+		return docs, nil
+	}
+	res := make([]any, len(docs))
+	for i := range docs {
+		doc, err := toDocument(docs[i])
+		if err != nil {
+			return nil, err
+		}
+		for vec_path, quantization := range store.quantized {
+			if val, found := lookupPath(doc, vec_path); found {
+				if vec, ok := asVector(val); ok && len(vec) > 0 {
+					setPath(doc, vec_path, QuantizeVector(vec, quantization))
+					if quantization == BinaryQuantization {
+						setPath(doc, vec_path+_RESCORE_SUFFIX, QuantizeVector(vec, Int8Quantization))
+					}
+				}
+			}
+		}
+		res[i] = doc
+	}
+	return res, nil
+}
+
+// decodes the item after turning the quantized vectors back into arrays
+func (store *Store[T]) unmarshal(raw bson.Raw, item *T) error {
+	if len(store.quantized) == 0 {
+		return bson.Unmarshal(raw, item)
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+	dequantized := false
+	for vec_path := range store.quantized {
+		if vec, ok := storedVector(doc, vec_path); ok {
+			unsetPath(doc, vec_path+_RESCORE_SUFFIX)
+			setPath(doc, vec_path, vec)
+			dequantized = true
+		}
+	}
+	if !dequantized {
+		return bson.Unmarshal(raw, item)
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, item)
+}
+
+// the most precise form of the stored vector. false if it is not quantized
+func storedVector(doc bson.M, vec_path string) ([]float32, bool) {
+	if val, found := lookupPath(doc, vec_path+_RESCORE_SUFFIX); found {
+		if vec, ok := DequantizeVector(val); ok {
+			return vec, true
+		}
+	}
+	val, _ := lookupPath(doc, vec_path)
+	return DequantizeVector(val)
+}
+
+// the rescoring copies of the binary quantized vectors go wherever the projection puts the vectors
+func (store *Store[T]) withRescoreFields(fields JSON) JSON {
+	var res JSON
+	for vec_path, quantization := range store.quantized {
+		if val, ok := fields[vec_path]; ok && quantization == BinaryQuantization {
+			if res == nil {
+				res = copyJSON(fields)
+			}
+			res[vec_path+_RESCORE_SUFFIX] = val
+		}
+	}
+	if res == nil {
+		return fields
+	}
+	return res
+}
+
+// Searches the quantized vectors for more than the top n and rescores the candidates with the full precision query
+// before applying the min score, post filter, sort, top n and projection of params. The search scores are the cosine similarity
+// of the query and the dequantized vectors so the score thresholds mean the same thing as without quantization
+func (store *Store[T]) rescoredVectorSearch(ctx context.Context, query_embeddings [][]float32, vec_path string, params *SearchParams, quantization Quantization) ([][]bson.Raw, error) {
+	top_n := params.TopN
+	if top_n <= 0 {
+		top_n = _DEFAULT_SEARCH_TOP_N
+	}
+	candidate_params := *params
+	// atlas doesn't search for more than _ATLAS_MAX_CANDIDATES so a big top n gets less oversampling
+	candidate_params.TopN = max(min(top_n*quantization.oversampling(), _ATLAS_MAX_CANDIDATES), top_n)
+	candidate_params.MinScore, candidate_params.SortBy, candidate_params.PostFilter = nil, nil, nil
+	candidate_params.Quantization = quantization
+	if len(params.Projection) > 0 {
+		// rescoring needs the vectors
+		candidate_params.Projection = withKeyFields(params.Projection, []SortKey{Asc(vec_path), Asc(vec_path + _RESCORE_SUFFIX)})
+	}
+	candidates, err := store.batchSearch(ctx, query_embeddings, vec_path, &candidate_params)
+	if err != nil {
+		return nil, err
+	}
+	stages, err := toPipeline(appendPostSearchStages(nil, params, false))
+	if err != nil {
+		return nil, err
+	}
+	results := make([][]bson.Raw, len(candidates))
+	for i, raws := range candidates {
+		docs := make([]bson.M, 0, len(raws))
+		for _, raw := range raws {
+			var doc bson.M
+			if err := bson.Unmarshal(raw, &doc); err != nil {
+				return nil, err
+			}
+			vec, ok := storedVector(doc, vec_path)
+			if !ok {
+				// items written before quantization got turned on
+				val, _ := lookupPath(doc, vec_path)
+				vec, _ = asVector(val)
+			}
+			doc[_SEARCH_SCORE] = CosineSimilarity(query_embeddings[i], vec)
+			// the projection of params applies to the rescoring copy the same way as to the vector
+			if val, found := lookupPath(doc, vec_path+_RESCORE_SUFFIX); found {
+				unsetPath(doc, vec_path+_RESCORE_SUFFIX)
+				setPath(doc, vec_path, val)
+			}
+			docs = append(docs, doc)
+		}
+		sort.SliceStable(docs, func(a, b int) bool {
+			return docs[a][_SEARCH_SCORE].(float64) > docs[b][_SEARCH_SCORE].(float64)
+		})
+		if len(docs) > top_n {
+			docs = docs[:top_n]
+		}
+		if docs, err = runPipeline(docs, stages); err != nil {
+			return nil, StoreError(fmt.Sprintf("rescoring failed. %v", err))
+		}
+		results[i] = toRaw(docs)
+	}
+	return results, nil
+}
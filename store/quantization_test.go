@@ -0,0 +1,120 @@
+package store
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func randomVector(rng *rand.Rand, dimensions int) []float32 {
+	vec := make([]float32, dimensions)
+	for i := range vec {
+		vec[i] = rng.Float32()*2 - 1
+	}
+	return vec
+}
+
+func TestQuantizeRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	// sizes that don't fill the last byte of packed bits too
+	for _, dimensions := range []int{1, 7, 8, 13, 384} {
+		vec := randomVector(rng, dimensions)
+
+		int8_vec, ok := DequantizeVector(QuantizeVector(vec, Int8Quantization))
+		if !ok || len(int8_vec) != dimensions {
+			t.Fatalf("%d dimensions: int8 round trip failed", dimensions)
+		}
+		if similarity := CosineSimilarity(vec, int8_vec); similarity < 0.99 {
+			t.Fatalf("%d dimensions: int8 round trip lost the direction. cosine %f", dimensions, similarity)
+		}
+
+		bits, ok := DequantizeVector(QuantizeVector(vec, BinaryQuantization))
+		if !ok || len(bits) != dimensions {
+			t.Fatalf("%d dimensions: binary round trip failed", dimensions)
+		}
+		for i := range vec {
+			if (vec[i] > 0) != (bits[i] > 0) || (bits[i] != 1 && bits[i] != -1) {
+				t.Fatalf("%d dimensions: bit %d is %f for %f", dimensions, i, bits[i], vec[i])
+			}
+		}
+	}
+}
+
+func TestQuantizeEdgeCases(t *testing.T) {
+	vec := []float32{0.5, -0.5}
+	if res, ok := QuantizeVector(vec, NoQuantization).([]float32); !ok || len(res) != 2 {
+		t.Fatalf("expected the vector as is, got %v", res)
+	}
+	if res, ok := QuantizeVector(nil, Int8Quantization).([]float32); !ok || len(res) != 0 {
+		t.Fatalf("expected the empty vector as is, got %v", res)
+	}
+	zero, ok := DequantizeVector(QuantizeVector([]float32{0, 0}, Int8Quantization))
+	if !ok || zero[0] != 0 || zero[1] != 0 {
+		t.Fatalf("expected the zero vector back, got %v", zero)
+	}
+	for _, val := range []any{vec, bson.A{1, 2}, nil, "vector"} {
+		if _, ok := DequantizeVector(val); ok {
+			t.Errorf("%v is not a binary vector", val)
+		}
+	}
+}
+
+func TestQuantizedStore(t *testing.T) {
+	ctx := context.Background()
+	rng := rand.New(rand.NewSource(2))
+	for _, quantization := range []Quantization{Int8Quantization, BinaryQuantization} {
+		t.Run(quantization.String(), func(t *testing.T) {
+			store := newTestStore(t, WithQuantizedVectors[testItem](quantization, "vector"))
+			items := make([]testItem, 50)
+			for i := range items {
+				items[i] = testItem{ID: string(rune('A' + i)), Vector: randomVector(rng, 32)}
+			}
+			addItems(t, store, items...)
+
+			// the vectors read back as floats
+			stored, err := store.Get(ctx, JSON{"_id": "A"}, nil, nil, 1)
+			if err != nil || len(stored) != 1 || len(stored[0].Vector) != 32 {
+				t.Fatalf("expected a float vector, got %v %v", stored, err)
+			}
+			raws, err := store.backend.Get(ctx, JSON{"_id": "A"}, nil, nil, 1)
+			if err != nil || len(raws) != 1 {
+				t.Fatalf("expected the stored item, got %v", err)
+			}
+			if raws[0].Lookup("vector").Type != bson.TypeBinary {
+				t.Fatalf("expected the vector to be stored quantized, got %v", raws[0].Lookup("vector").Type)
+			}
+
+			// rescoring finds the item itself as the best match with the full precision score
+			found, err := store.VectorSearch(ctx, [][]float32{items[7].Vector}, "vector", WithVectorTopN(3))
+			if err != nil || len(found) != 3 || found[0].ID != items[7].ID {
+				t.Fatalf("expected %s first, got %s %v", items[7].ID, ids(found), err)
+			}
+			if found[0].SearchScore < 0.95 {
+				t.Fatalf("expected a rescored score close to 1, got %f", found[0].SearchScore)
+			}
+		})
+	}
+}
+
+// hides the optional interfaces of the backend
+type plainBackend struct {
+	Backend
+}
+
+func TestQuantizationNeedsSupport(t *testing.T) {
+	backend, err := openBackend("memory://"+t.Name(), "test", "items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NewWithBackend("items", backend, WithQuantizedVectors[testItem](Int8Quantization, "vector")) == nil {
+		t.Fatal("expected the memory backend to take quantized vectors")
+	}
+	if NewWithBackend("items", Backend(plainBackend{backend}), WithQuantizedVectors[testItem](Int8Quantization, "vector")) != nil {
+		t.Fatal("expected a backend that can't search quantized vectors to be refused")
+	}
+	if NewWithBackend("items", Backend(plainBackend{backend}), WithQuantizedVectors[testItem](NoQuantization, "vector")) == nil {
+		t.Fatal("expected a store without quantized vectors")
+	}
+}
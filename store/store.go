@@ -0,0 +1,301 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	datautils "github.com/soumitsalman/data-utils"
+)
+
+type JSON map[string]any
+
+const (
+	_LOOKUP_BATCH_SIZE = 500 // number of ids in one query that looks up the existing docs
+)
+
+type Store[T any] struct {
+	name          string
+	backend       Backend
+	get_id        func(data *T) JSON
+	equals        func(a, b *T) bool
+	unique_field  string
+	write_policy  WritePolicy
+	content_hash  func(data *T) string
+	unique_fields []string                // id fields that EnsureIndexes puts a unique index on
+	unique_index  atomic.Bool             // the backend enforces the unique index on the id fields
+	quantized     map[string]Quantization // vector fields that are stored quantized
+}
+
+// Creates a store for the collection. The backend is picked based on the scheme of the connection string
+func New[T any](connection_string, database, collection string, opts ...StoreOption[T]) *Store[T] {
+	backend, err := openBackend(connection_string, database, collection)
+	if err != nil {
+		log.Printf("[%s/%s]: Couldn't open backend. %v\n", database, collection, err)
+		return nil
+	}
+	return NewWithBackend(fmt.Sprintf("%s/%s", database, collection), backend, opts...)
+}
+
+// Creates a store on top of an already created backend
+func NewWithBackend[T any](name string, backend Backend, opts ...StoreOption[T]) *Store[T] {
+	if backend == nil {
+		return nil
+	}
+	store := &Store[T]{
+		name:         name,
+		backend:      backend,
+		unique_field: _DEFAULT_UNIQUE_FIELD,
+	}
+	// apply options
+	for _, opt := range opts {
+		opt(store)
+	}
+	// the vector search would skip the quantized vectors without an error
+	if searcher, ok := backend.(QuantizedVectorSearcher); len(store.quantized) > 0 && (!ok || !searcher.SearchesQuantizedVectors()) {
+		log.Printf("[%s]: The vector search of the backend can't search quantized vectors. Use NoQuantization.\n", name)
+		return nil
+	}
+	return store
+}
+
+// Inserts the docs that don't exist yet. The docs that already exist are handled by the write policy of the store.
+// With a unique index the backend finds the existing docs while inserting. Otherwise they get looked up by their ids first.
+// In a backend transaction they are always looked up since a duplicate key error would abort the transaction.
+// Returns the docs that got inserted or written over an existing item
+func (store *Store[T]) Add(ctx context.Context, docs []T) ([]T, error) {
+	// this is done for error handling for mongo db
+	if len(docs) == 0 {
+		log.Printf("[%s]: Empty list of docs, nothing to insert.\n", store.name)
+		return nil, nil
+	}
+
+	// if there is no id function then treat each item as unique
+	var existing_items map[string]T
+	var duplicates []T
+	if (!store.unique_index.Load() || inNativeTransaction(ctx)) && store.get_id != nil && store.equals != nil {
+		var err error
+		if existing_items, err = store.getExisting(ctx, docs); err != nil {
+			return nil, err
+		}
+		docs, duplicates = store.splitExisting(docs, existing_items)
+	}
+	inserted, found_duplicates, err := store.insert(ctx, docs)
+	if err != nil {
+		return inserted, err
+	}
+	duplicates = append(duplicates, found_duplicates...)
+
+	// if these docs already exist just return without error
+	if len(duplicates) == 0 || store.write_policy == SkipExisting || store.get_id == nil {
+		if len(inserted) == 0 {
+			log.Printf("[%s]: Docs already exists, nothing new to insert.\n", store.name)
+		}
+		return inserted, nil
+	}
+	changed_docs, err := store.applyWritePolicy(ctx, duplicates, existing_items)
+	if err != nil || len(changed_docs) == 0 {
+		return inserted, err
+	}
+	res, err := store.writeExisting(ctx, changed_docs)
+	if err != nil {
+		log.Printf("[%s]: Writing over %d existing items (%s) failed. %v\n", store.name, len(res.Failed), store.write_policy, err)
+	}
+	log.Printf("[%s]: %d existing items written (%s).\n", store.name, len(changed_docs)-len(res.Failed), store.write_policy)
+	for i := range changed_docs {
+		if _, failed := res.Failed[i]; !failed {
+			inserted = append(inserted, changed_docs[i])
+		}
+	}
+	return inserted, err
+}
+
+// Returns the docs that got inserted and the ones that already exist according to the unique index of the backend
+func (store *Store[T]) insert(ctx context.Context, docs []T) ([]T, []T, error) {
+	if len(docs) == 0 {
+		return nil, nil, nil
+	}
+	items, err := store.quantize(datautils.Transform(docs, func(item *T) any { return *item }))
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := store.backend.Add(ctx, items)
+	inserted := pick(docs, res.Inserted)
+	duplicates := pick(docs, res.Duplicates)
+	if len(duplicates) > 0 {
+		log.Printf("[%s]: %d items already exist.\n", store.name, len(duplicates))
+	}
+	if err != nil {
+		log.Printf("[%s]: Insertion failed for %d items. %v\n", store.name, len(res.Failed), err)
+		return inserted, duplicates, err
+	}
+	log.Printf("[%s]: %d items inserted.\n", store.name, len(inserted))
+	return inserted, duplicates, nil
+}
+
+// docs is an array of any struct that is bson serializable. Returns how many items matched and changed and which docs failed.
+// If some of the updates fail, the error is for those and the rest still get written
+func (store *Store[T]) Update(ctx context.Context, docs []any, filters []JSON) (UpdateResult, error) {
+	if len(docs) != len(filters) {
+		return UpdateResult{}, StoreError(fmt.Sprintf("%d docs and %d filters don't match", len(docs), len(filters)))
+	}
+	docs, err := store.quantize(docs)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	res, err := store.backend.Update(ctx, docs, filters)
+	if err != nil {
+		log.Printf("[%s]: Update failed for %d items. %v\n", store.name, len(res.Failed), err)
+	}
+	log.Printf("[%s]: %d items updated.\n", store.name, len(docs)-len(res.Failed))
+	return res, err
+}
+
+func (store *Store[T]) Get(ctx context.Context, filter JSON, fields JSON, sort_by JSON, top_n int) ([]T, error) {
+	return store.decode(store.backend.Get(ctx, filter, store.withRescoreFields(fields), sort_by, top_n))
+}
+
+func (store *Store[T]) Aggregate(ctx context.Context, pipeline any) ([]T, error) {
+	return store.decode(store.backend.Aggregate(ctx, pipeline))
+}
+
+// regular keyword/text search
+func (store *Store[T]) TextSearch(ctx context.Context, query_texts []string, options ...SearchOption) ([]T, error) {
+	params := NewSearchParams(options...)
+	if len(params.SortBy) > 0 {
+		// the unique field breaks the ties so that the order doesn't depend on how the backend happened to find the items
+		params.SortBy = pageKeys(params.SortBy, Desc(store.unique_field))
+	}
+	return store.decode(store.backend.TextSearch(ctx, query_texts, params))
+}
+
+// Searches with each of the query embeddings and merges the results. An item that matches more than one of them gets one result
+// with the scores combined by the score aggregation of the options. The results are sorted by the combined score
+// unless the options sort them otherwise and the top n of the options applies to the merged results
+func (store *Store[T]) VectorSearch(ctx context.Context, query_embeddings [][]float32, vec_path string, options ...SearchOption) ([]T, error) {
+	params := NewSearchParams(options...)
+	// the unique field breaks the ties so that the order doesn't depend on the order the results came in
+	keys := []SortKey{Desc(_SEARCH_SCORE), Desc(store.unique_field)}
+	if len(params.SortBy) > 0 {
+		keys = pageKeys(params.SortBy, Desc(store.unique_field))
+	}
+	if len(params.Projection) > 0 {
+		// merging needs the scores and the unique field and sorting needs the sort keys
+		params.Projection = withKeyFields(params.Projection, append(keys, Desc(_SEARCH_SCORE)))
+	}
+	docs, err := store.vectorSearchMerged(ctx, query_embeddings, vec_path, params)
+	if err != nil {
+		log.Printf("[%s]: Search failed. %v\n", store.name, err)
+		return nil, err
+	}
+	docs = sortDocuments(docs, sortDocument(keys))
+	if params.TopN > 0 && len(docs) > params.TopN {
+		docs = docs[:params.TopN]
+	}
+	return store.decode(toRaw(docs), nil)
+}
+
+func (store *Store[T]) Delete(ctx context.Context, filter JSON) (int, error) {
+	count, err := store.backend.Delete(ctx, filter)
+	if err != nil {
+		log.Printf("[%s]: Deletion failed. %v\n", store.name, err)
+		return 0, err
+	}
+	log.Printf("[%s]: %d items deleted.\n", store.name, count)
+	return count, nil
+}
+
+// releases the connections held by the backend. The store shouldn't be used after this
+func (store *Store[T]) Close(ctx context.Context) error {
+	if closer, ok := store.backend.(Closer); ok {
+		return closer.Close(ctx)
+	}
+	return nil
+}
+
+// looks up the existing items in batches so that the query doesn't go over the size limit. The items are keyed by idKey
+func (store *Store[T]) getExisting(ctx context.Context, docs []T) (map[string]T, error) {
+	existing_items := make(map[string]T)
+	for i := 0; i < len(docs); i += _LOOKUP_BATCH_SIZE {
+		batch := datautils.SafeSlice(docs, i, i+_LOOKUP_BATCH_SIZE)
+		items, err := store.Get(ctx, JSON{"$or": store.getIDs(batch)}, nil, nil, -1)
+		if err != nil {
+			return nil, err
+		}
+		for j := range items {
+			existing_items[store.idKey(&items[j])] = items[j]
+		}
+	}
+	return existing_items, nil
+}
+
+// splits the docs into the new ones and the ones that are in existing_items
+func (store *Store[T]) splitExisting(docs []T, existing_items map[string]T) ([]T, []T) {
+	new_docs := make([]T, 0, len(docs))
+	var duplicates []T
+	for i := range docs {
+		if _, ok := existing_items[store.idKey(&docs[i])]; ok {
+			duplicates = append(duplicates, docs[i])
+		} else {
+			new_docs = append(new_docs, docs[i])
+		}
+	}
+	return new_docs, duplicates
+}
+
+// docs with the same id get the same key
+func (store *Store[T]) idKey(item *T) string {
+	id := store.get_id(item)
+	keys := make([]string, 0, len(id))
+	for key := range id {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	doc := make(bson.D, 0, len(keys))
+	for _, key := range keys {
+		doc = append(doc, bson.E{Key: key, Value: id[key]})
+	}
+	data, err := bson.MarshalExtJSON(doc, true, false)
+	if err != nil {
+		return fmt.Sprint(doc)
+	}
+	return string(data)
+}
+
+func (store *Store[T]) getIDs(items []T) []JSON {
+	return datautils.Transform(items, func(item *T) JSON {
+		return store.get_id(item)
+	})
+}
+
+// items at the given positions
+func pick[T any](items []T, positions []int) []T {
+	res := make([]T, 0, len(positions))
+	for _, i := range positions {
+		res = append(res, items[i])
+	}
+	return res
+}
+
+// unmarshalls the raw documents returned by the backend
+func (store *Store[T]) decode(raws []bson.Raw, err error) ([]T, error) {
+	if err != nil {
+		log.Printf("[%s]: Couldn't retrieve items. %v\n", store.name, err)
+		return nil, err
+	}
+	if len(raws) == 0 {
+		return nil, nil
+	}
+	contents := make([]T, len(raws))
+	for i, raw := range raws {
+		if err = store.unmarshal(raw, &contents[i]); err != nil {
+			log.Printf("[%s]: Couldn't unmarshall item. %v\n", store.name, err)
+			return nil, err
+		}
+	}
+	return contents, nil
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+type testItem struct {
+	ID          string    `bson:"_id"`
+	Title       string    `bson:"title,omitempty"`
+	Rank        int       `bson:"rank"`
+	Vector      []float32 `bson:"vector,omitempty"`
+	SearchScore float64   `bson:"search_score,omitempty"`
+}
+
+// a store on its own in-memory collection
+func newTestStore(t *testing.T, opts ...StoreOption[testItem]) *Store[testItem] {
+	t.Helper()
+	opts = append([]StoreOption[testItem]{
+		WithDataIDAndEqualsFunction(
+			func(item *testItem) JSON { return JSON{"_id": item.ID} },
+			func(a, b *testItem) bool { return a.ID == b.ID }),
+	}, opts...)
+	store := New("memory://"+t.Name(), "test", "items", opts...)
+	if store == nil {
+		t.Fatal("couldn't create the store")
+	}
+	return store
+}
+
+func addItems(t *testing.T, store *Store[testItem], items ...testItem) {
+	t.Helper()
+	if _, err := store.Add(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ids(items []testItem) string {
+	res := make([]string, len(items))
+	for i := range items {
+		res[i] = items[i].ID
+	}
+	return fmt.Sprint(res)
+}
+
+func TestAddSkipsExisting(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t, WithUniqueIndex[testItem]("_id"))
+	addItems(t, store, testItem{ID: "a", Rank: 1})
+	// the unique index only gets relied on once EnsureIndexes creates it
+	if store.unique_index.Load() {
+		t.Fatal("the option created the unique index")
+	}
+	if _, err := store.EnsureIndexes(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !store.unique_index.Load() {
+		t.Fatal("EnsureIndexes didn't create the unique index")
+	}
+	inserted, err := store.Add(ctx, []testItem{{ID: "a", Rank: 2}, {ID: "b", Rank: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids(inserted) != "[b]" {
+		t.Fatalf("expected only b to be inserted, got %s", ids(inserted))
+	}
+	items, err := store.Get(ctx, JSON{"_id": "a"}, nil, nil, -1)
+	if err != nil || len(items) != 1 || items[0].Rank != 1 {
+		t.Fatalf("expected the original a, got %v %v", items, err)
+	}
+}
+
+func TestAddReplacesExisting(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t, WithWritePolicy[testItem](ReplaceExisting))
+	addItems(t, store, testItem{ID: "a", Rank: 1})
+	inserted, err := store.Add(ctx, []testItem{{ID: "a", Rank: 2}})
+	if err != nil || ids(inserted) != "[a]" {
+		t.Fatalf("expected a to be replaced, got %s %v", ids(inserted), err)
+	}
+	items, _ := store.Get(ctx, JSON{}, nil, nil, -1)
+	if len(items) != 1 || items[0].Rank != 2 {
+		t.Fatalf("expected one item with rank 2, got %v", items)
+	}
+}
@@ -0,0 +1,326 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Tenant scopes a store to the items of one tenant. The zero value is no scoping
+type Tenant struct {
+	Name string
+	// when set the tenants share the collections and each item carries the name of its tenant in this field.
+	// Otherwise each tenant gets its own collections named <tenant>_<collection>
+	Field string
+	// deletes don't have a document to tell the tenant by. Watch uses the pre-image of the document when the backend has it.
+	// Without pre-images Watch leaves the deletes out unless this is set. Then it reads the _id of every item of the tenant
+	// when the stream opens and keeps them in memory along with the ones added after, so it only suits small tenants
+	TrackDeletes bool
+}
+
+// Same as New but every operation of the store only sees and writes the items of the tenant.
+// With a tenant field the unique and scalar indexes get the field as their first key and the vector indexes get it as a filter field.
+// Pipelines that reach into other collections such as $lookup are not scoped
+func NewForTenant[T any](connection_string, database, collection string, tenant Tenant, opts ...StoreOption[T]) *Store[T] {
+	switch {
+	case tenant.Name == "":
+		return New(connection_string, database, collection, opts...)
+	case tenant.Field == "":
+		return New(connection_string, database, tenant.Name+"_"+collection, opts...)
+	}
+	backend, err := openBackend(connection_string, database, collection)
+	if err != nil {
+		log.Printf("[%s/%s]: Couldn't open backend. %v\n", database, collection, err)
+		return nil
+	}
+	// the options go on the scoped backend so that the unique index includes the tenant field
+	return NewWithBackend(fmt.Sprintf("%s/%s@%s", database, collection, tenant.Name), TenantBackend(backend, tenant), opts...)
+}
+
+// wraps the backend so that it only sees and writes the items that have the tenant's name in the tenant field
+func TenantBackend(backend Backend, tenant Tenant) Backend {
+	return &tenantBackend{backend: backend, field: tenant.Field, name: tenant.Name, track_deletes: tenant.TrackDeletes}
+}
+
+// tenantBackend implements all the optional backend interfaces and falls back the way Store does when the wrapped backend doesn't
+type tenantBackend struct {
+	backend       Backend
+	field         string
+	name          string
+	track_deletes bool
+}
+
+// ands the tenant condition to the filter
+func (backend *tenantBackend) scope(filter JSON) JSON {
+	if len(filter) == 0 {
+		return JSON{backend.field: backend.name}
+	}
+	if _, ok := filter[backend.field]; ok {
+		return JSON{"$and": []JSON{filter, {backend.field: backend.name}}}
+	}
+	scoped := copyJSON(filter)
+	scoped[backend.field] = backend.name
+	return scoped
+}
+
+func (backend *tenantBackend) scopeAll(filters []JSON) []JSON {
+	scoped := make([]JSON, len(filters))
+	for i := range filters {
+		scoped[i] = backend.scope(filters[i])
+	}
+	return scoped
+}
+
+func (backend *tenantBackend) scopeParams(params *SearchParams) *SearchParams {
+	scoped := *params
+	scoped.Filter = backend.scope(params.Filter)
+	return &scoped
+}
+
+// search stages have to be the first stage so the match goes right after them.
+// A leading $match gets the tenant condition itself since a $text query has to stay in the first stage
+func (backend *tenantBackend) scopePipeline(pipeline any) ([]bson.D, error) {
+	stages, err := toPipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	match := bson.D{{Key: "$match", Value: JSON{backend.field: backend.name}}}
+	if len(stages) > 0 && len(stages[0]) > 0 {
+		switch stages[0][0].Key {
+		case "$match":
+			filter, ok := asMap(stages[0][0].Value)
+			if !ok {
+				return nil, StoreError("$match has to be a document")
+			}
+			return append([]bson.D{{{Key: "$match", Value: backend.scope(JSON(filter))}}}, stages[1:]...), nil
+		case "$search", "$vectorSearch", "$searchMeta", "$geoNear":
+			return append(append([]bson.D{stages[0]}, match), stages[1:]...), nil
+		}
+	}
+	return append([]bson.D{match}, stages...), nil
+}
+
+// sets the tenant field of the docs
+func (backend *tenantBackend) tag(docs []any) ([]any, error) {
+	tagged := make([]any, len(docs))
+	for i := range docs {
+		doc, err := toDocument(docs[i])
+		if err != nil {
+			return nil, err
+		}
+		doc[backend.field] = backend.name
+		tagged[i] = doc
+	}
+	return tagged, nil
+}
+
+func (backend *tenantBackend) Add(ctx context.Context, docs []any) (InsertResult, error) {
+	tagged, err := backend.tag(docs)
+	if err != nil {
+		return InsertResult{Failed: positions(len(docs))}, err
+	}
+	return backend.backend.Add(ctx, tagged)
+}
+
+func (backend *tenantBackend) Update(ctx context.Context, docs []any, filters []JSON) (UpdateResult, error) {
+	return backend.backend.Update(ctx, docs, backend.scopeAll(filters))
+}
+
+func (backend *tenantBackend) Replace(ctx context.Context, docs []any, filters []JSON) (UpdateResult, error) {
+	tagged, err := backend.tag(docs)
+	if err != nil {
+		return failAll(len(docs), err), err
+	}
+	return backend.backend.Replace(ctx, tagged, backend.scopeAll(filters))
+}
+
+func (backend *tenantBackend) Get(ctx context.Context, filter JSON, fields JSON, sort_by JSON, top_n int) ([]bson.Raw, error) {
+	return backend.backend.Get(ctx, backend.scope(filter), fields, sort_by, top_n)
+}
+
+func (backend *tenantBackend) Aggregate(ctx context.Context, pipeline any) ([]bson.Raw, error) {
+	stages, err := backend.scopePipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	return backend.backend.Aggregate(ctx, stages)
+}
+
+func (backend *tenantBackend) TextSearch(ctx context.Context, query_texts []string, params *SearchParams) ([]bson.Raw, error) {
+	return backend.backend.TextSearch(ctx, query_texts, backend.scopeParams(params))
+}
+
+func (backend *tenantBackend) VectorSearch(ctx context.Context, query_embedding []float32, vec_path string, params *SearchParams) ([]bson.Raw, error) {
+	return backend.backend.VectorSearch(ctx, query_embedding, vec_path, backend.scopeParams(params))
+}
+
+func (backend *tenantBackend) BatchVectorSearch(ctx context.Context, query_embeddings [][]float32, vec_path string, params *SearchParams) ([][]bson.Raw, error) {
+	if searcher, ok := backend.backend.(BatchVectorSearcher); ok {
+		return searcher.BatchVectorSearch(ctx, query_embeddings, vec_path, backend.scopeParams(params))
+	}
+	results := make([][]bson.Raw, len(query_embeddings))
+	for i, vec := range query_embeddings {
+		raws, err := backend.VectorSearch(ctx, vec, vec_path, params)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = raws
+	}
+	return results, nil
+}
+
+func (backend *tenantBackend) Delete(ctx context.Context, filter JSON) (int, error) {
+	return backend.backend.Delete(ctx, backend.scope(filter))
+}
+
+func (backend *tenantBackend) StreamGet(ctx context.Context, filter JSON, fields JSON, sort_by JSON, top_n int) (RawIterator, error) {
+	if streamer, ok := backend.backend.(Streamer); ok {
+		return streamer.StreamGet(ctx, backend.scope(filter), fields, sort_by, top_n)
+	}
+	return sliceIterator(backend.Get(ctx, filter, fields, sort_by, top_n))
+}
+
+func (backend *tenantBackend) StreamAggregate(ctx context.Context, pipeline any) (RawIterator, error) {
+	streamer, ok := backend.backend.(Streamer)
+	if !ok {
+		return sliceIterator(backend.Aggregate(ctx, pipeline))
+	}
+	stages, err := backend.scopePipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	return streamer.StreamAggregate(ctx, stages)
+}
+
+// Deletes don't carry the document so the wrapped backend lets the deletes of every tenant through.
+// The stream keeps track of the ids of the tenant's items and drops the deletes of the others.
+// When it resumes from a token the deletes of the items that were already gone when it started get dropped too
+func (backend *tenantBackend) Watch(ctx context.Context, filter JSON, resume_token bson.Raw) (ChangeStream, error) {
+	watcher, ok := backend.backend.(Watcher)
+	if !ok {
+		return nil, ErrWatchNotSupported
+	}
+	stream, err := watcher.Watch(ctx, backend.scope(filter), resume_token)
+	if err != nil {
+		return nil, err
+	}
+	if !backend.track_deletes {
+		return &tenantChangeStream{ChangeStream: stream, backend: backend}, nil
+	}
+	// the ids get read after the stream starts so that the items added in between come through the stream
+	raws, err := backend.Get(ctx, nil, JSON{"_id": 1}, nil, -1)
+	if err != nil {
+		stream.Close(ctx)
+		return nil, err
+	}
+	ids := make(map[string]bool, len(raws))
+	for _, raw := range raws {
+		var doc bson.M
+		if err = bson.Unmarshal(raw, &doc); err != nil {
+			stream.Close(ctx)
+			return nil, err
+		}
+		ids[uniqueKey(doc, []string{"_id"})] = true
+	}
+	return &tenantChangeStream{ChangeStream: stream, backend: backend, ids: ids}, nil
+}
+
+// passes the deletes of the tenant's items. See Tenant.TrackDeletes
+type tenantChangeStream struct {
+	ChangeStream
+	backend *tenantBackend
+	ids     map[string]bool // the tenant's items that the stream has seen. nil unless the deletes are tracked
+}
+
+func (stream *tenantChangeStream) Next(ctx context.Context) bool {
+	for stream.ChangeStream.Next(ctx) {
+		change := stream.Current()
+		key := uniqueKey(bson.M{"_id": change.ID}, []string{"_id"})
+		switch {
+		case change.Kind != ChangeDelete:
+			if stream.ids != nil {
+				stream.ids[key] = true
+			}
+			return true
+		case change.Before != nil:
+			delete(stream.ids, key)
+			if stream.backend.owns(change.Before) {
+				return true
+			}
+		case stream.ids[key]:
+			delete(stream.ids, key)
+			return true
+		}
+	}
+	return false
+}
+
+// whether the document has the tenant's name in the tenant field
+func (backend *tenantBackend) owns(doc bson.Raw) bool {
+	val, err := doc.LookupErr(backend.field)
+	if err != nil {
+		return false
+	}
+	name, ok := val.StringValueOK()
+	return ok && name == backend.name
+}
+
+func (backend *tenantBackend) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if transactor, ok := backend.backend.(Transactor); ok {
+		return transactor.WithTransaction(ctx, fn)
+	}
+	return ErrTransactionsNotSupported
+}
+
+func (backend *tenantBackend) SetTextFields(fields []string) {
+	if indexer, ok := backend.backend.(TextIndexer); ok {
+		indexer.SetTextFields(fields)
+	}
+}
+
+func (backend *tenantBackend) SetVectorSearchDialect(dialect VectorSearchDialect) {
+	if indexer, ok := backend.backend.(VectorIndexer); ok {
+		indexer.SetVectorSearchDialect(dialect)
+	}
+}
+
+func (backend *tenantBackend) SearchesQuantizedVectors() bool {
+	searcher, ok := backend.backend.(QuantizedVectorSearcher)
+	return ok && searcher.SearchesQuantizedVectors()
+}
+
+func (backend *tenantBackend) SetVectorIndex(vec_path, index_name string) {
+	if indexer, ok := backend.backend.(VectorIndexer); ok {
+		indexer.SetVectorIndex(vec_path, index_name)
+	}
+}
+
+func (backend *tenantBackend) EnsureIndexes(ctx context.Context, specs []IndexSpec) (IndexReport, error) {
+	manager, ok := backend.backend.(IndexManager)
+	if !ok {
+		return IndexReport{}, nil
+	}
+	scoped := make([]IndexSpec, len(specs))
+	for i, spec := range specs {
+		scoped[i] = spec
+		switch {
+		case spec.Kind == VectorIndex:
+			scoped[i].Keys = append(append([]SortKey(nil), spec.Keys...), Asc(backend.field))
+		case spec.Kind == TextIndex:
+			// the text search filters on the tenant field without it being part of the index
+		default:
+			// this also makes the unique indexes unique within the tenant
+			scoped[i].Keys = append([]SortKey{Asc(backend.field)}, spec.Keys...)
+		}
+	}
+	return manager.EnsureIndexes(ctx, scoped)
+}
+
+func (backend *tenantBackend) Close(ctx context.Context) error {
+	if closer, ok := backend.backend.(Closer); ok {
+		return closer.Close(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTenantScoping(t *testing.T) {
+	ctx := context.Background()
+	backend, err := openBackend("memory://"+t.Name(), "test", "items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := TenantBackend(backend, Tenant{Name: "first", Field: "tenant"}), TenantBackend(backend, Tenant{Name: "second", Field: "tenant"})
+	first.Add(ctx, []any{bson.M{"_id": "a", "title": "go"}})
+	second.Add(ctx, []any{bson.M{"_id": "b", "title": "go"}})
+
+	raws, err := first.Get(ctx, JSON{"title": "go"}, nil, nil, -1)
+	if err != nil || len(raws) != 1 || raws[0].Lookup("_id").StringValue() != "a" {
+		t.Fatalf("expected only the item of the tenant, got %v %v", raws, err)
+	}
+	// the tenant field can't be used to reach into the other tenant
+	if raws, _ = first.Get(ctx, JSON{"tenant": "second"}, nil, nil, -1); len(raws) != 0 {
+		t.Fatalf("got the items of the other tenant %v", raws)
+	}
+	if deleted, _ := first.Delete(ctx, JSON{}); deleted != 1 {
+		t.Fatalf("expected to delete only the item of the tenant, deleted %d", deleted)
+	}
+	if raws, _ = backend.Get(ctx, JSON{}, nil, nil, -1); len(raws) != 1 {
+		t.Fatalf("expected the item of the other tenant to stay, got %d items", len(raws))
+	}
+}
+
+func TestScopePipeline(t *testing.T) {
+	backend := &tenantBackend{field: "tenant", name: "first"}
+	tests := []struct {
+		pipeline []JSON
+		expected string
+	}{
+		{nil, `[[{$match map[tenant:first]}]]`},
+		{[]JSON{{"$sort": JSON{"a": 1}}}, `[[{$match map[tenant:first]}] [{$sort [{a 1}]}]]`},
+		// a leading $match keeps its place so that a $text query stays in the first stage
+		{
+			[]JSON{{"$match": JSON{"$text": JSON{"$search": "go"}}}, {"$limit": 1}},
+			`[[{$match map[$text:[{$search go}] tenant:first]}] [{$limit 1}]]`,
+		},
+		{
+			[]JSON{{"$vectorSearch": JSON{"limit": 1}}, {"$limit": 1}},
+			`[[{$vectorSearch [{limit 1}]}] [{$match map[tenant:first]}] [{$limit 1}]]`,
+		},
+	}
+	for _, test := range tests {
+		stages, err := backend.scopePipeline(test.pipeline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := fmt.Sprint(stages); actual != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, actual)
+		}
+	}
+}
+
+type sliceChangeStream struct {
+	changes []RawChange
+	next    int
+}
+
+func (stream *sliceChangeStream) Next(ctx context.Context) bool {
+	stream.next++
+	return stream.next <= len(stream.changes)
+}
+
+func (stream *sliceChangeStream) Current() RawChange {
+	return stream.changes[stream.next-1]
+}
+
+func (stream *sliceChangeStream) Err() error {
+	return nil
+}
+
+func (stream *sliceChangeStream) Close(ctx context.Context) error {
+	return nil
+}
+
+// a backend whose change stream has the changes of every tenant
+type changesBackend struct {
+	Backend
+	changes []RawChange
+}
+
+func (backend changesBackend) Watch(ctx context.Context, filter JSON, resume_token bson.Raw) (ChangeStream, error) {
+	return &sliceChangeStream{changes: backend.changes}, nil
+}
+
+func rawDoc(t *testing.T, doc bson.M) bson.Raw {
+	t.Helper()
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// the kinds and ids of the changes that the tenant's stream lets through
+func watchedChanges(t *testing.T, backend Backend, tenant Tenant, changes []RawChange) string {
+	t.Helper()
+	ctx := context.Background()
+	stream, err := TenantBackend(changesBackend{Backend: backend, changes: changes}, tenant).(Watcher).Watch(ctx, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen []string
+	for stream.Next(ctx) {
+		change := stream.Current()
+		seen = append(seen, fmt.Sprintf("%s %v", change.Kind, change.ID))
+	}
+	return fmt.Sprint(seen)
+}
+
+func TestTenantWatchScopesDeletes(t *testing.T) {
+	ctx := context.Background()
+	backend, err := openBackend("memory://"+t.Name(), "test", "items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant := Tenant{Name: "first", Field: "tenant"}
+	TenantBackend(backend, tenant).Add(ctx, []any{bson.M{"_id": "a"}})
+	TenantBackend(backend, Tenant{Name: "second", Field: "tenant"}).Add(ctx, []any{bson.M{"_id": "b"}})
+	changes := []RawChange{
+		{Kind: ChangeDelete, ID: "b"}, // the other tenant's
+		{Kind: ChangeInsert, ID: "c"}, // added after the stream started
+		{Kind: ChangeDelete, ID: "a"},
+		{Kind: ChangeDelete, ID: "c"},
+	}
+
+	// without pre-images the deletes can't be told apart
+	if actual := watchedChanges(t, backend, tenant, changes); actual != "[insert c]" {
+		t.Fatalf("expected the deletes to be left out, got %s", actual)
+	}
+
+	tracked := tenant
+	tracked.TrackDeletes = true
+	if actual := watchedChanges(t, backend, tracked, changes); actual != "[insert c delete a delete c]" {
+		t.Fatalf("expected the tracked deletes of the tenant, got %s", actual)
+	}
+
+	// the pre-images tell the tenant without tracking the ids
+	with_before := []RawChange{
+		{Kind: ChangeDelete, ID: "b", Before: rawDoc(t, bson.M{"_id": "b", "tenant": "second"})},
+		{Kind: ChangeDelete, ID: "x", Before: rawDoc(t, bson.M{"_id": "x", "tenant": "first"})},
+	}
+	if actual := watchedChanges(t, backend, tenant, with_before); actual != "[delete x]" {
+		t.Fatalf("expected the delete of the tenant's item, got %s", actual)
+	}
+}
@@ -0,0 +1,155 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	datautils "github.com/soumitsalman/data-utils"
+)
+
+// Backends that can run multi-document transactions. The writes that fn makes with its ctx are committed together or not at all
+type Transactor interface {
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// returned by Transactor.WithTransaction when the deployment can't run transactions so that Store falls back to compensating writes
+var ErrTransactionsNotSupported = StoreError("transactions are not supported")
+
+// Transaction is the state of one Store.Transaction run.
+// With a backend transaction the writes roll back on their own. Otherwise the rollbacks registered through
+// OnRollback and Checkpoint undo what got written
+type Transaction struct {
+	native    bool
+	rollbacks []func(ctx context.Context) error
+}
+
+type transactionKey struct{}
+
+// Runs fn in a transaction of the backend when it has them. The other stores on the same connection string take part in it
+// as long as fn calls them with the ctx that it gets. Fn can run more than once if the backend retries the transaction.
+// Backends without transactions run fn as is and if it fails the rollbacks that it registered run in reverse order.
+// The error of fn is returned either way and a failed rollback is added to it
+func (store *Store[T]) Transaction(ctx context.Context, fn func(ctx context.Context, tx *Transaction) error) error {
+	if transactor, ok := store.backend.(Transactor); ok {
+		err := transactor.WithTransaction(ctx, func(ctx context.Context) error {
+			tx := &Transaction{native: true}
+			return fn(context.WithValue(ctx, transactionKey{}, tx), tx)
+		})
+		if !errors.Is(err, ErrTransactionsNotSupported) {
+			return err
+		}
+		log.Printf("[%s]: Transactions are not available. Falling back to compensating writes.\n", store.name)
+	}
+	tx := &Transaction{}
+	err := fn(ctx, tx)
+	if err == nil {
+		return nil
+	}
+	// the rollback has to run even if the caller is gone
+	if rollback_err := tx.rollback(context.WithoutCancel(ctx)); rollback_err != nil {
+		log.Printf("[%s]: Rollback failed. %v\n", store.name, rollback_err)
+		return errors.Join(err, fmt.Errorf("rollback failed: %w", rollback_err))
+	}
+	return err
+}
+
+// true if the writes get rolled back by the backend
+func (tx *Transaction) Native() bool {
+	return tx.native
+}
+
+// undo runs if the transaction fails. It is ignored for backend transactions
+func (tx *Transaction) OnRollback(undo func(ctx context.Context) error) {
+	if !tx.native {
+		tx.rollbacks = append(tx.rollbacks, undo)
+	}
+}
+
+func (tx *Transaction) rollback(ctx context.Context) error {
+	var errs []error
+	for i := len(tx.rollbacks) - 1; i >= 0; i-- {
+		errs = append(errs, tx.rollbacks[i](ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// true if ctx belongs to a backend transaction. Write errors abort those so Add can't rely on duplicate key errors in them
+func inNativeTransaction(ctx context.Context) bool {
+	tx, ok := ctx.Value(transactionKey{}).(*Transaction)
+	return ok && tx.native
+}
+
+// Records the documents that match the filter so that a rollback of tx brings them back:
+// the documents that match the filter at the time of the rollback get deleted and the recorded ones get put back as they were.
+// Call it before the writes with a filter that matches the documents that the writes add or change. Does nothing in backend transactions
+func (store *Store[T]) Checkpoint(ctx context.Context, tx *Transaction, filter JSON) error {
+	if tx.native {
+		return nil
+	}
+	if len(filter) == 0 {
+		// rolling back an empty filter would delete everything
+		return StoreError(fmt.Sprintf("checkpoint for %s needs a filter", store.name))
+	}
+	raws, err := store.backend.Get(ctx, filter, nil, nil, -1)
+	if err != nil {
+		return err
+	}
+	docs := make([]any, len(raws))
+	ids := make(bson.A, len(raws))
+	for i, raw := range raws {
+		var doc bson.M
+		if err = bson.Unmarshal(raw, &doc); err != nil {
+			return err
+		}
+		docs[i], ids[i] = doc, doc["_id"]
+	}
+	tx.OnRollback(func(ctx context.Context) error {
+		return store.restore(ctx, filter, docs, ids)
+	})
+	return nil
+}
+
+// Same as Checkpoint for the documents that match the filter and have one of the values in the field.
+// The values get recorded in batches so that the queries stay under the size limit
+func (store *Store[T]) CheckpointIn(ctx context.Context, tx *Transaction, filter JSON, field string, values []any) error {
+	for i := 0; i < len(values); i += _LOOKUP_BATCH_SIZE {
+		batch := JSON{field: JSON{"$in": datautils.SafeSlice(values, i, i+_LOOKUP_BATCH_SIZE)}}
+		if len(filter) > 0 {
+			batch = JSON{"$and": []JSON{filter, batch}}
+		}
+		if err := store.Checkpoint(ctx, tx, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletes the documents that match the filter and the recorded ones and puts the recorded ones back. The ids and the documents go in batches
+func (store *Store[T]) restore(ctx context.Context, filter JSON, docs []any, ids bson.A) error {
+	if _, err := store.backend.Delete(ctx, filter); err != nil {
+		return err
+	}
+	// the recorded documents that the writes changed so that they don't match the filter any more
+	for i := 0; i < len(ids); i += _LOOKUP_BATCH_SIZE {
+		if _, err := store.backend.Delete(ctx, JSON{"_id": JSON{"$in": datautils.SafeSlice(ids, i, i+_LOOKUP_BATCH_SIZE)}}); err != nil {
+			return err
+		}
+	}
+	inserted := 0
+	for i := 0; i < len(docs); i += _LOOKUP_BATCH_SIZE {
+		res, err := store.backend.Add(ctx, datautils.SafeSlice(docs, i, i+_LOOKUP_BATCH_SIZE))
+		inserted += len(res.Inserted)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("[%s]: Rolled back to %d items.\n", store.name, inserted)
+	if inserted < len(docs) {
+		return StoreError(fmt.Sprintf("restored %d of %d items of %s", inserted, len(docs), store.name))
+	}
+	return nil
+}
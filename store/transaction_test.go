@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestCheckpointRollback(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t, WithWritePolicy[testItem](ReplaceExisting))
+	addItems(t, store, testItem{ID: "a", Rank: 1}, testItem{ID: "b", Rank: 1}, testItem{ID: "other", Rank: 1})
+
+	failure := StoreError("failed")
+	err := store.Transaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		if tx.Native() {
+			t.Fatal("the memory backend doesn't have transactions")
+		}
+		if err := store.Checkpoint(ctx, tx, JSON{"_id": JSON{"$in": []string{"a", "b", "c"}}}); err != nil {
+			return err
+		}
+		// a replace, a new item and an item that gets changed so that it doesn't match the filter any more
+		if _, err := store.Add(ctx, []testItem{{ID: "a", Rank: 2}, {ID: "c", Rank: 2}}); err != nil {
+			return err
+		}
+		if _, err := store.Update(ctx, []any{JSON{"rank": 3}}, []JSON{{"_id": "b"}}); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("expected the error of the transaction, got %v", err)
+	}
+	items, err := store.Get(ctx, JSON{}, nil, JSON{"_id": 1}, -1)
+	if err != nil || ids(items) != "[a b other]" {
+		t.Fatalf("expected the items before the transaction, got %s %v", ids(items), err)
+	}
+	for _, item := range items {
+		if item.Rank != 1 {
+			t.Fatalf("%s didn't get rolled back: %+v", item.ID, item)
+		}
+	}
+}
+
+func TestCheckpointNeedsFilter(t *testing.T) {
+	store := newTestStore(t)
+	err := store.Transaction(context.Background(), func(ctx context.Context, tx *Transaction) error {
+		return store.Checkpoint(ctx, tx, nil)
+	})
+	if err == nil {
+		t.Fatal("expected an error for a checkpoint without a filter")
+	}
+}
+
+func TestCheckpointInBatches(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	count := 2*_LOOKUP_BATCH_SIZE + 1
+	existing := make([]testItem, count)
+	values := make([]any, 0, 2*count)
+	for i := range existing {
+		existing[i] = testItem{ID: fmt.Sprint(i), Rank: 1}
+		values = append(values, fmt.Sprint(i), fmt.Sprint(count+i))
+	}
+	addItems(t, store, existing...)
+
+	err := store.Transaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		if err := store.CheckpointIn(ctx, tx, JSON{"rank": JSON{"$gte": 0}}, "_id", values); err != nil {
+			return err
+		}
+		if batches := (len(values) + _LOOKUP_BATCH_SIZE - 1) / _LOOKUP_BATCH_SIZE; len(tx.rollbacks) != batches {
+			t.Fatalf("expected %d batches, got %d", batches, len(tx.rollbacks))
+		}
+		added := make([]testItem, count)
+		for i := range added {
+			added[i] = testItem{ID: fmt.Sprint(count + i), Rank: 2}
+		}
+		addItems(t, store, added...)
+		if _, err := store.Delete(ctx, JSON{"_id": "0"}); err != nil {
+			return err
+		}
+		return StoreError("failed")
+	})
+	if err == nil {
+		t.Fatal("expected the error of the transaction")
+	}
+	items, err := store.Get(ctx, JSON{}, nil, nil, -1)
+	if err != nil || len(items) != count {
+		t.Fatalf("expected the %d items before the transaction, got %d %v", count, len(items), err)
+	}
+	for _, item := range items {
+		if item.Rank != 1 {
+			t.Fatalf("%s didn't get rolled back: %+v", item.ID, item)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package store
+
+import (
+	"math"
+	"net/url"
+	"strings"
+)
+
+const (
+	_ATLAS_CANDIDATES_FACTOR = 10    // numCandidates = factor x limit. Atlas recommends 10x to 20x
+	_ATLAS_MAX_CANDIDATES    = 10000 // upper limit of numCandidates allowed by Atlas
+	_DEFAULT_VECTOR_INDEX    = "vector_index"
+)
+
+// Mongo flavors have different aggregation stages for vector search.
+// A dialect creates the stages that find the top_n nearest neighbors of the query embedding that match the filter
+// and assign the cosine similarity to `search_score`. The rest of the search pipeline is the same for all dialects
+type VectorSearchDialect interface {
+	Name() string
+	CreateSearchStages(query_embedding []float32, vec_path, index_name string, top_n int, filter JSON) []JSON
+}
+
+// Azure Cosmos DB for MongoDB vCore `$search.cosmosSearch`
+func CosmosSearch() VectorSearchDialect {
+	return cosmosSearch{}
+}
+
+// MongoDB Atlas `$vectorSearch`. This needs an Atlas Vector Search index on the vector field
+func AtlasVectorSearch() VectorSearchDialect {
+	return atlasVectorSearch{}
+}
+
+// exact k-nearest-neighbor search that computes cosine similarity in the aggregation pipeline.
+// This works on any MongoDB but it scans every document that matches the filter
+func ExactVectorSearch() VectorSearchDialect {
+	return exactVectorSearch{}
+}
+
+// picks the dialect based on the host in the connection string. Anything that is not cosmos or atlas gets the exact search
+func detectVectorSearchDialect(connection_string string) VectorSearchDialect {
+	conn_url, err := url.Parse(connection_string)
+	if err != nil {
+		return ExactVectorSearch()
+	}
+	// there can be multiple hosts in the connection string
+	for _, host := range strings.Split(conn_url.Host, ",") {
+		host, _, _ = strings.Cut(strings.ToLower(host), ":")
+		switch {
+		case strings.HasSuffix(host, ".cosmos.azure.com"):
+			return CosmosSearch()
+		case strings.HasSuffix(host, ".mongodb.net"):
+			return AtlasVectorSearch()
+		}
+	}
+	return ExactVectorSearch()
+}
+
+type cosmosSearch struct{}
+
+func (cosmosSearch) Name() string {
+	return "cosmosSearch"
+}
+
+func (cosmosSearch) CreateSearchStages(query_embedding []float32, vec_path, _ string, top_n int, filter JSON) []JSON {
+	search := JSON{
+		"vector": query_embedding,
+		"path":   vec_path,
+		"k":      top_n,
+	}
+	// scalar filter is part of the search stage
+	if len(filter) > 0 {
+		search["filter"] = filter
+	}
+	return []JSON{
+		{
+			"$search": JSON{
+				"cosmosSearch":       search,
+				"returnStoredSource": true,
+			},
+		},
+		{
+			"$addFields": JSON{
+				"search_score": JSON{"$meta": "searchScore"},
+			},
+		},
+	}
+}
+
+type atlasVectorSearch struct{}
+
+func (atlasVectorSearch) Name() string {
+	return "vectorSearch"
+}
+
+func (atlasVectorSearch) CreateSearchStages(query_embedding []float32, vec_path, index_name string, top_n int, filter JSON) []JSON {
+	if index_name == "" {
+		index_name = _DEFAULT_VECTOR_INDEX
+	}
+	search := JSON{
+		"index":         index_name,
+		"path":          vec_path,
+		"queryVector":   query_embedding,
+		"numCandidates": min(top_n*_ATLAS_CANDIDATES_FACTOR, _ATLAS_MAX_CANDIDATES),
+		"limit":         top_n,
+	}
+	// the fields in the filter need to be indexed as `filter` fields in the vector search index
+	if len(filter) > 0 {
+		search["filter"] = filter
+	}
+	return []JSON{
+		{
+			"$vectorSearch": search,
+		},
+		{
+			// for cosine similarity atlas normalizes the score to (1 + cosine)/2
+			// converting it back so that the score thresholds mean the same thing across dialects
+			"$addFields": JSON{
+				"search_score": JSON{
+					"$subtract": []any{
+						JSON{"$multiply": []any{JSON{"$meta": "vectorSearchScore"}, 2}},
+						1,
+					},
+				},
+			},
+		},
+	}
+}
+
+type exactVectorSearch struct{}
+
+func (exactVectorSearch) Name() string {
+	return "exact"
+}
+
+func (exactVectorSearch) CreateSearchStages(query_embedding []float32, vec_path, _ string, top_n int, filter JSON) []JSON {
+	// normalizing the query ahead of time so that the pipeline only needs the norm of the stored vector
+	query := normalizeVector(query_embedding)
+	field := "$" + vec_path
+
+	match := JSON{vec_path: JSON{"$exists": true}}
+	if len(filter) > 0 {
+		match = JSON{"$and": []JSON{filter, match}}
+	}
+	dot_product := JSON{
+		"$reduce": JSON{
+			"input":        JSON{"$zip": JSON{"inputs": []any{field, query}}},
+			"initialValue": 0,
+			"in": JSON{
+				"$add": []any{
+					"$$value",
+					JSON{"$multiply": []any{
+						JSON{"$arrayElemAt": []any{"$$this", 0}},
+						JSON{"$arrayElemAt": []any{"$$this", 1}},
+					}},
+				},
+			},
+		},
+	}
+	norm := JSON{
+		"$sqrt": JSON{
+			"$reduce": JSON{
+				"input":        field,
+				"initialValue": 0,
+				"in":           JSON{"$add": []any{"$$value", JSON{"$multiply": []any{"$$this", "$$this"}}}},
+			},
+		},
+	}
+	return []JSON{
+		{
+			"$match": match,
+		},
+		{
+			"$addFields": JSON{
+				"search_score": JSON{
+					"$let": JSON{
+						"vars": JSON{"norm": norm},
+						"in": JSON{
+							"$cond": []any{
+								JSON{"$eq": []any{"$$norm", 0}},
+								0,
+								JSON{"$divide": []any{dot_product, "$$norm"}},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			"$sort": JSON{"search_score": -1},
+		},
+		{
+			"$limit": top_n,
+		},
+	}
+}
+
+func normalizeVector(vec []float32) []float32 {
+	var norm float64
+	for _, val := range vec {
+		norm += float64(val) * float64(val)
+	}
+	if norm == 0 {
+		return vec
+	}
+	norm = math.Sqrt(norm)
+	res := make([]float32, len(vec))
+	for i, val := range vec {
+		res[i] = float32(float64(val) / norm)
+	}
+	return res
+}
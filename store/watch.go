@@ -0,0 +1,395 @@
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"hash/fnv"
+	"log"
+	"maps"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	_DEFAULT_POLL_INTERVAL = time.Minute
+	_WATCH_BUFFER_SIZE     = 16 // changes that can wait in the channel before the watcher blocks
+)
+
+type ChangeKind string
+
+const (
+	ChangeInsert  ChangeKind = "insert"
+	ChangeUpdate  ChangeKind = "update"
+	ChangeReplace ChangeKind = "replace"
+	ChangeDelete  ChangeKind = "delete"
+)
+
+// Change is one insert, update, replace or delete of an item
+type Change[T any] struct {
+	Kind ChangeKind
+	ID   any // _id of the item
+	// the item after the change. Zero value for deletes and for updates of items that got deleted right after
+	Item T
+	// top level fields that an update changed. Empty for the other kinds of changes
+	Fields []string
+	// pass it to WithResumeToken to watch the changes that come after this one
+	ResumeToken string
+}
+
+// RawChange is the backend form of a change
+type RawChange struct {
+	Kind     ChangeKind
+	ID       any
+	Document bson.Raw // nil when there is no document after the change
+	// the document before the change. Only backends that keep pre-images have it
+	Before bson.Raw
+	Fields []string
+	// backend specific token to resume after this change. nil if the backend can't resume
+	ResumeToken bson.Raw
+}
+
+// ChangeStream walks through the changes as they happen. Next blocks until there is a change or ctx is done
+type ChangeStream interface {
+	Next(ctx context.Context) bool
+	Current() RawChange
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// Backends that can push the changes of the documents that match the filter.
+// Store polls the backends that don't implement it
+type Watcher interface {
+	Watch(ctx context.Context, filter JSON, resume_token bson.Raw) (ChangeStream, error)
+}
+
+// returned by Watcher.Watch when the deployment doesn't have change streams so that Store falls back to polling
+var ErrWatchNotSupported = StoreError("change streams are not supported")
+
+// Subscription delivers the changes that Watch picks up until it is closed or its context is done
+type Subscription[T any] struct {
+	changes chan Change[T]
+	cancel  context.CancelFunc
+	done    chan struct{}
+	err     error
+}
+
+// what the resume token holds. The watermark lets the polling fallback resume where a change stream left off and vice versa
+type watchToken struct {
+	Resume    bson.Raw `bson:"r,omitempty"`
+	Watermark any      `bson:"w,omitempty"`
+}
+
+// Delivers the inserts, updates, replaces and deletes of the items that match the filter.
+// Backends with change streams push the changes as they happen. The rest get polled every poll interval and
+// the changes are found by comparing the items with the previous poll, so the filter should keep the number of items small
+// or WithIncrementalPolling should limit the polls to the items that moved the watermark.
+// The filter applies to the items after the change. Deletes are delivered regardless of the filter since there is nothing left to match.
+// Resuming from a token replays the missed changes on change streams. Polling can only tell the items that were
+// added in the mean time and needs WithWatermarkField for it. The other missed changes are lost
+func (store *Store[T]) Watch(ctx context.Context, filter JSON, options ...WatchOption) (*Subscription[T], error) {
+	params := NewWatchParams(options...)
+	token, err := decodeWatchToken(params.ResumeToken)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := store.changeStream(ctx, filter, params, token)
+	if err != nil {
+		log.Printf("[%s]: Couldn't watch changes. %v\n", store.name, err)
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &Subscription[T]{
+		changes: make(chan Change[T], _WATCH_BUFFER_SIZE),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(sub.done)
+		defer close(sub.changes)
+		defer stream.Close(context.WithoutCancel(ctx))
+		sub.err = store.deliver(ctx, stream, params.WatermarkField, token.Watermark, sub.changes)
+	}()
+	return sub, nil
+}
+
+func (store *Store[T]) changeStream(ctx context.Context, filter JSON, params *WatchParams, token watchToken) (ChangeStream, error) {
+	if watcher, ok := store.backend.(Watcher); ok {
+		stream, err := watcher.Watch(ctx, filter, token.Resume)
+		if !errors.Is(err, ErrWatchNotSupported) {
+			return stream, err
+		}
+		log.Printf("[%s]: Change streams are not available. Polling every %v.\n", store.name, params.PollInterval)
+	}
+	return &pollStream{
+		poll: func(ctx context.Context, high_water any) (RawIterator, error) {
+			if high_water == nil {
+				return store.iterateRaw(ctx, filter, nil, nil, -1)
+			}
+			// the items at the high water mark get read again since more can come with the same value
+			after := JSON{"$and": []JSON{filterOrAll(filter), {params.WatermarkField: JSON{"$gte": high_water}}}}
+			return store.iterateRaw(ctx, after, nil, JSON{params.WatermarkField: 1}, -1)
+		},
+		interval:        params.PollInterval,
+		watermark_field: params.WatermarkField,
+		watermark:       token.Watermark,
+		incremental:     params.Incremental && params.WatermarkField != "",
+	}, nil
+}
+
+// reads the stream until it fails or ctx is done. A done ctx is not an error
+func (store *Store[T]) deliver(ctx context.Context, stream ChangeStream, watermark_field string, watermark any, changes chan<- Change[T]) error {
+	for stream.Next(ctx) {
+		raw := stream.Current()
+		change := Change[T]{Kind: raw.Kind, ID: raw.ID, Fields: raw.Fields}
+		if raw.Document != nil {
+			if err := store.unmarshal(raw.Document, &change.Item); err != nil {
+				log.Printf("[%s]: Couldn't unmarshall item. %v\n", store.name, err)
+				return err
+			}
+			if watermark_field != "" {
+				var doc bson.M
+				if err := bson.Unmarshal(raw.Document, &doc); err != nil {
+					return err
+				}
+				if val, later := afterWatermark(doc, watermark_field, watermark); later {
+					watermark = val
+				}
+			}
+		}
+		token, err := encodeWatchToken(watchToken{Resume: raw.ResumeToken, Watermark: watermark})
+		if err != nil {
+			return err
+		}
+		change.ResumeToken = token
+		select {
+		case changes <- change:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	if err := stream.Err(); err != nil && ctx.Err() == nil {
+		log.Printf("[%s]: Stopped watching changes. %v\n", store.name, err)
+		return err
+	}
+	return nil
+}
+
+// the channel gets closed when the subscription stops
+func (sub *Subscription[T]) Changes() <-chan Change[T] {
+	return sub.changes
+}
+
+// the error that stopped the subscription. nil if it was closed or its context is done. Only valid after Changes is closed
+func (sub *Subscription[T]) Err() error {
+	return sub.err
+}
+
+// stops the subscription and waits for it to let go of the backend
+func (sub *Subscription[T]) Close() {
+	sub.cancel()
+	<-sub.done
+}
+
+// the value of the watermark field if it comes after watermark
+func afterWatermark(doc bson.M, field string, watermark any) (any, bool) {
+	if field == "" {
+		return nil, false
+	}
+	val, found := lookupPath(doc, field)
+	if !found || val == nil {
+		return nil, false
+	}
+	return val, watermark == nil || sortOrder(val, watermark) > 0
+}
+
+func encodeWatchToken(token watchToken) (string, error) {
+	if token.Resume == nil && token.Watermark == nil {
+		return "", nil
+	}
+	data, err := bson.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeWatchToken(token string) (watchToken, error) {
+	var res watchToken
+	if token == "" {
+		return res, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || bson.Unmarshal(data, &res) != nil {
+		return watchToken{}, StoreError("invalid resume token")
+	}
+	return res, nil
+}
+
+// polledDoc is what a poll remembers of an item: its _id and a hash of each top level field
+type polledDoc struct {
+	id     any
+	fields map[string]uint64
+}
+
+// pollStream finds the changes by comparing the results of consecutive polls.
+// Incremental streams only read the items from the high water mark on after the first poll and can't tell the deletes
+type pollStream struct {
+	poll            func(ctx context.Context, high_water any) (RawIterator, error) // nil high_water reads all the items
+	interval        time.Duration
+	watermark_field string
+	watermark       any // items after it count as inserts in the first poll
+	incremental     bool
+
+	snapshot   map[string]polledDoc // nil before the first poll
+	high_water any                  // highest watermark seen so far. Only kept by the incremental streams
+	pending    []RawChange
+	current    RawChange
+	err        error
+}
+
+func (stream *pollStream) Next(ctx context.Context) bool {
+	for len(stream.pending) == 0 {
+		if stream.err != nil {
+			return false
+		}
+		if stream.snapshot != nil {
+			select {
+			case <-time.After(stream.interval):
+			case <-ctx.Done():
+				stream.err = ctx.Err()
+				return false
+			}
+		}
+		stream.err = stream.pollOnce(ctx)
+	}
+	stream.current, stream.pending = stream.pending[0], stream.pending[1:]
+	return true
+}
+
+func (stream *pollStream) pollOnce(ctx context.Context) error {
+	raws, err := stream.poll(ctx, stream.high_water)
+	if err != nil {
+		return err
+	}
+	defer raws.Close(ctx)
+	first := stream.snapshot == nil
+	snapshot := make(map[string]polledDoc, len(stream.snapshot))
+	for raws.Next(ctx) {
+		var doc bson.M
+		if err = bson.Unmarshal(raws.Current(), &doc); err != nil {
+			return err
+		}
+		key := uniqueKey(doc, []string{"_id"})
+		polled := polledDoc{id: doc["_id"], fields: hashFields(doc)}
+		snapshot[key] = polled
+		if val, later := afterWatermark(doc, stream.watermark_field, stream.high_water); later && stream.incremental {
+			stream.high_water = val
+		}
+		raw := append(bson.Raw(nil), raws.Current()...)
+		switch previous, found := stream.snapshot[key]; {
+		case first:
+			// nothing to compare with except the watermark of the resume token
+			if _, later := afterWatermark(doc, stream.watermark_field, stream.watermark); later && stream.watermark != nil {
+				stream.pending = append(stream.pending, RawChange{Kind: ChangeInsert, ID: polled.id, Document: raw})
+			}
+		case !found:
+			stream.pending = append(stream.pending, RawChange{Kind: ChangeInsert, ID: polled.id, Document: raw})
+		default:
+			if fields := changedFields(previous.fields, polled.fields); len(fields) > 0 {
+				stream.pending = append(stream.pending, RawChange{Kind: ChangeUpdate, ID: polled.id, Document: raw, Fields: fields})
+			}
+		}
+	}
+	if err = raws.Err(); err != nil {
+		return err
+	}
+	if stream.incremental && !first {
+		// the items that weren't read are as they were
+		maps.Copy(stream.snapshot, snapshot)
+		return nil
+	}
+	for key, previous := range stream.snapshot {
+		if _, found := snapshot[key]; !found {
+			stream.pending = append(stream.pending, RawChange{Kind: ChangeDelete, ID: previous.id})
+		}
+	}
+	stream.snapshot = snapshot
+	return nil
+}
+
+func (stream *pollStream) Current() RawChange {
+	return stream.current
+}
+
+// a done context is not an error for a stream that runs until it gets cancelled
+func (stream *pollStream) Err() error {
+	if errors.Is(stream.err, context.Canceled) || errors.Is(stream.err, context.DeadlineExceeded) {
+		return nil
+	}
+	return stream.err
+}
+
+func (stream *pollStream) Close(ctx context.Context) error {
+	stream.snapshot, stream.pending = nil, nil
+	return nil
+}
+
+// the documents come with their keys in any order so the values are hashed in a canonical form
+func hashFields(doc bson.M) map[string]uint64 {
+	res := make(map[string]uint64, len(doc))
+	for field, val := range doc {
+		data, err := bson.Marshal(bson.D{{Key: "v", Value: canonicalValue(val)}})
+		if err != nil {
+			continue
+		}
+		hash := fnv.New64a()
+		hash.Write(data)
+		res[field] = hash.Sum64()
+	}
+	return res
+}
+
+func canonicalValue(val any) any {
+	switch v := val.(type) {
+	case bson.M:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		res := make(bson.D, len(keys))
+		for i, key := range keys {
+			res[i] = bson.E{Key: key, Value: canonicalValue(v[key])}
+		}
+		return res
+	case bson.A:
+		res := make(bson.A, len(v))
+		for i, item := range v {
+			res[i] = canonicalValue(item)
+		}
+		return res
+	default:
+		return val
+	}
+}
+
+// fields that were added, removed or changed, sorted
+func changedFields(before, after map[string]uint64) []string {
+	var fields []string
+	for field, hash := range after {
+		if previous, found := before[field]; !found || previous != hash {
+			fields = append(fields, field)
+		}
+	}
+	for field := range before {
+		if _, found := after[field]; !found {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
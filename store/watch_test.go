@@ -0,0 +1,87 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// polls the stream once and returns the changes it found as kind:id[fields] along with how many items it read
+func pollChanges(t *testing.T, stream *pollStream) (string, int) {
+	t.Helper()
+	ctx := context.Background()
+	poll, read := stream.poll, 0
+	stream.poll = func(ctx context.Context, high_water any) (RawIterator, error) {
+		raws, err := poll(ctx, high_water)
+		if err != nil {
+			return nil, err
+		}
+		for raws.Next(ctx) {
+			read++
+		}
+		raws.Close(ctx)
+		return poll(ctx, high_water)
+	}
+	defer func() { stream.poll = poll }()
+
+	if err := stream.pollOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var changes []string
+	for _, change := range stream.pending {
+		changes = append(changes, fmt.Sprintf("%s:%v%v", change.Kind, change.ID, change.Fields))
+	}
+	stream.pending = nil
+	return fmt.Sprint(changes), read
+}
+
+func TestIncrementalPolling(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	addItems(t, store, testItem{ID: "a", Rank: 1}, testItem{ID: "b", Rank: 2})
+	params := NewWatchParams(WithWatermarkField("rank"), WithIncrementalPolling())
+	stream, err := store.changeStream(ctx, nil, params, watchToken{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	polling := stream.(*pollStream)
+	if changes, read := pollChanges(t, polling); changes != "[]" || read != 2 {
+		t.Fatalf("expected the first poll to read everything without changes, got %s after reading %d", changes, read)
+	}
+
+	addItems(t, store, testItem{ID: "c", Rank: 3})
+	if _, err := store.Update(ctx, []any{JSON{"title": "moved"}, JSON{"title": "same rank"}}, []JSON{{"_id": "b"}, {"_id": "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	// b is at the high water mark so it gets read again. a is below it so its update is missed
+	if changes, read := pollChanges(t, polling); changes != "[update:b[title] insert:c[]]" || read != 2 {
+		t.Fatalf("unexpected changes %s after reading %d", changes, read)
+	}
+
+	if _, err := store.Delete(ctx, JSON{"_id": "c"}); err != nil {
+		t.Fatal(err)
+	}
+	// the delete is missed and only the items from the new high water mark get read
+	if changes, read := pollChanges(t, polling); changes != "[]" || read != 0 {
+		t.Fatalf("unexpected changes %s after reading %d", changes, read)
+	}
+}
+
+func TestPollingFindsDeletes(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	addItems(t, store, testItem{ID: "a", Rank: 1}, testItem{ID: "b", Rank: 2})
+	stream, err := store.changeStream(ctx, nil, NewWatchParams(WithWatermarkField("rank")), watchToken{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	polling := stream.(*pollStream)
+	pollChanges(t, polling)
+
+	if _, err := store.Delete(ctx, JSON{"_id": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if changes, read := pollChanges(t, polling); changes != "[delete:b[]]" || read != 1 {
+		t.Fatalf("expected the delete of b after reading everything, got %s after reading %d", changes, read)
+	}
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"context"
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	datautils "github.com/soumitsalman/data-utils"
+)
+
+// WritePolicy decides what Store.Add does with the docs that already exist in the store.
+// A doc exists if the equals function of the store matches it with a stored item. Without id and equals functions every doc is new
+type WritePolicy int
+
+const (
+	// existing docs are left as is
+	SkipExisting WritePolicy = iota
+	// existing docs are replaced by the new ones. The fields that the new doc doesn't have are gone
+	ReplaceExisting
+	// the non-empty fields of the new docs are set on the existing ones. The rest of the existing fields stay
+	MergeExisting
+	// existing docs are replaced only if the content hash of the new doc is different. This needs WithContentHash
+	ReplaceIfChanged
+)
+
+func (policy WritePolicy) String() string {
+	switch policy {
+	case SkipExisting:
+		return "skip"
+	case ReplaceExisting:
+		return "replace"
+	case MergeExisting:
+		return "merge"
+	case ReplaceIfChanged:
+		return "replace if changed"
+	default:
+		return "unknown"
+	}
+}
+
+// picks the duplicates that have to be written over the existing items based on the write policy.
+// existing_items can be nil in which case they are looked up if the policy needs them
+func (store *Store[T]) applyWritePolicy(ctx context.Context, duplicates []T, existing_items map[string]T) ([]T, error) {
+	switch store.write_policy {
+	case ReplaceExisting, MergeExisting:
+		return duplicates, nil
+	case ReplaceIfChanged:
+		if store.content_hash == nil {
+			return nil, StoreError("content hash function is not set for " + store.write_policy.String())
+		}
+		if existing_items == nil {
+			var err error
+			if existing_items, err = store.getExisting(ctx, duplicates); err != nil {
+				return nil, err
+			}
+		}
+		changed_docs := make([]T, 0, len(duplicates))
+		for i := range duplicates {
+			existing, ok := existing_items[store.idKey(&duplicates[i])]
+			if ok && store.content_hash(&duplicates[i]) != store.content_hash(&existing) {
+				changed_docs = append(changed_docs, duplicates[i])
+			}
+		}
+		return changed_docs, nil
+	default:
+		return nil, nil
+	}
+}
+
+// writes the docs over the existing items based on the write policy
+func (store *Store[T]) writeExisting(ctx context.Context, docs []T) (UpdateResult, error) {
+	filters := store.getIDs(docs)
+	updates := datautils.Transform(docs, func(item *T) any { return *item })
+	var err error
+	if store.write_policy == MergeExisting {
+		for i := range docs {
+			if updates[i], err = nonEmptyFields(docs[i]); err != nil {
+				return failAll(len(docs), err), err
+			}
+		}
+	}
+	if updates, err = store.quantize(updates); err != nil {
+		return failAll(len(docs), err), err
+	}
+	if store.write_policy != MergeExisting {
+		return store.backend.Replace(ctx, updates, filters)
+	}
+	return store.backend.Update(ctx, updates, filters)
+}
+
+func failAll(count int, err error) UpdateResult {
+	res := UpdateResult{}
+	for i := 0; i < count; i++ {
+		res.fail(i, err)
+	}
+	return res
+}
+
+// the top level fields of the doc that are not zero values. _id is left out so that the existing item keeps its own
+func nonEmptyFields(doc any) (bson.M, error) {
+	fields, err := toDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	for key, val := range fields {
+		if key == "_id" || isEmptyValue(val) {
+			delete(fields, key)
+		}
+	}
+	return fields, nil
+}
+
+func isEmptyValue(val any) bool {
+	if val == nil {
+		return true
+	}
+	value := reflect.ValueOf(val)
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String:
+		return value.Len() == 0
+	default:
+		return value.IsZero()
+	}
+}